@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"chat-server/pkg/chatclient"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func main() {
+	transport := flag.String("transport", "tcp", "tcp, websocket or gRPC")
+	addr := flag.String("addr", "localhost:8080", "server host:port, or the ws:// / wss:// URL for websocket")
+	useTLS := flag.Bool("tls", false, "connect with TLS (TLS over TCP, gRPC with TLS); websocket uses the wss:// URL")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification (self-signed certs, dev only)")
+	username := flag.String("user", "", "username, asked interactively when empty")
+	password := flag.String("password", "", "password, when the server requires one")
+	flag.Parse()
+
+	if *username == "" {
+		fmt.Print("Username: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "chat: %v\n", err)
+			os.Exit(1)
+		}
+		*username = strings.TrimSpace(line)
+	}
+
+	opts := chatclient.Options{
+		Transport: chatclient.Transport(*transport),
+		Address:   *addr,
+		Reconnect: true,
+	}
+	if *transport == string(chatclient.WebSocket) && !strings.Contains(*addr, "://") {
+		opts.Address = "ws://" + *addr + "/ws"
+	}
+	if *useTLS || strings.HasPrefix(opts.Address, "wss://") {
+		opts.TLSConfig = &tls.Config{InsecureSkipVerify: *insecure, MinVersion: tls.VersionTLS12}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := chatclient.Dial(ctx, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "chat: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	if err := client.Join(ctx, *username, *password); err != nil {
+		fmt.Fprintf(os.Stderr, "chat: %v\n", err)
+		os.Exit(1)
+	}
+
+	program := tea.NewProgram(newModel(client, *username), tea.WithAltScreen())
+	if _, err := program.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "chat: %v\n", err)
+		os.Exit(1)
+	}
+}
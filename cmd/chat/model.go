@@ -0,0 +1,314 @@
+package main
+
+import (
+	"chat-server/pkg/chatclient"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	lobby          = "#lobby"
+	userListWidth  = 22
+	scrollbackSize = 1000
+)
+
+var (
+	nickColors = []lipgloss.Color{"1", "2", "3", "4", "5", "6", "9", "10", "11", "12", "13", "14"}
+
+	activeTabStyle   = lipgloss.NewStyle().Reverse(true).Bold(true).Padding(0, 1)
+	tabStyle         = lipgloss.NewStyle().Padding(0, 1)
+	unreadTabStyle   = lipgloss.NewStyle().Padding(0, 1).Bold(true).Foreground(lipgloss.Color("11"))
+	systemStyle      = lipgloss.NewStyle().Faint(true).Italic(true)
+	announceStyle    = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("11"))
+	timeStyle        = lipgloss.NewStyle().Faint(true)
+	userListStyle    = lipgloss.NewStyle().Width(userListWidth).BorderStyle(lipgloss.NormalBorder()).BorderLeft(true).PaddingLeft(1)
+	userListTitle    = lipgloss.NewStyle().Bold(true).Underline(true)
+	inputBorderStyle = lipgloss.NewStyle().BorderStyle(lipgloss.NormalBorder()).BorderTop(true)
+)
+
+// eventMsg carries an event from the chat client into the bubbletea loop
+type eventMsg chatclient.Event
+
+// closedMsg tells the connection is gone for good
+type closedMsg struct{}
+
+// tab is the lobby or a private conversation ("@user") with its scrollback
+type tab struct {
+	name   string
+	lines  []string
+	unread bool
+}
+
+type model struct {
+	client   *chatclient.Client
+	username string
+	tabs     []*tab
+	active   int
+	users    map[string]struct{}
+	viewport viewport.Model
+	input    textinput.Model
+	width    int
+	height   int
+}
+
+func newModel(client *chatclient.Client, username string) *model {
+	input := textinput.New()
+	input.Placeholder = "message, /pm <user> <text>, /users, /quit — tab switches conversations"
+	input.Prompt = "> "
+	input.Focus()
+
+	return &model{
+		client:   client,
+		username: username,
+		tabs:     []*tab{{name: lobby}},
+		users:    map[string]struct{}{username: {}},
+		viewport: viewport.New(0, 0),
+		input:    input,
+	}
+}
+
+func (m *model) Init() tea.Cmd {
+	return tea.Batch(textinput.Blink, m.waitForEvent(), m.requestUsers())
+}
+
+// waitForEvent delivers the next client event as an eventMsg
+func (m *model) waitForEvent() tea.Cmd {
+	return func() tea.Msg {
+		evt, ok := <-m.client.Messages()
+		if !ok {
+			return closedMsg{}
+		}
+		return eventMsg(evt)
+	}
+}
+
+func (m *model) requestUsers() tea.Cmd {
+	return func() tea.Msg {
+		_ = m.client.RequestUsers()
+		return nil
+	}
+}
+
+func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.viewport.Width = max(msg.Width-userListWidth-1, 10)
+		m.viewport.Height = max(msg.Height-4, 3)
+		m.input.Width = max(msg.Width-3, 10)
+		m.refresh()
+		return m, nil
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "esc":
+			_ = m.client.Close()
+			return m, tea.Quit
+		case "tab", "ctrl+right":
+			m.switchTo((m.active + 1) % len(m.tabs))
+			return m, nil
+		case "shift+tab", "ctrl+left":
+			m.switchTo((m.active + len(m.tabs) - 1) % len(m.tabs))
+			return m, nil
+		case "ctrl+w":
+			if m.active != 0 {
+				m.tabs = slices.Delete(m.tabs, m.active, m.active+1)
+				m.switchTo(m.active - 1)
+			}
+			return m, nil
+		case "enter":
+			return m, m.submit()
+		case "pgup", "pgdown", "up", "down":
+			var cmd tea.Cmd
+			m.viewport, cmd = m.viewport.Update(msg)
+			return m, cmd
+		}
+
+	case eventMsg:
+		cmd := m.handleEvent(chatclient.Event(msg))
+		return m, tea.Batch(cmd, m.waitForEvent())
+
+	case closedMsg:
+		m.appendTo(m.tabs[0], systemStyle.Render("-- connection closed, press esc to exit"))
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+// submit sends the input line to the lobby or to the peer of the active private tab
+func (m *model) submit() tea.Cmd {
+	text := strings.TrimSpace(m.input.Value())
+	m.input.Reset()
+	if text == "" {
+		return nil
+	}
+
+	current := m.tabs[m.active]
+	var err error
+	switch {
+	case text == "/quit":
+		_ = m.client.Close()
+		return tea.Quit
+	case strings.HasPrefix(text, "/pm "):
+		parts := strings.SplitN(text, " ", 3)
+		if len(parts) < 3 {
+			m.appendTo(current, systemStyle.Render("-- usage: /pm <username> <message>"))
+			return nil
+		}
+		if err = m.client.PrivateMessage(parts[1], parts[2]); err == nil {
+			peer := m.tab("@" + parts[1])
+			m.appendTo(peer, m.formatMessage(m.username, parts[2]))
+			m.switchTo(slices.Index(m.tabs, peer))
+		}
+	case strings.HasPrefix(text, "/"):
+		// other commands are answered by the server
+		err = m.client.Send(text)
+	case current.name != lobby:
+		if err = m.client.PrivateMessage(strings.TrimPrefix(current.name, "@"), text); err == nil {
+			m.appendTo(current, m.formatMessage(m.username, text))
+		}
+	default:
+		if err = m.client.Send(text); err == nil {
+			m.appendTo(current, m.formatMessage(m.username, text))
+		}
+	}
+
+	if err != nil {
+		m.appendTo(current, systemStyle.Render("-- "+err.Error()))
+	}
+	return nil
+}
+
+func (m *model) handleEvent(evt chatclient.Event) tea.Cmd {
+	switch evt.Type {
+	case chatclient.EventChat:
+		m.appendTo(m.tabs[0], m.formatMessage(evt.From, evt.Text))
+	case chatclient.EventPrivate:
+		m.appendTo(m.tab("@"+evt.From), m.formatMessage(evt.From, evt.Text))
+	case chatclient.EventJoin:
+		m.users[evt.From] = struct{}{}
+		m.appendTo(m.tabs[0], systemStyle.Render(fmt.Sprintf("-- %s joined", evt.From)))
+	case chatclient.EventLeave:
+		delete(m.users, evt.From)
+		m.appendTo(m.tabs[0], systemStyle.Render(fmt.Sprintf("-- %s left", evt.From)))
+	case chatclient.EventAnnouncement:
+		m.appendTo(m.tabs[0], announceStyle.Render("** "+evt.Text))
+	case chatclient.EventUsers:
+		m.users = make(map[string]struct{}, len(evt.Users))
+		for _, user := range evt.Users {
+			m.users[user] = struct{}{}
+		}
+		m.refresh()
+	case chatclient.EventNotice:
+		m.appendTo(m.tabs[m.active], systemStyle.Render("-- "+evt.Text))
+	case chatclient.EventDisconnected:
+		m.users = map[string]struct{}{m.username: {}}
+		m.appendTo(m.tabs[0], systemStyle.Render(fmt.Sprintf("-- connection lost (%v), reconnecting...", evt.Err)))
+	case chatclient.EventReconnected:
+		m.appendTo(m.tabs[0], systemStyle.Render("-- "+evt.Text))
+		return m.requestUsers()
+	}
+	return nil
+}
+
+// tab returns the tab called name, opening it if needed
+func (m *model) tab(name string) *tab {
+	for _, t := range m.tabs {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &tab{name: name}
+	m.tabs = append(m.tabs, t)
+	return t
+}
+
+func (m *model) switchTo(index int) {
+	m.active = index
+	m.tabs[index].unread = false
+	m.refresh()
+	m.viewport.GotoBottom()
+}
+
+func (m *model) appendTo(t *tab, line string) {
+	t.lines = append(t.lines, line)
+	if len(t.lines) > scrollbackSize {
+		t.lines = t.lines[len(t.lines)-scrollbackSize:]
+	}
+	if t != m.tabs[m.active] {
+		t.unread = true
+		return
+	}
+
+	atBottom := m.viewport.AtBottom()
+	m.refresh()
+	if atBottom {
+		m.viewport.GotoBottom()
+	}
+}
+
+// refresh renders the active tab into the viewport, wrapping lines to its width
+func (m *model) refresh() {
+	wrap := lipgloss.NewStyle().Width(m.viewport.Width)
+	lines := make([]string, len(m.tabs[m.active].lines))
+	for i, line := range m.tabs[m.active].lines {
+		lines[i] = wrap.Render(line)
+	}
+	m.viewport.SetContent(strings.Join(lines, "\n"))
+}
+
+func (m *model) formatMessage(from, text string) string {
+	return fmt.Sprintf("%s %s %s", timeStyle.Render(time.Now().Format("15:04")), nick(from), text)
+}
+
+// nick colors a username with a color derived from its hash, so it is the same everywhere
+func nick(username string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(username))
+	color := nickColors[h.Sum32()%uint32(len(nickColors))]
+	return lipgloss.NewStyle().Bold(true).Foreground(color).Render("<" + username + ">")
+}
+
+func (m *model) View() string {
+	if m.width == 0 {
+		return "connecting..."
+	}
+
+	var tabs []string
+	for i, t := range m.tabs {
+		switch {
+		case i == m.active:
+			tabs = append(tabs, activeTabStyle.Render(t.name))
+		case t.unread:
+			tabs = append(tabs, unreadTabStyle.Render(t.name+"*"))
+		default:
+			tabs = append(tabs, tabStyle.Render(t.name))
+		}
+	}
+
+	users := slices.Sorted(maps.Keys(m.users))
+	list := []string{userListTitle.Render(fmt.Sprintf("Users (%d)", len(users)))}
+	for _, user := range users {
+		list = append(list, nick(user))
+	}
+	userPane := userListStyle.Height(m.viewport.Height).Render(strings.Join(list, "\n"))
+
+	body := lipgloss.JoinHorizontal(lipgloss.Top, m.viewport.View(), userPane)
+	return lipgloss.JoinVertical(lipgloss.Left,
+		strings.Join(tabs, " "),
+		body,
+		inputBorderStyle.Width(m.width).Render(m.input.View()),
+	)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	chatpb "chat-server/internal/server/network/grpc"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const usage = `chatctl manages a running chat server through its AdminService.
+
+Usage:
+  chatctl [flags] <command> [arguments]
+
+Commands:
+  clients                          list connected clients
+  kick <username> [reason]         disconnect a client
+  ban <username>                   ban and kick a user
+  unban <username>                 lift a ban
+  mute <username> [seconds]        mute a user, forever when seconds is omitted
+  unmute <username>                lift a mute
+  announce <text>                  send a system message to everyone
+  reload                           reload config.yml
+  stats                            show server statistics
+  drain [deadline-seconds] [text]  stop accepting clients, kick the rest after the deadline
+
+Flags:
+`
+
+func main() {
+	socket := flag.String("socket", "chat-admin.sock", "Unix socket of the AdminService")
+	addr := flag.String("addr", "", "host:port of the mTLS AdminService, used instead of -socket")
+	certFile := flag.String("cert", "", "client certificate for -addr")
+	keyFile := flag.String("key", "", "client private key for -addr")
+	caFile := flag.String("ca", "", "CA verifying the server certificate for -addr")
+	serverName := flag.String("server-name", "", "expected server name in the certificate, defaults to the -addr host")
+	timeout := flag.Duration("timeout", 5*time.Second, "request timeout")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := dial(*socket, *addr, *certFile, *keyFile, *caFile, *serverName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "chatctl: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if err := run(ctx, chatpb.NewAdminServiceClient(conn), flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "chatctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// dial connects to the AdminService over the Unix socket, or over mTLS when addr is set
+func dial(socket, addr, certFile, keyFile, caFile, serverName string) (*grpc.ClientConn, error) {
+	if addr == "" {
+		return grpc.NewClient("unix:"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("-cert, -key and -ca are required with -addr")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	})
+	return grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+}
+
+func run(ctx context.Context, client chatpb.AdminServiceClient, command string, args []string) error {
+	switch command {
+	case "clients":
+		resp, err := client.ListClients(ctx, &chatpb.ListClientsRequest{})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tTRANSPORT\tCONNECTED\tMUTED")
+		for _, c := range resp.GetClients() {
+			connected := time.Since(time.Unix(c.GetConnectedAtUnix(), 0)).Round(time.Second)
+			fmt.Fprintf(w, "%s\t%s\t%s ago\t%v\n", c.GetUsername(), c.GetTransport(), connected, c.GetMuted())
+		}
+		return w.Flush()
+
+	case "kick":
+		if len(args) < 1 {
+			return errors.New("usage: kick <username> [reason]")
+		}
+		return printStatus(client.Kick(ctx, &chatpb.KickRequest{Username: args[0], Reason: strings.Join(args[1:], " ")}))
+
+	case "ban", "unban":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <username>", command)
+		}
+		if command == "ban" {
+			return printStatus(client.Ban(ctx, &chatpb.BanRequest{Username: args[0]}))
+		}
+		return printStatus(client.Unban(ctx, &chatpb.BanRequest{Username: args[0]}))
+
+	case "mute":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("usage: mute <username> [seconds]")
+		}
+		var seconds int64
+		if len(args) == 2 {
+			var err error
+			if seconds, err = strconv.ParseInt(args[1], 10, 64); err != nil || seconds < 0 {
+				return fmt.Errorf("invalid duration %q", args[1])
+			}
+		}
+		return printStatus(client.Mute(ctx, &chatpb.MuteRequest{Username: args[0], DurationSeconds: seconds}))
+
+	case "unmute":
+		if len(args) != 1 {
+			return errors.New("usage: unmute <username>")
+		}
+		return printStatus(client.Unmute(ctx, &chatpb.MuteRequest{Username: args[0]}))
+
+	case "announce":
+		if len(args) == 0 {
+			return errors.New("usage: announce <text>")
+		}
+		return printStatus(client.Announce(ctx, &chatpb.AnnounceRequest{Text: strings.Join(args, " ")}))
+
+	case "reload":
+		return printStatus(client.ReloadConfig(ctx, &chatpb.ReloadConfigRequest{}))
+
+	case "stats":
+		resp, err := client.Stats(ctx, &chatpb.StatsRequest{})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("clients:   %d\n", resp.GetClients())
+		for _, transport := range slices.Sorted(maps.Keys(resp.GetTransports())) {
+			fmt.Printf("  %-10s %d\n", transport+":", resp.GetTransports()[transport])
+		}
+		fmt.Printf("banned:    %s\n", strings.Join(resp.GetBannedUsers(), ", "))
+		fmt.Printf("muted:     %s\n", strings.Join(resp.GetMutedUsers(), ", "))
+		fmt.Printf("draining:  %v\n", resp.GetDraining())
+		fmt.Printf("started:   %s\n", time.Unix(resp.GetStartedAtUnix(), 0).Format(time.RFC3339))
+		fmt.Printf("uptime:    %s\n", time.Duration(resp.GetUptimeSeconds())*time.Second)
+		return nil
+
+	case "drain":
+		req := &chatpb.DrainRequest{}
+		if len(args) > 0 {
+			seconds, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("invalid deadline %q", args[0])
+			}
+			req.DeadlineSeconds = seconds
+			req.Message = strings.Join(args[1:], " ")
+		}
+		return printStatus(client.Drain(ctx, req))
+
+	default:
+		return fmt.Errorf("unknown command %q, run chatctl -h for usage", command)
+	}
+}
+
+func printStatus(resp *chatpb.AdminResponse, err error) error {
+	if err != nil {
+		return err
+	}
+	fmt.Println(resp.GetStatus())
+	return nil
+}
@@ -1,88 +1,232 @@
 package main
 
 import (
+	"chat-server/internal/admin"
 	"chat-server/internal/config"
+	"chat-server/internal/logging"
+	"chat-server/internal/moderation"
+	"chat-server/internal/plugin"
 	"chat-server/internal/server"
+	"chat-server/internal/server/federation"
 	grpcserver "chat-server/internal/server/grpcserver"
+	"chat-server/internal/server/irc"
 	"chat-server/internal/server/network"
 	chatpb "chat-server/internal/server/network/grpc"
+	"chat-server/internal/server/redisbackplane"
+	"chat-server/internal/server/sshserver"
+	"chat-server/internal/server/web"
+	"chat-server/internal/upgrade"
+	"chat-server/internal/webhook"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/websocket"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
-	cfg, err := config.LoadConfig()
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		os.Exit(configCheck(os.Args[3:]))
+	}
+
+	configPath := flag.String("config", "", "path to the config file (default ./config.yml)")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig(*configPath)
 	if err != nil {
 		fmt.Printf("error loading config: %v\n", err)
 		return
 	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Printf("invalid config %s:\n%v\n", config.File(), err)
+		return
+	}
 
-	chatServer := server.NewChatServer()
+	if err := logging.Setup(cfg.Log); err != nil {
+		fmt.Printf("error setting up logging: %v\n", err)
+		return
+	}
 
-	if cfg.Server.Type == "tcp" {
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Server.Port))
+	backplane, err := newBackplane(cfg.Backplane)
+	if err != nil {
+		fmt.Printf("Error connecting to backplane: %v\n", err)
+		return
+	}
+	defer backplane.Close()
+	chatServer, err := server.NewChatServerWithBackplane(backplane)
+	if err != nil {
+		fmt.Printf("Error connecting to backplane: %v\n", err)
+		return
+	}
+	chatServer.SetBannedUsers(cfg.Security.BannedUsers)
+	chatServer.SetRoles(cfg.Security.Moderators, cfg.Security.Admins)
+
+	if len(cfg.Webhooks.Endpoints) > 0 {
+		chatServer.AddHook(webhook.New(cfg.Webhooks).Handle)
+	}
+
+	store := config.NewStore(cfg)
+	store.OnReload(func(old, updated *config.Config) {
+		logging.SetLevel(updated.Log.Level)
+		chatServer.SetBannedUsers(updated.Security.BannedUsers)
+		chatServer.SetRoles(updated.Security.Moderators, updated.Security.Admins)
+		if old.RateLimit != updated.RateLimit {
+			chatServer.SetRateLimit(updated.RateLimit.MessagePerSecond)
+		}
+	})
+	store.Watch()
+	go reloadOnSignal(store)
+
+	// Middleware chains, in order: cheap checks first, the hash and the log see the final text
+	chatServer.UseInbound("length", server.LengthLimit(store))
+	chatServer.UseInbound("rateLimit", server.RateLimit())
+	// moderation masks the words of message.profanity itself, with its homoglyph normalization
+	if cfg.Moderation.Enabled {
+		audit, err := logging.Audit(cfg.Log)
 		if err != nil {
-			fmt.Printf("Error listening on port 8080: %d, Err:%v\n", cfg.Server.Port, err)
+			fmt.Printf("Error opening audit log: %v\n", err)
+			return
+		}
+		if err := moderation.New(chatServer, store, audit).Serve(); err != nil {
+			fmt.Printf("Error starting moderation: %v\n", err)
 			return
 		}
+	} else {
+		chatServer.UseInbound("profanity", server.ProfanityFilter(store))
+	}
+	if cfg.Plugins.Enabled {
+		if err := plugin.New(chatServer, cfg.Plugins).Serve(); err != nil {
+			fmt.Printf("Error loading plugins: %v\n", err)
+			return
+		}
+	}
+	chatServer.UseInbound("hash", server.Hashing(store))
+	chatServer.UseInbound("log", server.Logging(server.DirectionInbound))
+	chatServer.UseOutbound("log", server.Logging(server.DirectionOutbound))
+
+	adminServer := admin.New(chatServer, store)
+	if cfg.Admin.Enabled {
+		if err := adminServer.Serve(); err != nil {
+			fmt.Printf("Error starting admin server: %v\n", err)
+			return
+		}
+	}
+	if err := admin.NewService(chatServer, store).Serve(cfg); err != nil {
+		fmt.Printf("Error starting admin service: %v\n", err)
+		return
+	}
+	if cfg.IRC.Enabled {
+		if err := irc.New(chatServer, store).Serve(cfg); err != nil {
+			fmt.Printf("Error starting IRC gateway: %v\n", err)
+			return
+		}
+	}
+	if cfg.SSH.Enabled {
+		if err := sshserver.New(chatServer, store).Serve(cfg); err != nil {
+			fmt.Printf("Error starting SSH server: %v\n", err)
+			return
+		}
+	}
+	if cfg.Federation.Enabled {
+		if err := federation.New(chatServer, store).Serve(cfg); err != nil {
+			fmt.Printf("Error starting federation: %v\n", err)
+			return
+		}
+	}
+
+	// TCP on server.host:server.port or the sockets passed by systemd, plus server.socket
+	listener, err := network.ListenServer(cfg.Server)
+	if err != nil {
+		fmt.Printf("Error listening: %v\n", err)
+		return
+	}
+	if cfg.Server.Socket != "" {
+		log.Printf("Chat server also listening on unix:%s\n", cfg.Server.Socket)
+	}
+	if cfg.Server.Type == "tcp" || cfg.Server.Type == "gRPC" {
+		// websocket clients behind a proxy are identified by the forwarded headers instead
+		listener = network.NewProxyListener(listener, store)
+	}
 
+	var serve func() error
+	if cfg.Server.Type == "tcp" {
 		if cfg.TLS.TLSRequire {
 			tlsListener, err := network.NewTLS(listener, cfg.TLS)
 			if err != nil {
 				fmt.Printf("Error creating TLS listener: %v\n", err)
 				return
 			}
-			fmt.Printf("TCP(As TLS) Chat server listening on port :%d \n", cfg.Server.Port)
-			for {
-				conn, err := tlsListener.Accept()
-				if err != nil {
-					log.Printf("Error accepting connection: %v\n", err)
-					continue
+			fmt.Printf("TCP(As TLS) Chat server listening on %s \n", listener.Addr())
+			serve = func() error {
+				for {
+					conn, err := tlsListener.Accept()
+					if errors.Is(err, net.ErrClosed) {
+						return err
+					}
+					if err != nil {
+						log.Printf("Error accepting connection: %v\n", err)
+						continue
+					}
+					go func() {
+						if err := network.Handshake(conn); err != nil {
+							log.Printf("TLS handshake failed: %v\n", err)
+							conn.Close()
+							return
+						}
+						server.HandleConnection(newTCPConnection(conn, store), chatServer, store)
+					}()
 				}
-				go server.HandleConnection(network.NewTCPConnection(conn), chatServer, cfg)
 			}
 		} else {
-			fmt.Printf("TCP(As not TLS) Chat server listening on port :%d \n", cfg.Server.Port)
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					log.Printf("Error accepting connection: %v\n", err)
-					continue
+			fmt.Printf("TCP(As not TLS) Chat server listening on %s \n", listener.Addr())
+			serve = func() error {
+				for {
+					conn, err := listener.Accept()
+					if errors.Is(err, net.ErrClosed) {
+						return err
+					}
+					if err != nil {
+						log.Printf("Error accepting connection: %v\n", err)
+						continue
+					}
+					go server.HandleConnection(newTCPConnection(conn, store), chatServer, store)
 				}
-				go server.HandleConnection(network.NewTCPConnection(conn), chatServer, cfg)
 			}
 		}
 	} else if cfg.Server.Type == "websocket" {
-		upgrader := websocket.Upgrader{}
-		http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-			wsConn, err := upgrader.Upgrade(w, r, nil)
-			if err != nil {
-				log.Printf("Error upgrading websocket: %s\n", err)
-				return
-			}
-			go server.HandleConnection(network.NewWSConnection(wsConn), chatServer, cfg)
-		})
+		handle := func(conn network.Connection) {
+			server.HandleConnection(conn, chatServer, store)
+		}
+		http.Handle(cfg.WebSocket.Path, network.NewWSHandler(store, handle))
+		http.Handle("POST /hooks/{room}/{token}", adminServer.IncomingWebhooks())
+		if cfg.SSE.Enabled {
+			sse := network.NewSSEHandler(store, handle)
+			http.Handle("/sessions", sse)
+			http.Handle("/events", sse)
+			http.Handle("/messages", sse)
+		}
+		if cfg.WebSocket.WebClient {
+			http.Handle("/", web.Handler(web.Options{WSPath: cfg.WebSocket.Path, SSE: cfg.SSE.Enabled}))
+		}
 
-		addr := fmt.Sprintf(":%d", cfg.Server.Port)
+		httpSrv := &http.Server{ErrorLog: network.NewHTTPErrorLog()}
 		if cfg.TLS.TLSRequire {
-			log.Printf("Websocket (WSS) chat server listening on port %d\n", cfg.Server.Port)
-			log.Fatal(http.ListenAndServeTLS(addr, cfg.TLS.CertFile, cfg.TLS.KeyFile, nil))
+			log.Printf("Websocket (WSS) chat server listening on %s, path %s\n", listener.Addr(), cfg.WebSocket.Path)
+			serve = func() error { return httpSrv.ServeTLS(listener, cfg.TLS.CertFile, cfg.TLS.KeyFile) }
 		} else {
-			log.Printf("Websocket (WS) chat server listening on port %d\n", cfg.Server.Port)
-			log.Fatal(http.ListenAndServe(addr, nil))
+			log.Printf("Websocket (WS) chat server listening on %s, path %s\n", listener.Addr(), cfg.WebSocket.Path)
+			serve = func() error { return httpSrv.Serve(listener) }
 		}
 	} else if cfg.Server.Type == "gRPC" {
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Server.Port))
-		if err != nil {
-			fmt.Printf("Error listening on port %d : , Err:%v\n", cfg.Server.Port, err)
-			return
-		}
-
 		var opts []grpc.ServerOption
 		if cfg.TLS.TLSRequire {
 			creds, err := network.NewGRPCTLSCredentials(cfg.TLS)
@@ -93,12 +237,118 @@ func main() {
 		}
 
 		grpcSrv := grpc.NewServer(opts...)
-		grpcService := grpcserver.New(chatServer, cfg)
+		grpcService := grpcserver.New(chatServer, store)
 		chatpb.RegisterChatServiceServer(grpcSrv, grpcService)
 
-		log.Printf("gRPC chat server listening on port %d (tls=%v)\n", cfg.Server.Port, cfg.TLS.TLSRequire)
-		log.Fatal(grpcSrv.Serve(listener))
+		healthServer := health.NewServer()
+		healthpb.RegisterHealthServer(grpcSrv, healthServer)
+		healthServer.SetServingStatus(chatpb.ChatService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+		// a draining replica refuses new streams, the load balancers have to stop sending them
+		chatServer.OnDrain(healthServer.Shutdown)
+
+		log.Printf("gRPC chat server listening on %s (tls=%v)\n", listener.Addr(), cfg.TLS.TLSRequire)
+		serve = func() error { return grpcSrv.Serve(listener) }
 	} else {
 		log.Printf("Unknown type: %s\n", cfg.Server.Type)
+		return
+	}
+
+	// every listener is up, sockets inherited for disabled transports are not needed
+	network.CloseUnusedInherited()
+	adminServer.SetReady(true)
+	if err := upgrade.Ready(cfg.Upgrade.PIDFile); err != nil {
+		log.Printf("Error signaling readiness: %v\n", err)
+	}
+
+	upgrader := upgrade.New(store)
+	go upgradeOnSignal(upgrader)
+
+	err = serve()
+	if upgrader.Upgraded() {
+		drain(chatServer, store)
+		return
+	}
+	log.Fatal(err)
+}
+
+// newBackplane connects to the backplane shared with the other replicas, if any
+func newBackplane(cfg config.BackplaneConfig) (server.Backplane, error) {
+	if cfg.Type == "redis" {
+		log.Printf("Using redis backplane at %s\n", cfg.Redis.Address)
+		return redisbackplane.Dial(cfg.Redis)
+	}
+	return server.NewMemoryBackplane(), nil
+}
+
+// newTCPConnection bounds the lines read from conn by message.maxLength
+func newTCPConnection(conn net.Conn, store *config.Store) network.Connection {
+	tcpConn := network.NewTCPConnection(conn)
+	tcpConn.SetReadLimit(network.ReadLimit(store.Get().Message.MaxLength))
+	return tcpConn
+}
+
+// configCheck implements `config check`: it loads and validates the config and reports every problem
+func configCheck(args []string) int {
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the config file (default ./config.yml)")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("error loading config: %v\n", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Printf("invalid config %s:\n%v\n", config.File(), err)
+		return 1
+	}
+
+	fmt.Printf("config %s is valid\n", config.File())
+	return 0
+}
+
+// reloadOnSignal reloads the configuration every time the process receives SIGHUP
+func reloadOnSignal(store *config.Store) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := store.Reload(); err != nil {
+			log.Printf("config reload failed: %v\n", err)
+		}
+	}
+}
+
+// upgradeOnSignal hands the listening sockets to a new process on SIGUSR2. Once it is ready,
+// this process stops accepting, which ends serve in main.
+func upgradeOnSignal(upgrader *upgrade.Upgrader) {
+	if upgrade.Signal == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, upgrade.Signal)
+	for range signals {
+		if err := upgrader.Upgrade(); err != nil {
+			log.Printf("upgrade failed: %v\n", err)
+			continue
+		}
+		network.CloseListeners()
+	}
+}
+
+// drain lets the clients leave after an upgrade, the ones still connected after
+// upgrade.drainTimeout are kicked
+func drain(chatServer *server.ChatServer, store *config.Store) {
+	timeout := time.Duration(store.Get().Upgrade.DrainTimeout) * time.Second
+	log.Printf("Upgraded, draining %d clients for up to %s\n", len(chatServer.Clients()), timeout)
+	if store.Get().Backplane.Type != "redis" {
+		log.Printf("Without the redis backplane the clients still here don't see the ones of the new process and their usernames can be taken there\n")
+	}
+	chatServer.Drain("The server is being upgraded, please reconnect", timeout)
+
+	// kicked clients need a moment to be disconnected
+	deadline := time.Now().Add(timeout + 5*time.Second)
+	for len(chatServer.Clients()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
 	}
+	log.Printf("Drained, exiting\n")
 }
@@ -0,0 +1,173 @@
+package admin
+
+import (
+	"chat-server/internal/config"
+	"chat-server/internal/metrics"
+	"chat-server/internal/server"
+	"chat-server/internal/server/network"
+	"chat-server/internal/webhook"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Server is the admin HTTP server: health probes, metrics, the operator API and incoming webhooks
+type Server struct {
+	core     *server.ChatServer
+	store    *config.Store
+	ready    atomic.Bool
+	incoming *webhook.IncomingHandler
+}
+
+// New creates an admin server for the given chat server
+func New(core *server.ChatServer, store *config.Store) *Server {
+	return &Server{core: core, store: store, incoming: webhook.NewIncomingHandler(core, store)}
+}
+
+// IncomingWebhooks returns the handler of POST /hooks/{room}/{token}, so the chat HTTP server can
+// serve incoming webhooks too, sharing their rate limits
+func (s *Server) IncomingWebhooks() http.Handler {
+	return s.incoming
+}
+
+// SetReady marks the chat listener as ready (or not) to accept clients, it drives /readyz
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// Serve serves the admin endpoints on admin.host:admin.port in the background
+func (s *Server) Serve() error {
+	cfg := s.store.Get().Admin
+	listener, err := network.Listen(network.ListenerAdmin, cfg.Host, cfg.Port)
+	if err != nil {
+		return err
+	}
+	if cfg.Token == "" {
+		log.Printf("admin.token is not set, the admin API is disabled\n")
+	}
+	log.Printf("Admin server listening on %s\n", listener.Addr())
+	go func() {
+		log.Printf("Admin server stopped: %v\n", http.Serve(listener, s.Handler()))
+	}()
+	return nil
+}
+
+// Handler returns the admin routes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", s.healthz)
+	mux.HandleFunc("GET /readyz", s.readyz)
+
+	mux.HandleFunc("GET /api/users", s.authorize(s.listUsers))
+	mux.HandleFunc("POST /api/users/{username}/kick", s.authorize(s.kickUser))
+	mux.HandleFunc("POST /api/users/{username}/ban", s.authorize(s.banUser))
+	mux.HandleFunc("DELETE /api/users/{username}/ban", s.authorize(s.unbanUser))
+	mux.HandleFunc("POST /api/announce", s.authorize(s.announce))
+	mux.HandleFunc("GET /api/stats", s.authorize(s.stats))
+
+	// incoming webhooks are authorized by their own tokens
+	mux.Handle("POST /hooks/{room}/{token}", s.incoming)
+	return mux
+}
+
+// authorize only lets requests carrying the admin token as a bearer token through
+func (s *Server) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := s.store.Get().Admin.Token.Value()
+		if token == "" {
+			writeError(w, http.StatusForbidden, errors.New("admin API disabled: admin.token is not set"))
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+		return
+	}
+	if s.core.Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.core.Clients())
+}
+
+func (s *Server) kickUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if err := s.core.Kick(username, "kicked by an operator"); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Printf("admin: kicked %s\n", username)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "kicked"})
+}
+
+func (s *Server) banUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	s.core.Ban(username)
+	log.Printf("admin: banned %s\n", username)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "banned"})
+}
+
+func (s *Server) unbanUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if err := s.core.Unban(username); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Printf("admin: unbanned %s\n", username)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "unbanned"})
+}
+
+func (s *Server) announce(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`expected {"text": "<announcement>"}`))
+		return
+	}
+	if maxLength := s.store.Get().Message.MaxLength; len(req.Text) > maxLength {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("announcement too long (max %d chars)", maxLength))
+		return
+	}
+
+	s.core.Announce(req.Text)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.core.Stats())
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,180 @@
+package admin
+
+import (
+	"chat-server/internal/config"
+	"chat-server/internal/server"
+	"chat-server/internal/server/network"
+	chatpb "chat-server/internal/server/network/grpc"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Service implements the AdminService gRPC API used by chatctl
+type Service struct {
+	core  *server.ChatServer
+	store *config.Store
+	chatpb.UnimplementedAdminServiceServer
+}
+
+// NewService creates the admin gRPC service for the given chat server
+func NewService(core *server.ChatServer, store *config.Store) *Service {
+	return &Service{core: core, store: store}
+}
+
+// Serve starts the configured AdminService listeners: a Unix socket only reachable by local users
+// with access to the socket file, and a TCP port requiring client certificates (mTLS).
+func (s *Service) Serve(cfg *config.Config) error {
+	if cfg.Admin.Socket != "" {
+		// only the server's user can connect
+		listener, err := network.ListenUnix(network.ListenerAdminSocket, cfg.Admin.Socket, 0o600)
+		if err != nil {
+			return err
+		}
+		grpcSrv := grpc.NewServer()
+		chatpb.RegisterAdminServiceServer(grpcSrv, s)
+		log.Printf("Admin gRPC service listening on unix:%s\n", cfg.Admin.Socket)
+		go func() {
+			log.Printf("Admin gRPC socket stopped: %v\n", grpcSrv.Serve(listener))
+		}()
+	}
+
+	if cfg.Admin.GRPCPort != 0 {
+		creds, err := network.NewMutualTLSCredentials(cfg.TLS, cfg.Admin.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		listener, err := network.Listen(network.ListenerAdminGRPC, cfg.Admin.Host, cfg.Admin.GRPCPort)
+		if err != nil {
+			return err
+		}
+		grpcSrv := grpc.NewServer(grpc.Creds(creds))
+		chatpb.RegisterAdminServiceServer(grpcSrv, s)
+		log.Printf("Admin gRPC service listening on %s (mTLS)\n", listener.Addr())
+		go func() {
+			log.Printf("Admin gRPC port stopped: %v\n", grpcSrv.Serve(listener))
+		}()
+	}
+	return nil
+}
+
+func (s *Service) ListClients(ctx context.Context, req *chatpb.ListClientsRequest) (*chatpb.ListClientsResponse, error) {
+	var clients []*chatpb.ClientInfo
+	for _, client := range s.core.Clients() {
+		clients = append(clients, &chatpb.ClientInfo{
+			Username:        client.Username,
+			Transport:       client.Transport,
+			ConnectedAtUnix: client.ConnectedAt.Unix(),
+			Muted:           client.Muted,
+		})
+	}
+	return &chatpb.ListClientsResponse{Clients: clients}, nil
+}
+
+func (s *Service) Kick(ctx context.Context, req *chatpb.KickRequest) (*chatpb.AdminResponse, error) {
+	reason := req.GetReason()
+	if reason == "" {
+		reason = "kicked by an operator"
+	}
+	if err := s.core.Kick(req.GetUsername(), reason); err != nil {
+		return nil, toStatus(err)
+	}
+	log.Printf("admin: kicked %s\n", req.GetUsername())
+	return &chatpb.AdminResponse{Status: "kicked"}, nil
+}
+
+func (s *Service) Ban(ctx context.Context, req *chatpb.BanRequest) (*chatpb.AdminResponse, error) {
+	if req.GetUsername() == "" {
+		return nil, status.Error(codes.InvalidArgument, "username required")
+	}
+	s.core.Ban(req.GetUsername())
+	log.Printf("admin: banned %s\n", req.GetUsername())
+	return &chatpb.AdminResponse{Status: "banned"}, nil
+}
+
+func (s *Service) Unban(ctx context.Context, req *chatpb.BanRequest) (*chatpb.AdminResponse, error) {
+	if err := s.core.Unban(req.GetUsername()); err != nil {
+		return nil, toStatus(err)
+	}
+	log.Printf("admin: unbanned %s\n", req.GetUsername())
+	return &chatpb.AdminResponse{Status: "unbanned"}, nil
+}
+
+func (s *Service) Mute(ctx context.Context, req *chatpb.MuteRequest) (*chatpb.AdminResponse, error) {
+	if req.GetUsername() == "" {
+		return nil, status.Error(codes.InvalidArgument, "username required")
+	}
+	duration := time.Duration(req.GetDurationSeconds()) * time.Second
+	s.core.Mute(req.GetUsername(), duration)
+	log.Printf("admin: muted %s (duration=%s)\n", req.GetUsername(), duration)
+	return &chatpb.AdminResponse{Status: "muted"}, nil
+}
+
+func (s *Service) Unmute(ctx context.Context, req *chatpb.MuteRequest) (*chatpb.AdminResponse, error) {
+	if err := s.core.Unmute(req.GetUsername()); err != nil {
+		return nil, toStatus(err)
+	}
+	log.Printf("admin: unmuted %s\n", req.GetUsername())
+	return &chatpb.AdminResponse{Status: "unmuted"}, nil
+}
+
+func (s *Service) Announce(ctx context.Context, req *chatpb.AnnounceRequest) (*chatpb.AdminResponse, error) {
+	text := req.GetText()
+	if strings.TrimSpace(text) == "" {
+		return nil, status.Error(codes.InvalidArgument, "announcement text required")
+	}
+	if maxLength := s.store.Get().Message.MaxLength; len(text) > maxLength {
+		return nil, status.Errorf(codes.InvalidArgument, "announcement too long (max %d chars)", maxLength)
+	}
+	s.core.Announce(text)
+	return &chatpb.AdminResponse{Status: "sent"}, nil
+}
+
+func (s *Service) ReloadConfig(ctx context.Context, req *chatpb.ReloadConfigRequest) (*chatpb.AdminResponse, error) {
+	if err := s.store.Reload(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &chatpb.AdminResponse{Status: "reloaded"}, nil
+}
+
+func (s *Service) Stats(ctx context.Context, req *chatpb.StatsRequest) (*chatpb.StatsResponse, error) {
+	stats := s.core.Stats()
+	transports := make(map[string]int32, len(stats.Transports))
+	for transport, count := range stats.Transports {
+		transports[transport] = int32(count)
+	}
+	return &chatpb.StatsResponse{
+		Clients:       int32(stats.Clients),
+		Transports:    transports,
+		BannedUsers:   stats.BannedUsers,
+		MutedUsers:    stats.MutedUsers,
+		StartedAtUnix: stats.StartedAt.Unix(),
+		UptimeSeconds: int64(time.Since(stats.StartedAt).Seconds()),
+		Draining:      stats.Draining,
+	}, nil
+}
+
+func (s *Service) Drain(ctx context.Context, req *chatpb.DrainRequest) (*chatpb.AdminResponse, error) {
+	deadline := time.Duration(req.GetDeadlineSeconds()) * time.Second
+	s.core.Drain(req.GetMessage(), deadline)
+	log.Printf("admin: draining (deadline=%s)\n", deadline)
+	return &chatpb.AdminResponse{Status: "draining"}, nil
+}
+
+// toStatus maps chat server errors to gRPC status codes
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, server.ErrClientNotFound),
+		errors.Is(err, server.ErrUserNotBanned),
+		errors.Is(err, server.ErrUserNotMuted):
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
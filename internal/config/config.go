@@ -2,61 +2,447 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/viper"
 )
 
+// EnvPrefix is the prefix of environment variables overriding config keys, e.g. CHAT_SERVER_PORT
+const EnvPrefix = "CHAT"
+
 type Config struct {
-	Server    ServerConfig
-	Security  SecurityConfig
-	TLS       TLSConfig
-	Message   MessageConfig
-	RateLimit RateLimitConfig
-	Log       LogConfig
+	Server     ServerConfig     `mapstructure:"server"`
+	Security   SecurityConfig   `mapstructure:"security"`
+	TLS        TLSConfig        `mapstructure:"tls"`
+	Message    MessageConfig    `mapstructure:"message"`
+	RateLimit  RateLimitConfig  `mapstructure:"rateLimit"`
+	Log        LogConfig        `mapstructure:"log"`
+	Admin      AdminConfig      `mapstructure:"admin"`
+	WebSocket  WebSocketConfig  `mapstructure:"websocket"`
+	SSE        SSEConfig        `mapstructure:"sse"`
+	IRC        IRCConfig        `mapstructure:"irc"`
+	SSH        SSHConfig        `mapstructure:"ssh"`
+	Proxy      ProxyConfig      `mapstructure:"proxy"`
+	Upgrade    UpgradeConfig    `mapstructure:"upgrade"`
+	Backplane  BackplaneConfig  `mapstructure:"backplane"`
+	Federation FederationConfig `mapstructure:"federation"`
+	Webhooks   WebhooksConfig   `mapstructure:"webhooks"`
+
+	IncomingWebhooks IncomingWebhooksConfig `mapstructure:"incomingWebhooks"`
+	Plugins          PluginsConfig          `mapstructure:"plugins"`
+	Moderation       ModerationConfig       `mapstructure:"moderation"`
 }
 
 type ServerConfig struct {
-	Host         string `yaml:"host"`
-	Port         int    `yaml:"port"`
-	Type         string `yaml:"type"`
-	MaxClients   int    `yaml:"maxClients"`
-	ReadTimeout  int    `yaml:"readTimeout"`
-	WriteTimeout int    `yaml:"writeTimeout"`
+	Host         string `mapstructure:"host"`
+	Port         int    `mapstructure:"port"`
+	Type         string `mapstructure:"type"`
+	MaxClients   int    `mapstructure:"maxClients"`
+	ReadTimeout  int    `mapstructure:"readTimeout"`
+	WriteTimeout int    `mapstructure:"writeTimeout"`
+	Socket       string `mapstructure:"socket"`
+	SocketMode   string `mapstructure:"socketMode"`
+}
+
+// SocketFileMode parses socketMode, the octal permissions of the Unix socket (e.g. "0660")
+func (c ServerConfig) SocketFileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q", c.SocketMode)
+	}
+	return os.FileMode(mode), nil
 }
 
 type SecurityConfig struct {
-	RequirePassword bool   `yaml:"requirePassword"`
-	Password        string `yaml:"password"`
-	HashMessage     bool   `yaml:"hashMessage"`
-	HashAlgorithm   string `yaml:"hashAlgorithm"`
-	HashKey         string `yaml:"hashKey"`
+	RequirePassword bool     `mapstructure:"requirePassword"`
+	Password        Secret   `mapstructure:"password"`
+	HashMessage     bool     `mapstructure:"hashMessage"`
+	HashAlgorithm   string   `mapstructure:"hashAlgorithm"`
+	HashKey         Secret   `mapstructure:"hashKey"`
+	BannedUsers     []string `mapstructure:"bannedUsers"`
+	// Moderators and Admins get the commands of their role, admins those of moderators too
+	Moderators []string `mapstructure:"moderators"`
+	Admins     []string `mapstructure:"admins"`
 }
 
 type MessageConfig struct {
-	MaxLength int `yaml:"maxLength"`
+	MaxLength int `mapstructure:"maxLength"`
+	// Profanity are the words masked with * in messages
+	Profanity []string `mapstructure:"profanity"`
 }
 
 type RateLimitConfig struct {
-	MessagePerSecond int `yaml:"messagePerSecond"`
-	Burst            int `yaml:"burst"`
+	MessagePerSecond int `mapstructure:"messagePerSecond"`
+	Burst            int `mapstructure:"burst"`
 }
 
 type LogConfig struct {
-	EnableLogging bool   `yaml:"enableLogging"`
-	File          string `yaml:"file"`
+	EnableLogging bool   `mapstructure:"enableLogging"`
+	File          string `mapstructure:"file"`
+	Level         string `mapstructure:"level"`
+	// AuditFile receives the moderation events as JSON lines, the server log does when it is empty
+	AuditFile string `mapstructure:"auditFile"`
+}
+
+type AdminConfig struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	Host         string `mapstructure:"host"`
+	Port         int    `mapstructure:"port"`
+	Token        Secret `mapstructure:"token"`
+	Socket       string `mapstructure:"socket"`
+	GRPCPort     int    `mapstructure:"grpcPort"`
+	ClientCAFile string `mapstructure:"clientCAFile"`
+}
+
+type WebSocketConfig struct {
+	Path            string   `mapstructure:"path"`
+	WebClient       bool     `mapstructure:"webClient"`
+	AllowedOrigins  []string `mapstructure:"allowedOrigins"`
+	Compression     bool     `mapstructure:"compression"`
+	ReadBufferSize  int      `mapstructure:"readBufferSize"`
+	WriteBufferSize int      `mapstructure:"writeBufferSize"`
+}
+
+type SSEConfig struct {
+	Enabled        bool `mapstructure:"enabled"`
+	SessionTimeout int  `mapstructure:"sessionTimeout"`
+	ReplayBuffer   int  `mapstructure:"replayBuffer"`
+}
+
+type IRCConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	Port       int    `mapstructure:"port"`
+	TLS        bool   `mapstructure:"tls"`
+	ServerName string `mapstructure:"serverName"`
+}
+
+// SSHConfig sets up the SSH front-end, the public key in authorizedKeysFile decides the username
+type SSHConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	Port               int    `mapstructure:"port"`
+	HostKeyFile        string `mapstructure:"hostKeyFile"`
+	AuthorizedKeysFile string `mapstructure:"authorizedKeysFile"`
 }
 
 type TLSConfig struct {
-	TLSRequire bool   `yaml:"tlsRequire"`
-	CertFile   string `yaml:"certFile"`
-	KeyFile    string `yaml:"keyFile"`
-	MinVersion string `yaml:"minVersion"`
+	TLSRequire bool   `mapstructure:"tlsRequire"`
+	CertFile   string `mapstructure:"certFile"`
+	KeyFile    string `mapstructure:"keyFile"`
+	MinVersion string `mapstructure:"minVersion"`
+}
+
+// ProxyConfig describes the load balancers in front of the server, only connections from
+// trustedProxies may set the client address with a PROXY header or forwarded headers
+type ProxyConfig struct {
+	ProxyProtocol  bool     `mapstructure:"proxyProtocol"`
+	TrustedProxies []string `mapstructure:"trustedProxies"`
+}
+
+// UpgradeConfig controls binary upgrades: on SIGUSR2 the listening sockets are handed to a new
+// process and this one drains its clients for up to drainTimeout seconds
+type UpgradeConfig struct {
+	DrainTimeout int    `mapstructure:"drainTimeout"`
+	ReadyTimeout int    `mapstructure:"readyTimeout"`
+	PIDFile      string `mapstructure:"pidFile"`
+}
+
+// BackplaneConfig selects how replicas share users and messages: "memory" for a single server,
+// "redis" for several replicas behind a load balancer
+type BackplaneConfig struct {
+	Type  string      `mapstructure:"type"`
+	Redis RedisConfig `mapstructure:"redis"`
+}
+
+type RedisConfig struct {
+	Address  string `mapstructure:"address"`
+	Username string `mapstructure:"username"`
+	Password Secret `mapstructure:"password"`
+	DB       int    `mapstructure:"db"`
+	Prefix   string `mapstructure:"prefix"`
+}
+
+// FederationConfig peers this server with other chat servers. Peers connect to port with a
+// certificate signed by caFile that is valid for their name, users are addressed as user@name.
+type FederationConfig struct {
+	Enabled   bool         `mapstructure:"enabled"`
+	Name      string       `mapstructure:"name"`
+	Port      int          `mapstructure:"port"`
+	CertFile  string       `mapstructure:"certFile"`
+	KeyFile   string       `mapstructure:"keyFile"`
+	CAFile    string       `mapstructure:"caFile"`
+	RateLimit int          `mapstructure:"rateLimit"`
+	MaxHops   int          `mapstructure:"maxHops"`
+	Peers     []PeerConfig `mapstructure:"peers"`
+}
+
+// PeerConfig is a federated server and the rooms shared with it. rateLimit overrides
+// federation.rateLimit for this peer.
+type PeerConfig struct {
+	Name      string   `mapstructure:"name"`
+	Address   string   `mapstructure:"address"`
+	Rooms     []string `mapstructure:"rooms"`
+	RateLimit int      `mapstructure:"rateLimit"`
+}
+
+// Peer returns the peer named name
+func (c FederationConfig) Peer(name string) (PeerConfig, bool) {
+	for _, peer := range c.Peers {
+		if peer.Name == name {
+			return peer, true
+		}
+	}
+	return PeerConfig{}, false
+}
+
+// WebhooksConfig lists the endpoints chat events are POSTed to. Each endpoint has a queue of
+// queueSize deliveries, a delivery is tried up to maxRetries more times when it fails.
+type WebhooksConfig struct {
+	QueueSize  int               `mapstructure:"queueSize"`
+	Timeout    int               `mapstructure:"timeout"`
+	MaxRetries int               `mapstructure:"maxRetries"`
+	Endpoints  []WebhookEndpoint `mapstructure:"endpoints"`
+}
+
+// WebhookEndpoint receives the events it subscribes to, signed with secret. Empty rooms or users
+// don't filter, keywords are matched case-insensitively for keyword events.
+type WebhookEndpoint struct {
+	Name     string   `mapstructure:"name"`
+	URL      string   `mapstructure:"url"`
+	Secret   Secret   `mapstructure:"secret"`
+	Events   []string `mapstructure:"events"`
+	Keywords []string `mapstructure:"keywords"`
+	Rooms    []string `mapstructure:"rooms"`
+	Users    []string `mapstructure:"users"`
+}
+
+// IncomingWebhooksConfig lets services post into a room with POST /hooks/{room}/{token},
+// each hook may post messagesPerMinute messages unless it sets its own limit
+type IncomingWebhooksConfig struct {
+	MessagesPerMinute int               `mapstructure:"messagesPerMinute"`
+	MaxAttachments    int               `mapstructure:"maxAttachments"`
+	Hooks             []IncomingWebhook `mapstructure:"hooks"`
+}
+
+// IncomingWebhook is a URL posting into room as username. The poster may choose another
+// username when allowUsernameOverride is set.
+type IncomingWebhook struct {
+	Name                  string `mapstructure:"name"`
+	Room                  string `mapstructure:"room"`
+	Token                 Secret `mapstructure:"token"`
+	Username              string `mapstructure:"username"`
+	AllowUsernameOverride bool   `mapstructure:"allowUsernameOverride"`
+	MessagesPerMinute     int    `mapstructure:"messagesPerMinute"`
+}
+
+// PluginsConfig loads the Lua plugins of dir, a plugin call may run timeout milliseconds and
+// keep maxKeys entries in its key-value store, saved in dataDir
+type PluginsConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Dir     string `mapstructure:"dir"`
+	DataDir string `mapstructure:"dataDir"`
+	Timeout int    `mapstructure:"timeout"`
+	MaxKeys int    `mapstructure:"maxKeys"`
+}
+
+// Moderation filter actions: mask rewrites the offending part, reject refuses the message and flag
+// lets it through for the moderators to review
+const (
+	ActionMask   = "mask"
+	ActionReject = "reject"
+	ActionFlag   = "flag"
+)
+
+// ModerationConfig filters the messages users send before they are delivered. The words are
+// matched after homoglyph normalization when normalizeHomoglyphs is set, e.g. a Cyrillic "а" as "a".
+// Hits go to the audit log and, with queue set, flags and rejections to the moderator queue of
+// queueSize entries.
+type ModerationConfig struct {
+	Enabled             bool            `mapstructure:"enabled"`
+	NormalizeHomoglyphs bool            `mapstructure:"normalizeHomoglyphs"`
+	Blocklist           []BlocklistRule `mapstructure:"blocklist"`
+	Links               LinkFilter      `mapstructure:"links"`
+	Caps                CapsFilter      `mapstructure:"caps"`
+	Repeat              RepeatFilter    `mapstructure:"repeat"`
+	Flood               FloodFilter     `mapstructure:"flood"`
+	Queue               bool            `mapstructure:"queue"`
+	QueueSize           int             `mapstructure:"queueSize"`
+}
+
+// BlocklistRule matches whole words ignoring case, or a regular expression
+type BlocklistRule struct {
+	Name   string   `mapstructure:"name"`
+	Words  []string `mapstructure:"words"`
+	Regex  string   `mapstructure:"regex"`
+	Action string   `mapstructure:"action"`
+}
+
+// LinkFilter acts on the links to hosts outside of allow (and their subdomains), every link when
+// allow is empty. An empty action disables the filter, as for the filters below.
+type LinkFilter struct {
+	Action string   `mapstructure:"action"`
+	Allow  []string `mapstructure:"allow"`
+}
+
+// CapsFilter acts on messages of at least minLetters letters with more than maxPercent capitals
+type CapsFilter struct {
+	Action     string `mapstructure:"action"`
+	MinLetters int    `mapstructure:"minLetters"`
+	MaxPercent int    `mapstructure:"maxPercent"`
+}
+
+// RepeatFilter acts on characters repeated more than maxRun times in a row
+type RepeatFilter struct {
+	Action string `mapstructure:"action"`
+	MaxRun int    `mapstructure:"maxRun"`
 }
 
-func LoadConfig() (*Config, error) {
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
+// FloodFilter acts on a user sending the same message more than maxRepeats times within window
+// seconds
+type FloodFilter struct {
+	Action     string `mapstructure:"action"`
+	MaxRepeats int    `mapstructure:"maxRepeats"`
+	Window     int    `mapstructure:"window"`
+}
+
+// setDefaults registers a default for every key, which also lets viper bind them to environment variables
+func setDefaults() {
+	viper.SetDefault("server.host", "0.0.0.0")
+	viper.SetDefault("server.port", 8080)
+	viper.SetDefault("server.type", "tcp")
+	viper.SetDefault("server.maxClients", 100)
+	viper.SetDefault("server.readTimeout", 5)
+	viper.SetDefault("server.writeTimeout", 5)
+	viper.SetDefault("server.socket", "")
+	viper.SetDefault("server.socketMode", "0660")
+
+	viper.SetDefault("security.requirePassword", false)
+	viper.SetDefault("security.password", "")
+	viper.SetDefault("security.hashMessage", false)
+	viper.SetDefault("security.hashAlgorithm", "sha256")
+	viper.SetDefault("security.hashKey", "")
+	viper.SetDefault("security.bannedUsers", []string{})
+	viper.SetDefault("security.moderators", []string{})
+	viper.SetDefault("security.admins", []string{})
+
+	viper.SetDefault("message.maxLength", 1000)
+	viper.SetDefault("message.profanity", []string{})
+
+	viper.SetDefault("rateLimit.messagePerSecond", 5)
+	viper.SetDefault("rateLimit.burst", 5)
+
+	viper.SetDefault("log.enableLogging", false)
+	viper.SetDefault("log.file", "chat.log")
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.auditFile", "")
+
+	viper.SetDefault("admin.enabled", false)
+	viper.SetDefault("admin.host", "127.0.0.1")
+	viper.SetDefault("admin.port", 9090)
+	viper.SetDefault("admin.token", "")
+	viper.SetDefault("admin.socket", "")
+	viper.SetDefault("admin.grpcPort", 0)
+	viper.SetDefault("admin.clientCAFile", "")
+
+	viper.SetDefault("websocket.path", "/ws")
+	viper.SetDefault("websocket.webClient", true)
+	viper.SetDefault("websocket.allowedOrigins", []string{})
+	viper.SetDefault("websocket.compression", false)
+	viper.SetDefault("websocket.readBufferSize", 4096)
+	viper.SetDefault("websocket.writeBufferSize", 4096)
+
+	viper.SetDefault("sse.enabled", true)
+	viper.SetDefault("sse.sessionTimeout", 30)
+	viper.SetDefault("sse.replayBuffer", 256)
+
+	viper.SetDefault("irc.enabled", false)
+	viper.SetDefault("irc.port", 6667)
+	viper.SetDefault("irc.tls", false)
+	viper.SetDefault("irc.serverName", "chat-server")
+
+	viper.SetDefault("ssh.enabled", false)
+	viper.SetDefault("ssh.port", 2222)
+	viper.SetDefault("ssh.hostKeyFile", "ssh/host_key")
+	viper.SetDefault("ssh.authorizedKeysFile", "ssh/authorized_keys")
+
+	viper.SetDefault("proxy.proxyProtocol", false)
+	viper.SetDefault("proxy.trustedProxies", []string{})
+
+	viper.SetDefault("upgrade.drainTimeout", 60)
+	viper.SetDefault("upgrade.readyTimeout", 30)
+	viper.SetDefault("upgrade.pidFile", "")
+
+	viper.SetDefault("backplane.type", "memory")
+	viper.SetDefault("backplane.redis.address", "localhost:6379")
+	viper.SetDefault("backplane.redis.username", "")
+	viper.SetDefault("backplane.redis.password", "")
+	viper.SetDefault("backplane.redis.db", 0)
+	viper.SetDefault("backplane.redis.prefix", "chat")
+
+	viper.SetDefault("federation.enabled", false)
+	viper.SetDefault("federation.name", "")
+	viper.SetDefault("federation.port", 7443)
+	viper.SetDefault("federation.certFile", "tls/federation.crt")
+	viper.SetDefault("federation.keyFile", "tls/federation.key")
+	viper.SetDefault("federation.caFile", "tls/federation-ca.crt")
+	viper.SetDefault("federation.rateLimit", 50)
+	viper.SetDefault("federation.maxHops", 4)
+	viper.SetDefault("federation.peers", []PeerConfig{})
+
+	viper.SetDefault("webhooks.queueSize", 1000)
+	viper.SetDefault("webhooks.timeout", 5)
+	viper.SetDefault("webhooks.maxRetries", 5)
+	viper.SetDefault("webhooks.endpoints", []WebhookEndpoint{})
+
+	viper.SetDefault("incomingWebhooks.messagesPerMinute", 30)
+	viper.SetDefault("incomingWebhooks.maxAttachments", 5)
+	viper.SetDefault("incomingWebhooks.hooks", []IncomingWebhook{})
+
+	viper.SetDefault("plugins.enabled", false)
+	viper.SetDefault("plugins.dir", "plugins")
+	viper.SetDefault("plugins.dataDir", "plugins/data")
+	viper.SetDefault("plugins.timeout", 100)
+	viper.SetDefault("plugins.maxKeys", 1000)
+
+	viper.SetDefault("moderation.enabled", false)
+	viper.SetDefault("moderation.normalizeHomoglyphs", true)
+	viper.SetDefault("moderation.blocklist", []BlocklistRule{})
+	viper.SetDefault("moderation.links.action", "")
+	viper.SetDefault("moderation.links.allow", []string{})
+	viper.SetDefault("moderation.caps.action", "")
+	viper.SetDefault("moderation.caps.minLetters", 10)
+	viper.SetDefault("moderation.caps.maxPercent", 70)
+	viper.SetDefault("moderation.repeat.action", "")
+	viper.SetDefault("moderation.repeat.maxRun", 10)
+	viper.SetDefault("moderation.flood.action", "")
+	viper.SetDefault("moderation.flood.maxRepeats", 3)
+	viper.SetDefault("moderation.flood.window", 30)
+	viper.SetDefault("moderation.queue", false)
+	viper.SetDefault("moderation.queueSize", 100)
+
+	viper.SetDefault("tls.tlsRequire", false)
+	viper.SetDefault("tls.certFile", "tls/server.crt")
+	viper.SetDefault("tls.keyFile", "tls/server.key")
+	viper.SetDefault("tls.minVersion", "TLS12")
+}
+
+// LoadConfig reads the config file at path, or config.yml from the working directory when path is empty.
+// Values are layered as defaults, then the file, then CHAT_ prefixed environment variables.
+func LoadConfig(path string) (*Config, error) {
+	if path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.SetConfigName("config")
+		viper.SetConfigType("yaml")
+		viper.AddConfigPath(".")
+	}
+
+	setDefaults()
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+
 	err := viper.ReadInConfig()
 	if err != nil {
 		return nil, fmt.Errorf("fatal error config file: %w", err)
@@ -67,6 +453,15 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("fatal error config file: %w", err)
 	}
+	err = config.resolveSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("fatal error config file: %w", err)
+	}
 
 	return &config, nil
 }
+
+// File returns the path of the config file that was loaded
+func File() string {
+	return viper.ConfigFileUsed()
+}
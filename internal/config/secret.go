@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// Secret is a config value that must never be printed. In config.yml it can hold the value itself,
+// a "file:/path" reference read from disk (e.g. a Docker secret) or an "env:NAME" reference.
+type Secret string
+
+// Value returns the resolved secret
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String hides the secret from fmt, so logging a config never leaks it
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// GoString hides the secret from %#v
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalText hides the secret from JSON and YAML dumps
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// resolve replaces a file: or env: reference with the value it points to
+func (s Secret) resolve() (Secret, error) {
+	ref := string(s)
+	switch {
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file %s: %w", path, err)
+		}
+		return Secret(strings.TrimRight(string(data), "\r\n")), nil
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", name)
+		}
+		return Secret(value), nil
+	default:
+		return s, nil
+	}
+}
+
+// resolveSecrets resolves every secret reference of the config in place
+func (c *Config) resolveSecrets() error {
+	secrets := map[string]*Secret{
+		"security.password":        &c.Security.Password,
+		"security.hashKey":         &c.Security.HashKey,
+		"admin.token":              &c.Admin.Token,
+		"backplane.redis.password": &c.Backplane.Redis.Password,
+	}
+	for i := range c.Webhooks.Endpoints {
+		secrets[fmt.Sprintf("webhooks.endpoints[%d].secret", i)] = &c.Webhooks.Endpoints[i].Secret
+	}
+	for i := range c.IncomingWebhooks.Hooks {
+		secrets[fmt.Sprintf("incomingWebhooks.hooks[%d].token", i)] = &c.IncomingWebhooks.Hooks[i].Token
+	}
+	for key, secret := range secrets {
+		value, err := secret.resolve()
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*secret = value
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// ReloadFunc is called after a reload with the previous and the new configuration
+type ReloadFunc func(old, updated *Config)
+
+// Store holds the active configuration and swaps it atomically on reload,
+// so handlers always read a consistent snapshot through Get
+type Store struct {
+	current   atomic.Pointer[Config]
+	mutex     sync.Mutex
+	listeners []ReloadFunc
+}
+
+// NewStore creates a store serving cfg until the next reload
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+// Get returns the current configuration snapshot, it must be treated as read-only
+func (s *Store) Get() *Config {
+	return s.current.Load()
+}
+
+// OnReload registers fn to be called every time a reload changes the configuration
+func (s *Store) OnReload(fn ReloadFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Reload re-reads the config file and applies the settings that are safe to change at runtime.
+// Settings that need a restart are logged and keep their current value.
+func (s *Store) Reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("error reloading config file: %w", err)
+	}
+
+	var next Config
+	if err := viper.Unmarshal(&next); err != nil {
+		return fmt.Errorf("error reloading config file: %w", err)
+	}
+	if err := next.resolveSecrets(); err != nil {
+		return fmt.Errorf("error reloading config file: %w", err)
+	}
+	if err := next.Validate(); err != nil {
+		return fmt.Errorf("invalid config, keeping current settings:\n%w", err)
+	}
+
+	old := s.Get()
+	updated, changed, rejected := mergeReloadable(old, &next)
+	for _, field := range rejected {
+		log.Printf("config reload: %s changed but requires a restart, keeping current value\n", field)
+	}
+	if len(changed) == 0 {
+		log.Printf("config reload: no runtime settings changed\n")
+		return nil
+	}
+
+	s.current.Store(updated)
+	log.Printf("config reload: applied %s\n", strings.Join(changed, ", "))
+
+	for _, fn := range s.listeners {
+		fn(old, updated)
+	}
+	return nil
+}
+
+// Watch reloads the configuration whenever the config file changes on disk
+func (s *Store) Watch() {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		if err := s.Reload(); err != nil {
+			log.Printf("config reload failed: %v\n", err)
+		}
+	})
+	viper.WatchConfig()
+}
+
+// mergeReloadable copies the runtime-safe settings of next on top of a copy of old.
+// It returns the merged config with the names of the applied and the rejected settings.
+func mergeReloadable(old, next *Config) (*Config, []string, []string) {
+	merged := *old
+	var changed, rejected []string
+
+	if old.Server.Host != next.Server.Host {
+		rejected = append(rejected, "server.host")
+	}
+	if old.Server.Port != next.Server.Port {
+		rejected = append(rejected, "server.port")
+	}
+	if old.Server.Type != next.Server.Type {
+		rejected = append(rejected, "server.type")
+	}
+	if old.Server.Socket != next.Server.Socket || old.Server.SocketMode != next.Server.SocketMode {
+		rejected = append(rejected, "server.socket")
+	}
+	if old.Server.ReadTimeout != next.Server.ReadTimeout || old.Server.WriteTimeout != next.Server.WriteTimeout {
+		rejected = append(rejected, "server timeouts")
+	}
+	if old.TLS != next.TLS {
+		rejected = append(rejected, "tls")
+	}
+	if old.Admin.Enabled != next.Admin.Enabled || old.Admin.Host != next.Admin.Host || old.Admin.Port != next.Admin.Port {
+		rejected = append(rejected, "admin listener")
+	}
+	if old.Admin.Socket != next.Admin.Socket || old.Admin.GRPCPort != next.Admin.GRPCPort || old.Admin.ClientCAFile != next.Admin.ClientCAFile {
+		rejected = append(rejected, "admin gRPC listeners")
+	}
+	if old.WebSocket.Path != next.WebSocket.Path || old.WebSocket.WebClient != next.WebSocket.WebClient ||
+		old.WebSocket.Compression != next.WebSocket.Compression ||
+		old.WebSocket.ReadBufferSize != next.WebSocket.ReadBufferSize || old.WebSocket.WriteBufferSize != next.WebSocket.WriteBufferSize {
+		rejected = append(rejected, "websocket listener")
+	}
+	if old.SSE.Enabled != next.SSE.Enabled {
+		rejected = append(rejected, "sse.enabled")
+	}
+	if old.IRC != next.IRC {
+		rejected = append(rejected, "irc")
+	}
+	if old.Backplane != next.Backplane {
+		rejected = append(rejected, "backplane")
+	}
+	if !reflect.DeepEqual(old.Federation, next.Federation) {
+		rejected = append(rejected, "federation")
+	}
+	if !reflect.DeepEqual(old.Webhooks, next.Webhooks) {
+		rejected = append(rejected, "webhooks")
+	}
+	if old.Plugins != next.Plugins {
+		rejected = append(rejected, "plugins")
+	}
+	if old.SSH != next.SSH {
+		rejected = append(rejected, "ssh")
+	}
+	if old.Log.EnableLogging != next.Log.EnableLogging || old.Log.File != next.Log.File || old.Log.AuditFile != next.Log.AuditFile {
+		rejected = append(rejected, "log output")
+	}
+
+	if old.Server.MaxClients != next.Server.MaxClients {
+		merged.Server.MaxClients = next.Server.MaxClients
+		changed = append(changed, fmt.Sprintf("server.maxClients=%d", next.Server.MaxClients))
+	}
+	if old.Message.MaxLength != next.Message.MaxLength || !slices.Equal(old.Message.Profanity, next.Message.Profanity) {
+		merged.Message = next.Message
+		changed = append(changed, fmt.Sprintf("message.maxLength=%d message.profanity=%d words",
+			next.Message.MaxLength, len(next.Message.Profanity)))
+	}
+	if old.RateLimit != next.RateLimit {
+		merged.RateLimit = next.RateLimit
+		changed = append(changed, fmt.Sprintf("rateLimit.messagePerSecond=%d rateLimit.burst=%d",
+			next.RateLimit.MessagePerSecond, next.RateLimit.Burst))
+	}
+	if old.Security.RequirePassword != next.Security.RequirePassword {
+		merged.Security.RequirePassword = next.Security.RequirePassword
+		changed = append(changed, fmt.Sprintf("security.requirePassword=%v", next.Security.RequirePassword))
+	}
+	if old.Security.Password != next.Security.Password {
+		merged.Security.Password = next.Security.Password
+		changed = append(changed, "security.password")
+	}
+	if old.Security.HashMessage != next.Security.HashMessage ||
+		old.Security.HashAlgorithm != next.Security.HashAlgorithm ||
+		old.Security.HashKey != next.Security.HashKey {
+		merged.Security.HashMessage = next.Security.HashMessage
+		merged.Security.HashAlgorithm = next.Security.HashAlgorithm
+		merged.Security.HashKey = next.Security.HashKey
+		changed = append(changed, "security hashing")
+	}
+	if !slices.Equal(old.Security.BannedUsers, next.Security.BannedUsers) {
+		merged.Security.BannedUsers = next.Security.BannedUsers
+		changed = append(changed, fmt.Sprintf("security.bannedUsers=%v", next.Security.BannedUsers))
+	}
+	if !slices.Equal(old.Security.Moderators, next.Security.Moderators) || !slices.Equal(old.Security.Admins, next.Security.Admins) {
+		merged.Security.Moderators = next.Security.Moderators
+		merged.Security.Admins = next.Security.Admins
+		changed = append(changed, fmt.Sprintf("security.moderators=%v security.admins=%v", next.Security.Moderators, next.Security.Admins))
+	}
+	if !slices.Equal(old.WebSocket.AllowedOrigins, next.WebSocket.AllowedOrigins) {
+		merged.WebSocket.AllowedOrigins = next.WebSocket.AllowedOrigins
+		changed = append(changed, fmt.Sprintf("websocket.allowedOrigins=%v", next.WebSocket.AllowedOrigins))
+	}
+	if old.SSE.SessionTimeout != next.SSE.SessionTimeout || old.SSE.ReplayBuffer != next.SSE.ReplayBuffer {
+		merged.SSE.SessionTimeout = next.SSE.SessionTimeout
+		merged.SSE.ReplayBuffer = next.SSE.ReplayBuffer
+		changed = append(changed, fmt.Sprintf("sse.sessionTimeout=%d sse.replayBuffer=%d", next.SSE.SessionTimeout, next.SSE.ReplayBuffer))
+	}
+	if old.Proxy.ProxyProtocol != next.Proxy.ProxyProtocol || !slices.Equal(old.Proxy.TrustedProxies, next.Proxy.TrustedProxies) {
+		merged.Proxy = next.Proxy
+		changed = append(changed, fmt.Sprintf("proxy.proxyProtocol=%v proxy.trustedProxies=%v", next.Proxy.ProxyProtocol, next.Proxy.TrustedProxies))
+	}
+	if old.Upgrade != next.Upgrade {
+		merged.Upgrade = next.Upgrade
+		changed = append(changed, fmt.Sprintf("upgrade.drainTimeout=%d upgrade.readyTimeout=%d upgrade.pidFile=%s", next.Upgrade.DrainTimeout, next.Upgrade.ReadyTimeout, next.Upgrade.PIDFile))
+	}
+	if old.Admin.Token != next.Admin.Token {
+		merged.Admin.Token = next.Admin.Token
+		changed = append(changed, "admin.token")
+	}
+	if !reflect.DeepEqual(old.IncomingWebhooks, next.IncomingWebhooks) {
+		merged.IncomingWebhooks = next.IncomingWebhooks
+		changed = append(changed, fmt.Sprintf("incomingWebhooks (%d hooks)", len(next.IncomingWebhooks.Hooks)))
+	}
+	if old.Moderation.Enabled != next.Moderation.Enabled {
+		rejected = append(rejected, "moderation.enabled")
+	}
+	// the filters are only validated when enabled
+	moderation := next.Moderation
+	moderation.Enabled = old.Moderation.Enabled
+	if next.Moderation.Enabled && !reflect.DeepEqual(old.Moderation, moderation) {
+		merged.Moderation = moderation
+		changed = append(changed, fmt.Sprintf("moderation (%d blocklist rules)", len(moderation.Blocklist)))
+	}
+	if old.Log.Level != next.Log.Level {
+		merged.Log.Level = next.Log.Level
+		changed = append(changed, fmt.Sprintf("log.level=%s", next.Log.Level))
+	}
+
+	return &merged, changed, rejected
+}
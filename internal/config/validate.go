@@ -0,0 +1,242 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	serverTypes    = []string{"tcp", "websocket", "gRPC"}
+	hashAlgorithms = []string{"sha256", "sha512", "hmac-sha256"}
+	logLevels      = []string{"debug", "info", "warn", "warning", "error"}
+	tlsVersions    = []string{"TLS12", "TLS13"}
+	backplaneTypes = []string{"memory", "redis"}
+	// the chat has a single room, "lobby"
+	rooms         = []string{"lobby"}
+	webhookEvents = []string{"message", "join", "leave", "mention", "keyword"}
+	actions       = []string{ActionMask, ActionReject, ActionFlag}
+)
+
+// Validate checks the whole configuration and returns every problem found joined in one error
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port must be between 1 and 65535, got %d", c.Server.Port)
+	check(slices.Contains(serverTypes, c.Server.Type), "server.type must be one of %s, got %q", strings.Join(serverTypes, ", "), c.Server.Type)
+	check(c.Server.MaxClients > 0, "server.maxClients must be positive, got %d", c.Server.MaxClients)
+	check(c.Server.ReadTimeout >= 0, "server.readTimeout must not be negative, got %d", c.Server.ReadTimeout)
+	check(c.Server.WriteTimeout >= 0, "server.writeTimeout must not be negative, got %d", c.Server.WriteTimeout)
+	check(c.Server.Host == "" || net.ParseIP(c.Server.Host) != nil || !strings.ContainsAny(c.Server.Host, " :/"), "server.host must be an IP address or host name, got %q", c.Server.Host)
+	if c.Server.Socket != "" {
+		_, err := c.Server.SocketFileMode()
+		check(err == nil, "server.socketMode must be an octal permission like 0660, got %q", c.Server.SocketMode)
+		check(c.Admin.Socket != c.Server.Socket, "server.socket must differ from admin.socket")
+	}
+
+	check(!c.Security.RequirePassword || c.Security.Password != "", "security.password is required when security.requirePassword is true")
+	if c.Security.HashMessage {
+		algo := strings.ToLower(c.Security.HashAlgorithm)
+		check(slices.Contains(hashAlgorithms, algo), "security.hashAlgorithm must be one of %s, got %q", strings.Join(hashAlgorithms, ", "), c.Security.HashAlgorithm)
+		check(algo != "hmac-sha256" || c.Security.HashKey != "", "security.hashKey is required for hmac-sha256")
+	}
+
+	check(c.Message.MaxLength > 0, "message.maxLength must be positive, got %d", c.Message.MaxLength)
+	for i, word := range c.Message.Profanity {
+		check(strings.TrimSpace(word) != "", "message.profanity[%d] must not be empty", i)
+	}
+
+	check(c.RateLimit.MessagePerSecond > 0, "rateLimit.messagePerSecond must be positive, got %d", c.RateLimit.MessagePerSecond)
+	check(c.RateLimit.Burst >= 0, "rateLimit.burst must not be negative, got %d", c.RateLimit.Burst)
+
+	check(c.Log.Level == "" || slices.Contains(logLevels, strings.ToLower(c.Log.Level)), "log.level must be one of debug, info, warn, error, got %q", c.Log.Level)
+	check(!c.Log.EnableLogging || c.Log.File != "", "log.file is required when log.enableLogging is true")
+
+	if c.Admin.Enabled {
+		check(c.Admin.Port > 0 && c.Admin.Port <= 65535, "admin.port must be between 1 and 65535, got %d", c.Admin.Port)
+		check(c.Admin.Port != c.Server.Port, "admin.port must differ from server.port")
+	}
+	if c.Admin.GRPCPort != 0 {
+		check(c.Admin.GRPCPort > 0 && c.Admin.GRPCPort <= 65535, "admin.grpcPort must be between 1 and 65535, got %d", c.Admin.GRPCPort)
+		check(c.Admin.GRPCPort != c.Server.Port, "admin.grpcPort must differ from server.port")
+		check(c.Admin.ClientCAFile != "", "admin.clientCAFile is required when admin.grpcPort is set")
+		check(c.TLS.CertFile != "" && c.TLS.KeyFile != "", "tls.certFile and tls.keyFile are required when admin.grpcPort is set")
+	}
+
+	check(strings.HasPrefix(c.WebSocket.Path, "/"), "websocket.path must start with /, got %q", c.WebSocket.Path)
+	check(!c.WebSocket.WebClient || c.WebSocket.Path != "/", "websocket.path must not be / when websocket.webClient is true")
+	check(c.WebSocket.ReadBufferSize >= 0, "websocket.readBufferSize must not be negative, got %d", c.WebSocket.ReadBufferSize)
+	check(c.WebSocket.WriteBufferSize >= 0, "websocket.writeBufferSize must not be negative, got %d", c.WebSocket.WriteBufferSize)
+	for _, origin := range c.WebSocket.AllowedOrigins {
+		u, err := url.Parse(origin)
+		check(origin == "*" || (err == nil && u.Scheme != "" && u.Host != ""), "websocket.allowedOrigins entries must be * or scheme://host[:port], got %q", origin)
+	}
+
+	if c.SSE.Enabled {
+		check(c.SSE.SessionTimeout > 0, "sse.sessionTimeout must be positive, got %d", c.SSE.SessionTimeout)
+		check(c.SSE.ReplayBuffer > 0, "sse.replayBuffer must be positive, got %d", c.SSE.ReplayBuffer)
+	}
+
+	if c.IRC.Enabled {
+		check(c.IRC.Port > 0 && c.IRC.Port <= 65535, "irc.port must be between 1 and 65535, got %d", c.IRC.Port)
+		check(c.IRC.Port != c.Server.Port, "irc.port must differ from server.port")
+		check(!c.Admin.Enabled || c.IRC.Port != c.Admin.Port, "irc.port must differ from admin.port")
+		check(c.IRC.ServerName != "" && !strings.ContainsAny(c.IRC.ServerName, " :"), "irc.serverName must be a non-empty name without spaces, got %q", c.IRC.ServerName)
+		check(!c.IRC.TLS || (c.TLS.CertFile != "" && c.TLS.KeyFile != ""), "tls.certFile and tls.keyFile are required when irc.tls is true")
+	}
+	if c.SSH.Enabled {
+		check(c.SSH.Port > 0 && c.SSH.Port <= 65535, "ssh.port must be between 1 and 65535, got %d", c.SSH.Port)
+		check(c.SSH.Port != c.Server.Port, "ssh.port must differ from server.port")
+		check(!c.Admin.Enabled || c.SSH.Port != c.Admin.Port, "ssh.port must differ from admin.port")
+		check(!c.IRC.Enabled || c.SSH.Port != c.IRC.Port, "ssh.port must differ from irc.port")
+		check(c.SSH.HostKeyFile != "", "ssh.hostKeyFile is required when ssh is enabled")
+		check(c.SSH.AuthorizedKeysFile != "", "ssh.authorizedKeysFile is required when ssh is enabled")
+	}
+
+	for _, entry := range c.Proxy.TrustedProxies {
+		_, _, err := net.ParseCIDR(entry)
+		check(err == nil || net.ParseIP(entry) != nil, "proxy.trustedProxies entries must be IP addresses or CIDRs, got %q", entry)
+	}
+	check(!c.Proxy.ProxyProtocol || len(c.Proxy.TrustedProxies) > 0, "proxy.trustedProxies is required when proxy.proxyProtocol is true")
+
+	check(c.Upgrade.DrainTimeout > 0, "upgrade.drainTimeout must be positive, got %d", c.Upgrade.DrainTimeout)
+	check(c.Upgrade.ReadyTimeout > 0, "upgrade.readyTimeout must be positive, got %d", c.Upgrade.ReadyTimeout)
+
+	check(slices.Contains(backplaneTypes, c.Backplane.Type), "backplane.type must be one of %s, got %q", strings.Join(backplaneTypes, ", "), c.Backplane.Type)
+	if c.Backplane.Type == "redis" {
+		check(c.Backplane.Redis.Address != "", "backplane.redis.address is required when backplane.type is redis")
+		check(c.Backplane.Redis.DB >= 0, "backplane.redis.db must not be negative, got %d", c.Backplane.Redis.DB)
+		check(c.Backplane.Redis.Prefix != "", "backplane.redis.prefix is required when backplane.type is redis")
+	}
+
+	if c.Federation.Enabled {
+		f := c.Federation
+		check(validServerName(f.Name), "federation.name must be a host name without @ or spaces, got %q", f.Name)
+		check(f.Port > 0 && f.Port <= 65535, "federation.port must be between 1 and 65535, got %d", f.Port)
+		check(f.Port != c.Server.Port, "federation.port must differ from server.port")
+		check(!c.Admin.Enabled || f.Port != c.Admin.Port, "federation.port must differ from admin.port")
+		check(f.CertFile != "" && f.KeyFile != "", "federation.certFile and federation.keyFile are required when federation is enabled")
+		check(f.CAFile != "", "federation.caFile is required when federation is enabled")
+		check(f.RateLimit > 0, "federation.rateLimit must be positive, got %d", f.RateLimit)
+		check(f.MaxHops > 0, "federation.maxHops must be positive, got %d", f.MaxHops)
+
+		names := make(map[string]bool)
+		for i, peer := range f.Peers {
+			check(validServerName(peer.Name), "federation.peers[%d].name must be a host name without @ or spaces, got %q", i, peer.Name)
+			check(peer.Name != f.Name, "federation.peers[%d].name must differ from federation.name", i)
+			check(!names[peer.Name], "federation.peers[%d].name %q is used twice", i, peer.Name)
+			names[peer.Name] = true
+			_, _, err := net.SplitHostPort(peer.Address)
+			check(err == nil, "federation.peers[%d].address must be host:port, got %q", i, peer.Address)
+			for _, room := range peer.Rooms {
+				check(slices.Contains(rooms, room), "federation.peers[%d].rooms entries must be one of %s, got %q", i, strings.Join(rooms, ", "), room)
+			}
+			check(peer.RateLimit >= 0, "federation.peers[%d].rateLimit must not be negative, got %d", i, peer.RateLimit)
+		}
+	}
+
+	check(c.Webhooks.QueueSize > 0, "webhooks.queueSize must be positive, got %d", c.Webhooks.QueueSize)
+	check(c.Webhooks.Timeout > 0, "webhooks.timeout must be positive, got %d", c.Webhooks.Timeout)
+	check(c.Webhooks.MaxRetries >= 0, "webhooks.maxRetries must not be negative, got %d", c.Webhooks.MaxRetries)
+	webhookNames := make(map[string]bool)
+	for i, endpoint := range c.Webhooks.Endpoints {
+		check(endpoint.Name != "", "webhooks.endpoints[%d].name is required", i)
+		check(!webhookNames[endpoint.Name], "webhooks.endpoints[%d].name %q is used twice", i, endpoint.Name)
+		webhookNames[endpoint.Name] = true
+		u, err := url.Parse(endpoint.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "webhooks.endpoints[%d].url must be an http(s) URL, got %q", i, endpoint.URL)
+		check(endpoint.Secret != "", "webhooks.endpoints[%d].secret is required to sign the payloads", i)
+		check(len(endpoint.Events) > 0, "webhooks.endpoints[%d].events must list at least one event", i)
+		for _, event := range endpoint.Events {
+			check(slices.Contains(webhookEvents, event), "webhooks.endpoints[%d].events entries must be one of %s, got %q", i, strings.Join(webhookEvents, ", "), event)
+		}
+		check(!slices.Contains(endpoint.Events, "keyword") || len(endpoint.Keywords) > 0, "webhooks.endpoints[%d].keywords is required for keyword events", i)
+		for _, room := range endpoint.Rooms {
+			check(slices.Contains(rooms, room), "webhooks.endpoints[%d].rooms entries must be one of %s, got %q", i, strings.Join(rooms, ", "), room)
+		}
+	}
+
+	check(c.IncomingWebhooks.MessagesPerMinute > 0, "incomingWebhooks.messagesPerMinute must be positive, got %d", c.IncomingWebhooks.MessagesPerMinute)
+	check(c.IncomingWebhooks.MaxAttachments >= 0, "incomingWebhooks.maxAttachments must not be negative, got %d", c.IncomingWebhooks.MaxAttachments)
+	hookNames := make(map[string]bool)
+	for i, hook := range c.IncomingWebhooks.Hooks {
+		check(hook.Name != "", "incomingWebhooks.hooks[%d].name is required", i)
+		check(!hookNames[hook.Name], "incomingWebhooks.hooks[%d].name %q is used twice", i, hook.Name)
+		hookNames[hook.Name] = true
+		check(slices.Contains(rooms, hook.Room), "incomingWebhooks.hooks[%d].room must be one of %s, got %q", i, strings.Join(rooms, ", "), hook.Room)
+		check(len(hook.Token.Value()) >= 16, "incomingWebhooks.hooks[%d].token must be at least 16 characters", i)
+		check(hook.Username != "" && !strings.ContainsAny(hook.Username, " []@"), "incomingWebhooks.hooks[%d].username must be a name without spaces, brackets or @, got %q", i, hook.Username)
+		check(hook.MessagesPerMinute >= 0, "incomingWebhooks.hooks[%d].messagesPerMinute must not be negative, got %d", i, hook.MessagesPerMinute)
+	}
+
+	if c.Plugins.Enabled {
+		check(c.Plugins.Dir != "", "plugins.dir is required when plugins.enabled is true")
+		check(c.Plugins.DataDir != "", "plugins.dataDir is required when plugins.enabled is true")
+		check(c.Plugins.Timeout > 0, "plugins.timeout must be positive, got %d", c.Plugins.Timeout)
+		check(c.Plugins.MaxKeys > 0, "plugins.maxKeys must be positive, got %d", c.Plugins.MaxKeys)
+	}
+
+	if c.Moderation.Enabled {
+		c.Moderation.validate(check)
+	}
+
+	if c.TLS.TLSRequire {
+		check(c.TLS.CertFile != "", "tls.certFile is required when tls.tlsRequire is true")
+		check(c.TLS.KeyFile != "", "tls.keyFile is required when tls.tlsRequire is true")
+	}
+	check(c.TLS.MinVersion == "" || slices.Contains(tlsVersions, c.TLS.MinVersion), "tls.minVersion must be one of %s, got %q", strings.Join(tlsVersions, ", "), c.TLS.MinVersion)
+
+	return errors.Join(errs...)
+}
+
+// validServerName reports whether name can address a federated server in user@name
+func validServerName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "@ :/")
+}
+
+// validate checks the filters of an enabled moderation, empty actions disable a filter
+func (m ModerationConfig) validate(check func(ok bool, format string, args ...any)) {
+	validAction := func(action string) bool { return action == "" || slices.Contains(actions, action) }
+	names := make(map[string]bool)
+	for i, rule := range m.Blocklist {
+		check(rule.Name == "" || !names[rule.Name], "moderation.blocklist[%d].name %q is used twice", i, rule.Name)
+		names[rule.Name] = true
+		check((len(rule.Words) > 0) != (rule.Regex != ""), "moderation.blocklist[%d] needs either words or regex", i)
+		for j, word := range rule.Words {
+			check(strings.TrimSpace(word) != "", "moderation.blocklist[%d].words[%d] must not be empty", i, j)
+		}
+		if rule.Regex != "" {
+			_, err := regexp.Compile(rule.Regex)
+			check(err == nil, "moderation.blocklist[%d].regex is invalid: %v", i, err)
+		}
+		check(slices.Contains(actions, rule.Action), "moderation.blocklist[%d].action must be one of %s, got %q", i, strings.Join(actions, ", "), rule.Action)
+	}
+
+	check(validAction(m.Links.Action), "moderation.links.action must be empty or one of %s, got %q", strings.Join(actions, ", "), m.Links.Action)
+	for i, host := range m.Links.Allow {
+		check(host != "" && !strings.ContainsAny(host, " /:"), "moderation.links.allow[%d] must be a host name, got %q", i, host)
+	}
+
+	check(validAction(m.Caps.Action), "moderation.caps.action must be empty or one of %s, got %q", strings.Join(actions, ", "), m.Caps.Action)
+	check(m.Caps.MinLetters > 0, "moderation.caps.minLetters must be positive, got %d", m.Caps.MinLetters)
+	check(m.Caps.MaxPercent > 0 && m.Caps.MaxPercent < 100, "moderation.caps.maxPercent must be between 1 and 99, got %d", m.Caps.MaxPercent)
+
+	check(validAction(m.Repeat.Action), "moderation.repeat.action must be empty or one of %s, got %q", strings.Join(actions, ", "), m.Repeat.Action)
+	check(m.Repeat.MaxRun > 1, "moderation.repeat.maxRun must be at least 2, got %d", m.Repeat.MaxRun)
+
+	// there is nothing to mask in a repeated message
+	check(m.Flood.Action != ActionMask && validAction(m.Flood.Action), "moderation.flood.action must be empty, %s or %s, got %q", ActionReject, ActionFlag, m.Flood.Action)
+	check(m.Flood.MaxRepeats > 0, "moderation.flood.maxRepeats must be positive, got %d", m.Flood.MaxRepeats)
+	check(m.Flood.Window > 0, "moderation.flood.window must be positive, got %d", m.Flood.Window)
+
+	check(!m.Queue || m.QueueSize > 0, "moderation.queueSize must be positive when moderation.queue is true, got %d", m.QueueSize)
+}
@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"chat-server/internal/config"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// level is shared by the default logger so it can be changed at runtime
+var level = new(slog.LevelVar)
+
+// Setup installs the default logger, writing to the log file as well as stdout when logging is enabled
+func Setup(cfg config.LogConfig) error {
+	var out io.Writer = os.Stdout
+	if cfg.EnableLogging && cfg.File != "" {
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		out = io.MultiWriter(os.Stdout, file)
+	}
+
+	SetLevel(cfg.Level)
+	slog.SetDefault(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
+// SetLevel changes the minimum level of the default logger, unknown names fall back to info
+func SetLevel(name string) {
+	switch strings.ToLower(name) {
+	case "debug":
+		level.Set(slog.LevelDebug)
+	case "warn", "warning":
+		level.Set(slog.LevelWarn)
+	case "error":
+		level.Set(slog.LevelError)
+	default:
+		level.Set(slog.LevelInfo)
+	}
+}
+
+// Audit returns the logger of the moderation events, writing JSON lines to cfg.AuditFile or to the
+// default logger when it is empty
+func Audit(cfg config.LogConfig) (*slog.Logger, error) {
+	if cfg.AuditFile == "" {
+		return slog.Default().With("audit", true), nil
+	}
+	file, err := os.OpenFile(cfg.AuditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	return slog.New(slog.NewJSONHandler(file, nil)), nil
+}
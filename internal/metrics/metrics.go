@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chat"
+
+// Message kinds used as the "kind" label of MessagesTotal
+const (
+	KindBroadcast = "broadcast"
+	KindPrivate   = "private"
+	KindDropped   = "dropped"
+)
+
+// Webhook delivery results used as the "result" label of WebhookDeliveries
+const (
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+	WebhookDropped   = "dropped"
+)
+
+var (
+	// ConnectedClients is the number of connected clients per room and transport
+	ConnectedClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_clients",
+		Help:      "Number of connected clients per room and transport.",
+	}, []string{"room", "transport"})
+
+	// MessagesTotal counts broadcast, private and dropped messages
+	MessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_total",
+		Help:      "Messages handled by kind (broadcast, private, dropped).",
+	}, []string{"kind"})
+
+	// RateLimitRejections counts messages refused by the per-client rate limiter
+	RateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Messages rejected by the per-client rate limit.",
+	}, []string{"transport"})
+
+	// MiddlewareRejections counts messages rejected by a middleware stage
+	MiddlewareRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "middleware_rejections_total",
+		Help:      "Messages rejected per middleware chain (inbound, outbound) and stage.",
+	}, []string{"direction", "stage"})
+
+	// ModerationHits counts the hits of the moderation filters
+	ModerationHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "moderation_hits_total",
+		Help:      "Messages caught by a moderation filter, by filter and action (mask, reject, flag).",
+	}, []string{"filter", "action"})
+
+	// AuthFailures counts rejected passwords
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Failed password checks per transport.",
+	}, []string{"transport"})
+
+	// TLSHandshakeErrors counts failed TLS handshakes
+	TLSHandshakeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tls_handshake_errors_total",
+		Help:      "Failed TLS handshakes per transport.",
+	}, []string{"transport"})
+
+	// BroadcastFanoutSeconds observes how long delivering one broadcast to every client takes
+	BroadcastFanoutSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "broadcast_fanout_seconds",
+		Help:      "Time spent delivering a broadcast to all clients.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+
+	// WebhookDeliveries counts webhook deliveries by endpoint and result
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries per endpoint by result (delivered, failed, dropped).",
+	}, []string{"webhook", "result"})
+
+	// ClientQueueDepth observes the outbound queue length of a client when a message is queued
+	ClientQueueDepth = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "client_queue_depth",
+		Help:      "Pending messages in a client's outbound queue when a new one is queued.",
+		Buckets:   prometheus.LinearBuckets(0, 1, 11),
+	})
+)
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
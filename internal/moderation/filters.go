@@ -0,0 +1,252 @@
+package moderation
+
+import (
+	"chat-server/internal/config"
+	"cmp"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// linkPattern finds the links of a message, those starting with a scheme or www.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// hit is a message caught by a filter
+type hit struct {
+	filter string
+	action string
+	// match is what the filter caught, for the moderators
+	match string
+	// reason is told to the sender when the message is rejected
+	reason string
+}
+
+// check runs a filter on text, it returns nil or the hit with the text masked
+type check func(text string) (*hit, string)
+
+// rules are the filters of a config, compiled once
+type rules struct {
+	cfg       *config.Config
+	normalize bool
+	blocklist []blocklistRule
+}
+
+type blocklistRule struct {
+	name    string
+	action  string
+	pattern *regexp.Regexp
+	// words rules match whole words of the folded text, their pattern captures the word
+	words bool
+}
+
+// compile prepares the filters of cfg, whose regular expressions were validated. The words of
+// message.profanity are the first blocklist rule, masked like the other words.
+func compile(cfg *config.Config) *rules {
+	moderation := cfg.Moderation
+	r := &rules{cfg: cfg, normalize: moderation.NormalizeHomoglyphs}
+	if len(cfg.Message.Profanity) > 0 {
+		r.blocklist = append(r.blocklist, r.compileWords("profanity", config.ActionMask, cfg.Message.Profanity))
+	}
+	for i, rule := range moderation.Blocklist {
+		name := cmp.Or(rule.Name, fmt.Sprintf("blocklist[%d]", i))
+		if rule.Regex != "" {
+			r.blocklist = append(r.blocklist, blocklistRule{name: name, action: rule.Action, pattern: regexp.MustCompile(rule.Regex)})
+		} else {
+			r.blocklist = append(r.blocklist, r.compileWords(name, rule.Action, rule.Words))
+		}
+	}
+	return r
+}
+
+// compileWords makes a rule matching the whole words and phrases of words on the folded text
+func (r *rules) compileWords(name, action string, words []string) blocklistRule {
+	// longest first, so that "darn" isn't cut to "dar" when both are listed, the words of a phrase
+	// may be apart by any spaces
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		parts := strings.Fields(fold(word, r.normalize).text)
+		for j, part := range parts {
+			parts[j] = regexp.QuoteMeta(part)
+		}
+		quoted[i] = strings.Join(parts, `\s+`)
+	}
+	slices.SortFunc(quoted, func(a, b string) int { return len(b) - len(a) })
+	return blocklistRule{
+		name:    name,
+		action:  action,
+		pattern: regexp.MustCompile(`(?:^|[^\pL\pN_])(` + strings.Join(quoted, "|") + `)`),
+		words:   true,
+	}
+}
+
+// checks returns the enabled filters, in the order they run: repeat, caps, blocklist then links,
+// so that the masks of the last ones aren't taken for repeated characters
+func (r *rules) checks() []check {
+	moderation := r.cfg.Moderation
+	var checks []check
+	if moderation.Repeat.Action != "" {
+		checks = append(checks, r.checkRepeat)
+	}
+	if moderation.Caps.Action != "" {
+		checks = append(checks, r.checkCaps)
+	}
+	for _, rule := range r.blocklist {
+		checks = append(checks, func(text string) (*hit, string) { return r.checkBlocklist(rule, text) })
+	}
+	if moderation.Links.Action != "" {
+		checks = append(checks, r.checkLinks)
+	}
+	return checks
+}
+
+// checkBlocklist masks the matches of rule. Words rules match the folded text and mask the
+// original characters the matches come from, regex rules match the original text.
+func (r *rules) checkBlocklist(rule blocklistRule, text string) (*hit, string) {
+	var spans [][2]int
+	if rule.words {
+		spans = r.wordSpans(rule, text)
+	} else {
+		for _, match := range rule.pattern.FindAllStringIndex(text, -1) {
+			if match[0] != match[1] {
+				spans = append(spans, [2]int{match[0], match[1]})
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return nil, text
+	}
+
+	var masked strings.Builder
+	var matches []string
+	last := 0
+	for _, span := range spans {
+		masked.WriteString(text[last:span[0]])
+		masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[span[0]:span[1]])))
+		matches = append(matches, text[span[0]:span[1]])
+		last = span[1]
+	}
+	masked.WriteString(text[last:])
+	return &hit{
+		filter: rule.name,
+		action: rule.action,
+		match:  strings.Join(matches, ", "),
+		reason: "contains blocked words",
+	}, masked.String()
+}
+
+// wordSpans returns where the words of rule are in text, matching them on the folded text
+func (r *rules) wordSpans(rule blocklistRule, text string) [][2]int {
+	folded := fold(text, r.normalize)
+	var spans [][2]int
+	for _, match := range rule.pattern.FindAllStringSubmatchIndex(folded.text, -1) {
+		start, end := match[2], match[3]
+		if next, _ := utf8.DecodeRuneInString(folded.text[end:]); end < len(folded.text) && isWordRune(next) {
+			continue
+		}
+		if start == end {
+			continue
+		}
+		start, end = folded.span(text, start, end)
+		spans = append(spans, [2]int{start, end})
+	}
+	return spans
+}
+
+// checkLinks catches the links to hosts outside of the allowlist and replaces them
+func (r *rules) checkLinks(text string) (*hit, string) {
+	links := r.cfg.Moderation.Links
+	var blocked []string
+	masked := linkPattern.ReplaceAllStringFunc(text, func(link string) string {
+		if allowedLink(link, links.Allow) {
+			return link
+		}
+		blocked = append(blocked, link)
+		return "[link removed]"
+	})
+	if len(blocked) == 0 {
+		return nil, text
+	}
+
+	reason := "links aren't allowed"
+	if len(links.Allow) > 0 {
+		reason = "links are only allowed to " + strings.Join(links.Allow, ", ")
+	}
+	return &hit{filter: "links", action: links.Action, match: strings.Join(blocked, ", "), reason: reason}, masked
+}
+
+// allowedLink reports whether link goes to one of the hosts of allow or their subdomains
+func allowedLink(link string, allow []string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return slices.ContainsFunc(allow, func(allowed string) bool {
+		allowed = strings.ToLower(allowed)
+		return host == allowed || strings.HasSuffix(host, "."+allowed)
+	})
+}
+
+// checkCaps catches shouting and lowers it
+func (r *rules) checkCaps(text string) (*hit, string) {
+	caps := r.cfg.Moderation.Caps
+	letters, upper := 0, 0
+	for _, c := range text {
+		if unicode.IsLetter(c) {
+			letters++
+			if unicode.IsUpper(c) {
+				upper++
+			}
+		}
+	}
+	if letters < caps.MinLetters || upper*100 <= letters*caps.MaxPercent {
+		return nil, text
+	}
+	return &hit{
+		filter: "caps",
+		action: caps.Action,
+		match:  fmt.Sprintf("%d%% capitals", upper*100/letters),
+		reason: "too many capitals",
+	}, strings.ToLower(text)
+}
+
+// checkRepeat catches characters repeated more than maxRun times in a row and shortens the runs
+func (r *rules) checkRepeat(text string) (*hit, string) {
+	maxRun := r.cfg.Moderation.Repeat.MaxRun
+	var masked strings.Builder
+	var repeated []rune
+	var previous rune
+	run := 0
+	for _, c := range text {
+		if c == previous {
+			run++
+		} else {
+			previous, run = c, 1
+		}
+		if run <= maxRun {
+			masked.WriteRune(c)
+		} else if run == maxRun+1 {
+			repeated = append(repeated, c)
+		}
+	}
+	if len(repeated) == 0 {
+		return nil, text
+	}
+	return &hit{
+		filter: "repeat",
+		action: r.cfg.Moderation.Repeat.Action,
+		match:  fmt.Sprintf("%q repeated more than %d times", string(repeated), maxRun),
+		reason: "too many repeated characters",
+	}, masked.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
@@ -0,0 +1,174 @@
+// Package moderation filters the messages users send before they are delivered: word and regex
+// blocklists, links, shouting, repeated characters and floods, each masking, rejecting or flagging
+// what it catches. Hits are written to the audit log and flags and rejections can be queued for
+// the moderators, who review them with /modqueue.
+package moderation
+
+import (
+	"chat-server/internal/config"
+	"chat-server/internal/metrics"
+	core "chat-server/internal/server"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Moderator is the inbound stage applying the moderation filters of the config
+type Moderator struct {
+	core  *core.ChatServer
+	store *config.Store
+	audit *slog.Logger
+	queue *queue
+
+	rules atomic.Pointer[rules]
+
+	// floodMutex guards the last messages of the users
+	floodMutex sync.Mutex
+	history    map[string]*history
+}
+
+// history is the last message of a user, sent count times since first
+type history struct {
+	text  string
+	first time.Time
+	count int
+}
+
+// New creates the moderator of the moderation config of store, writing its hits to audit
+func New(coreServer *core.ChatServer, store *config.Store, audit *slog.Logger) *Moderator {
+	return &Moderator{
+		core:    coreServer,
+		store:   store,
+		audit:   audit,
+		queue:   &queue{},
+		history: make(map[string]*history),
+	}
+}
+
+// Serve adds the moderation stage to the inbound chain and the /modqueue command
+func (m *Moderator) Serve() error {
+	m.core.UseInbound("moderation", m.filter)
+	return m.core.RegisterCommand(core.Command{
+		Name:    "modqueue",
+		Args:    "[action] [id]",
+		Role:    core.RoleModerator,
+		Help:    "Review the flagged messages: /modqueue, /modqueue dismiss <id> or /modqueue clear",
+		Handler: m.command,
+	})
+}
+
+// filter is the inbound stage, command lines are left to the commands
+func (m *Moderator) filter(msg *core.Message) error {
+	if msg.Kind == core.MessageCommand {
+		return nil
+	}
+
+	r := m.current()
+	original := msg.Text
+	var caught []string
+	if h := m.checkFlood(r, msg); h != nil {
+		m.record(msg, original, h)
+		if h.action == config.ActionReject {
+			return errors.New(h.reason)
+		}
+		caught = append(caught, h.filter+":"+h.action)
+	}
+
+	for _, check := range r.checks() {
+		h, masked := check(msg.Text)
+		if h == nil {
+			continue
+		}
+		m.record(msg, original, h)
+		switch h.action {
+		case config.ActionReject:
+			return errors.New(h.reason)
+		case config.ActionMask:
+			msg.Text = masked
+		}
+		caught = append(caught, h.filter+":"+h.action)
+	}
+
+	if len(caught) > 0 {
+		msg.Annotate("moderation", strings.Join(caught, ","))
+	}
+	return nil
+}
+
+// current returns the rules of the current config, compiling them after a reload
+func (m *Moderator) current() *rules {
+	cfg := m.store.Get()
+	if r := m.rules.Load(); r != nil && r.cfg == cfg {
+		return r
+	}
+	r := compile(cfg)
+	m.rules.Store(r)
+	return r
+}
+
+// checkFlood catches a user sending the same message over and over
+func (m *Moderator) checkFlood(r *rules, msg *core.Message) *hit {
+	flood := r.cfg.Moderation.Flood
+	if flood.Action == "" {
+		return nil
+	}
+	text := strings.Join(strings.Fields(fold(msg.Text, r.normalize).text), " ")
+	window := time.Duration(flood.Window) * time.Second
+	now := time.Now()
+
+	m.floodMutex.Lock()
+	defer m.floodMutex.Unlock()
+
+	// forget the users who stopped talking, once in a while
+	if len(m.history) >= 1024 {
+		for username, last := range m.history {
+			if now.Sub(last.first) > window {
+				delete(m.history, username)
+			}
+		}
+	}
+
+	last, ok := m.history[msg.From]
+	if !ok || last.text != text || now.Sub(last.first) > window {
+		m.history[msg.From] = &history{text: text, first: now, count: 1}
+		return nil
+	}
+	last.count++
+	if last.count <= flood.MaxRepeats {
+		return nil
+	}
+	return &hit{
+		filter: "flood",
+		action: flood.Action,
+		match:  fmt.Sprintf("sent %d times in %s", last.count, now.Sub(last.first).Round(time.Second)),
+		reason: fmt.Sprintf("you already sent this message %d times, wait before repeating it", last.count-1),
+	}
+}
+
+// record writes h to the audit log and queues flags and rejections for the moderators
+func (m *Moderator) record(msg *core.Message, text string, h *hit) {
+	metrics.ModerationHits.WithLabelValues(h.filter, h.action).Inc()
+	attrs := []any{"filter", h.filter, "action", h.action, "kind", msg.Kind, "from", msg.From}
+	if msg.To != "" {
+		attrs = append(attrs, "to", msg.To)
+	}
+	m.audit.Info("moderation", append(attrs, "match", h.match, "text", text)...)
+
+	if h.action == config.ActionMask || !m.store.Get().Moderation.Queue {
+		return
+	}
+	e := m.queue.push(entry{
+		time:   time.Now(),
+		from:   msg.From,
+		to:     msg.To,
+		filter: h.filter,
+		action: h.action,
+		match:  h.match,
+		text:   text,
+	}, m.store.Get().Moderation.QueueSize)
+	m.core.NotifyModerators(e.String() + ", see /modqueue")
+}
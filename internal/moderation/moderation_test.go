@@ -0,0 +1,133 @@
+package moderation
+
+import (
+	"chat-server/internal/config"
+	core "chat-server/internal/server"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// newModerator returns a moderator of the filters of moderation, with profanity as message.profanity
+func newModerator(moderation config.ModerationConfig, profanity ...string) *Moderator {
+	cfg := &config.Config{Moderation: moderation}
+	cfg.Moderation.Enabled = true
+	cfg.Message.Profanity = profanity
+	return New(core.NewChatServer(), config.NewStore(cfg), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestBlocklist(t *testing.T) {
+	moderation := config.ModerationConfig{
+		NormalizeHomoglyphs: true,
+		Blocklist: []config.BlocklistRule{
+			{Name: "swears", Words: []string{"frack", "smeg head"}, Action: config.ActionMask},
+			{Name: "shout", Regex: "[A-Z]{4,}", Action: config.ActionMask},
+			{Name: "spam", Regex: "(?i)buy\\s+now", Action: config.ActionReject},
+		},
+	}
+	m := newModerator(moderation, "darn")
+
+	tests := []struct {
+		name   string
+		text   string
+		want   string
+		reject bool
+	}{
+		{"clean", "hello there", "hello there", false},
+		{"word", "oh frack it", "oh ***** it", false},
+		{"ignoring case", "FRACK", "*****", false},
+		{"inside a word", "frackle", "frackle", false},
+		{"phrase with spaces", "you smeg   head", "you ***********", false},
+		{"decomposed accent", "oh frack\u0301e", "oh frack\u0301e", false},
+		{"trailing combining mark", "frack\u0301 off", "****** off", false},
+		{"cyrillic", "fr\u0430ck off", "***** off", false},
+		{"fullwidth", "ｆｒａｃｋ!", "*****!", false},
+		{"accents", "frÄck", "*****", false},
+		{"zero width", "fr\u200back", "******", false},
+		{"multibyte around", "日本 frack 日本", "日本 ***** 日本", false},
+		{"profanity", "darn, ｄａｒｎ", "****, ****", false},
+		{"regex on the original text", "say HELLO world", "say ***** world", false},
+		{"regex case sensitive", "say hello world", "say hello world", false},
+		{"regex reject", "BUY  now", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &core.Message{Kind: core.MessageBroadcast, From: "alice", Text: tt.text}
+			err := m.filter(msg)
+			if tt.reject {
+				if err == nil {
+					t.Fatalf("filter(%q) let %q through, want a rejection", tt.text, msg.Text)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("filter(%q): %v", tt.text, err)
+			}
+			if msg.Text != tt.want {
+				t.Fatalf("filter(%q) = %q, want %q", tt.text, msg.Text, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterSkipsCommands(t *testing.T) {
+	m := newModerator(config.ModerationConfig{}, "darn")
+	msg := &core.Message{Kind: core.MessageCommand, From: "alice", Text: "/pm bob darn"}
+	if err := m.filter(msg); err != nil || msg.Text != "/pm bob darn" {
+		t.Fatalf("filter of a command = %q, %v, want it untouched", msg.Text, err)
+	}
+}
+
+func TestFlood(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		texts  []string
+		// caught is the index of the first message caught, -1 for none
+		caught int
+	}{
+		{"under the limit", config.ActionReject, []string{"hi", "hi", "hi"}, -1},
+		{"over the limit", config.ActionReject, []string{"hi", "hi", "hi", "hi"}, 3},
+		{"folded alike", config.ActionReject, []string{"hi  there", "HI there", "ｈｉ there", "h\u0456 there"}, 3},
+		{"different messages", config.ActionReject, []string{"hi", "hi", "hello", "hi", "hi"}, -1},
+		{"flagged", config.ActionFlag, []string{"hi", "hi", "hi", "hi"}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newModerator(config.ModerationConfig{
+				NormalizeHomoglyphs: true,
+				Flood:               config.FloodFilter{Action: tt.action, MaxRepeats: 3, Window: 30},
+			})
+			caught := -1
+			for i, text := range tt.texts {
+				msg := &core.Message{Kind: core.MessageBroadcast, From: "alice", Text: text}
+				if err := m.filter(msg); err != nil && caught < 0 {
+					caught = i
+				}
+			}
+			if caught != tt.caught {
+				t.Fatalf("first message rejected: %d, want %d", caught, tt.caught)
+			}
+
+			// the other users aren't affected
+			msg := &core.Message{Kind: core.MessageBroadcast, From: "bob", Text: tt.texts[0]}
+			if err := m.filter(msg); err != nil {
+				t.Fatalf("bob's message rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestFloodFlagAnnotates(t *testing.T) {
+	m := newModerator(config.ModerationConfig{Flood: config.FloodFilter{Action: config.ActionFlag, MaxRepeats: 1, Window: 30}})
+	var msg *core.Message
+	for range 2 {
+		msg = &core.Message{Kind: core.MessageBroadcast, From: "alice", Text: "hi"}
+		if err := m.filter(msg); err != nil {
+			t.Fatalf("filter: %v", err)
+		}
+	}
+	if got := msg.Meta["moderation"]; got != "flood:flag" {
+		t.Fatalf("moderation annotation = %q, want flood:flag", got)
+	}
+}
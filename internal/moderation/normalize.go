@@ -0,0 +1,83 @@
+package moderation
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// homoglyphs maps the Cyrillic and Greek letters drawn like Latin ones to those. Fullwidth,
+// mathematical and accented letters are handled by the compatibility decomposition.
+var homoglyphs = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k', 'ӏ': 'l',
+	'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's',
+	'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ү': 'y',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'ζ': 'z', 'μ': 'u',
+}
+
+// folded is text prepared for matching, with the offset in the original text of each of its bytes
+type folded struct {
+	text    string
+	offsets []int
+}
+
+// fold lowercases text and, with normalize set, decomposes it, drops the accents and invisible
+// characters and maps the look-alike letters to Latin ones: "Dаrn" with a Cyrillic "а", "ｄａｒｎ"
+// and "d\u200barn" all read "darn"
+func fold(text string, normalize bool) folded {
+	var b strings.Builder
+	offsets := make([]int, 0, len(text))
+	for i, r := range text {
+		if !normalize {
+			n := b.Len()
+			b.WriteRune(unicode.ToLower(r))
+			for range b.Len() - n {
+				offsets = append(offsets, i)
+			}
+			continue
+		}
+		if unicode.Is(unicode.Cf, r) {
+			continue
+		}
+		for _, d := range norm.NFKD.String(string(r)) {
+			if unicode.Is(unicode.Mn, d) {
+				continue
+			}
+			n := b.Len()
+			b.WriteRune(skeleton(d))
+			for range b.Len() - n {
+				offsets = append(offsets, i)
+			}
+		}
+	}
+	return folded{text: b.String(), offsets: offsets}
+}
+
+func skeleton(r rune) rune {
+	r = unicode.ToLower(r)
+	if latin, ok := homoglyphs[r]; ok {
+		return latin
+	}
+	return r
+}
+
+// span returns the part of the original text that produced text[start:end], with the combining
+// marks following it, which were dropped from text
+func (f folded) span(original string, start, end int) (int, int) {
+	last := f.offsets[end-1]
+	_, size := utf8.DecodeRuneInString(original[last:])
+	end = last + size
+	for end < len(original) {
+		r, size := utf8.DecodeRuneInString(original[end:])
+		if !unicode.Is(unicode.Mn, r) {
+			break
+		}
+		end += size
+	}
+	return f.offsets[start], end
+}
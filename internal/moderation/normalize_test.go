@@ -0,0 +1,61 @@
+package moderation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		normalize bool
+		want      string
+	}{
+		{"lowercase", "DaRn", false, "darn"},
+		{"no normalization", "d\u0430rn", false, "d\u0430rn"},
+		{"cyrillic", "d\u0430rn", true, "darn"},
+		{"greek", "ΑΒΓ", true, "abγ"},
+		{"fullwidth", "ｄａｒｎ", true, "darn"},
+		{"accents", "dÄrñ", true, "darn"},
+		{"zero width", "d\u200barn", true, "darn"},
+		{"mathematical", "𝐝𝐚𝐫𝐧", true, "darn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fold(tt.text, tt.normalize).text; got != tt.want {
+				t.Fatalf("fold(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpan(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"ascii", "oh darn it", "darn"},
+		{"multibyte before", "日本 darn", "darn"},
+		{"fullwidth", "oh ｄａｒｎ it", "ｄａｒｎ"},
+		{"accents", "é dÄrn é", "dÄrn"},
+		{"decomposed accent", "oh dare\u0301 it", "dare\u0301"},
+		{"zero width", "oh d\u200barn it", "d\u200barn"},
+		{"mathematical", "𝐝𝐚𝐫𝐧!", "𝐝𝐚𝐫𝐧"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := fold(tt.text, true)
+			word := fold(tt.want, true).text
+			i := strings.Index(f.text, word)
+			if i < 0 {
+				t.Fatalf("%q not in the folded %q", word, f.text)
+			}
+			start, end := f.span(tt.text, i, i+len(word))
+			if got := tt.text[start:end]; got != tt.want {
+				t.Fatalf("span of %q in %q = %q, want %q", word, tt.text, got, tt.want)
+			}
+		})
+	}
+}
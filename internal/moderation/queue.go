@@ -0,0 +1,108 @@
+package moderation
+
+import (
+	core "chat-server/internal/server"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// entry is a message flagged or rejected by a filter, waiting for a moderator
+type entry struct {
+	id     int
+	time   time.Time
+	from   string
+	to     string
+	filter string
+	action string
+	match  string
+	text   string
+}
+
+func (e entry) String() string {
+	from := e.from
+	if e.to != "" {
+		from += " → " + e.to
+	}
+	return fmt.Sprintf("🚩 #%d %s %s (%s, %s: %s): %s", e.id, e.time.Format(time.TimeOnly), from, e.filter, e.action, e.match, e.text)
+}
+
+// queue keeps the last entries of this replica until a moderator dismisses them
+type queue struct {
+	mutex   sync.Mutex
+	entries []entry
+	lastID  int
+}
+
+// push adds e, dropping the oldest entries beyond size, and returns it with its id
+func (q *queue) push(e entry, size int) entry {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.lastID++
+	e.id = q.lastID
+	q.entries = append(q.entries, e)
+	if len(q.entries) > size {
+		q.entries = slices.Delete(q.entries, 0, len(q.entries)-size)
+	}
+	return e
+}
+
+func (q *queue) list() []entry {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return slices.Clone(q.entries)
+}
+
+func (q *queue) dismiss(id int) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i := slices.IndexFunc(q.entries, func(e entry) bool { return e.id == id })
+	if i < 0 {
+		return false
+	}
+	q.entries = slices.Delete(q.entries, i, i+1)
+	return true
+}
+
+func (q *queue) clear() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n := len(q.entries)
+	q.entries = nil
+	return n
+}
+
+// command is the /modqueue command
+func (m *Moderator) command(ctx *core.CommandContext) error {
+	switch ctx.Arg(0) {
+	case "":
+		entries := m.queue.list()
+		if len(entries) == 0 {
+			ctx.Reply("The moderation queue is empty")
+			return nil
+		}
+		ctx.Reply(fmt.Sprintf("Moderation queue (%d):", len(entries)))
+		for _, e := range entries {
+			ctx.Reply("  " + e.String())
+		}
+	case "dismiss":
+		id, err := strconv.Atoi(ctx.Arg(1))
+		if err != nil {
+			return fmt.Errorf("invalid id %q, use /modqueue dismiss <id>", ctx.Arg(1))
+		}
+		if !m.queue.dismiss(id) {
+			return fmt.Errorf("no entry #%d in the moderation queue", id)
+		}
+		ctx.Reply(fmt.Sprintf("Dismissed #%d", id))
+	case "clear":
+		ctx.Reply(fmt.Sprintf("Dismissed %d entries", m.queue.clear()))
+	default:
+		return fmt.Errorf("unknown action %s, use /modqueue, /modqueue dismiss <id> or /modqueue clear", ctx.Arg(0))
+	}
+	return nil
+}
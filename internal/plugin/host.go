@@ -0,0 +1,303 @@
+// Package plugin runs Lua plugins inside the chat server, e.g. auto-responders, message filters or
+// custom commands. Every *.lua file of the plugins directory is a plugin with its own sandboxed
+// interpreter that only sees the chat through the chat table: event hooks, filters, commands,
+// messages and a key-value store. Plugins are reloaded when their file changes.
+package plugin
+
+import (
+	"chat-server/internal/config"
+	core "chat-server/internal/server"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay groups the bursts of events editors make when saving a file into a single reload
+const reloadDelay = 200 * time.Millisecond
+
+// Host loads the plugins of a directory and connects them to the chat
+type Host struct {
+	core *core.ChatServer
+	cfg  config.PluginsConfig
+
+	// reloadMutex serializes reloads, mutex guards the maps
+	reloadMutex sync.Mutex
+	mutex       sync.RWMutex
+	plugins     map[string]*Plugin
+	failed      map[string]error
+	bots        map[string]*core.Bot
+}
+
+// New creates the host of the plugins of cfg.Dir
+func New(coreServer *core.ChatServer, cfg config.PluginsConfig) *Host {
+	return &Host{
+		core:    coreServer,
+		cfg:     cfg,
+		plugins: make(map[string]*Plugin),
+		failed:  make(map[string]error),
+		bots:    make(map[string]*core.Bot),
+	}
+}
+
+// Serve loads the plugins and reloads them whenever the plugins directory changes
+func (h *Host) Serve() error {
+	if info, err := os.Stat(h.cfg.Dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("plugins directory %s not found", h.cfg.Dir)
+	}
+
+	h.core.AddHook(h.dispatch)
+	h.core.UseInbound("plugins", h.filter)
+	err := h.core.RegisterCommand(core.Command{
+		Name:    "plugins",
+		Args:    "[reload]",
+		Role:    core.RoleAdmin,
+		Help:    "List the plugins, or reload them",
+		Handler: h.command,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.Reload()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(h.cfg.Dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	go h.watch(watcher)
+
+	log.Printf("Plugins loaded from %s\n", h.cfg.Dir)
+	return nil
+}
+
+// Reload loads the new and changed plugins of the directory and unloads the removed ones. A plugin
+// failing to load keeps running its previous version.
+func (h *Host) Reload() {
+	h.reloadMutex.Lock()
+	defer h.reloadMutex.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(h.cfg.Dir, "*.lua"))
+	if err != nil {
+		log.Printf("Error listing plugins: %v\n", err)
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".lua")
+		found[name] = true
+
+		source, err := os.ReadFile(path)
+		if err == nil {
+			err = h.load(name, source)
+		}
+		h.mutex.Lock()
+		if err != nil {
+			log.Printf("Error loading plugin %s: %v\n", name, err)
+			h.failed[name] = err
+		} else {
+			delete(h.failed, name)
+		}
+		h.mutex.Unlock()
+	}
+
+	// every plugin that ever loaded has a bot
+	h.mutex.RLock()
+	names := slices.Collect(maps.Keys(h.bots))
+	h.mutex.RUnlock()
+	for _, name := range names {
+		if !found[name] {
+			h.unload(name)
+		}
+	}
+}
+
+// load runs the source of the plugin name and swaps it with the running version, if any
+func (h *Host) load(name string, source []byte) error {
+	if !validName(name) {
+		return errors.New("the file name must be a username without spaces, brackets or @")
+	}
+	h.mutex.RLock()
+	old := h.plugins[name]
+	h.mutex.RUnlock()
+	digest := sha256.Sum256(source)
+	if old != nil && old.digest == digest {
+		return nil
+	}
+
+	bot, err := h.bot(name)
+	if err != nil {
+		return err
+	}
+	p, err := newPlugin(h, name, bot, source)
+	if err != nil {
+		return err
+	}
+	p.digest = digest
+
+	// the commands of both versions usually have the same names
+	if old != nil {
+		old.unregister()
+	}
+	if err := p.register(); err != nil {
+		p.close()
+		if old != nil {
+			if err := old.register(); err != nil {
+				log.Printf("Error restoring the commands of plugin %s: %v\n", name, err)
+			}
+		}
+		return err
+	}
+	if old != nil {
+		old.close()
+	}
+
+	h.mutex.Lock()
+	h.plugins[name] = p
+	h.mutex.Unlock()
+	go p.run()
+	log.Printf("Loaded plugin %s\n", name)
+	return nil
+}
+
+// unload stops the plugin name, if it is running, and frees its commands and username
+func (h *Host) unload(name string) {
+	h.mutex.Lock()
+	p, running := h.plugins[name]
+	bot := h.bots[name]
+	delete(h.plugins, name)
+	delete(h.failed, name)
+	delete(h.bots, name)
+	h.mutex.Unlock()
+
+	bot.Close()
+	if running {
+		p.unregister()
+		p.close()
+		log.Printf("Unloaded plugin %s\n", name)
+	}
+}
+
+// bot returns the user the plugin name speaks as, it outlives reloads
+func (h *Host) bot(name string) (*core.Bot, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if bot, exists := h.bots[name]; exists {
+		return bot, nil
+	}
+	bot, err := h.core.NewBot(name)
+	if err != nil {
+		return nil, fmt.Errorf("username %s: %w", name, err)
+	}
+	h.bots[name] = bot
+	return bot, nil
+}
+
+// sorted returns the running plugins sorted by name, the order their filters run in
+func (h *Host) sorted() []*Plugin {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	names := slices.Sorted(maps.Keys(h.plugins))
+	plugins := make([]*Plugin, len(names))
+	for i, name := range names {
+		plugins[i] = h.plugins[name]
+	}
+	return plugins
+}
+
+// dispatch hands activity to the plugins, except what plugins say themselves so that two
+// auto-responders can't answer each other forever
+func (h *Host) dispatch(activity core.Activity) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if _, fromPlugin := h.bots[activity.Username]; fromPlugin {
+		return
+	}
+	for _, p := range h.plugins {
+		p.enqueue(activity)
+	}
+}
+
+// filter is the inbound stage running the filters of the plugins on messages, command lines are
+// left to the commands
+func (h *Host) filter(msg *core.Message) error {
+	if msg.Kind == core.MessageCommand {
+		return nil
+	}
+	for _, p := range h.sorted() {
+		if err := p.filter(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// command is the /plugins command
+func (h *Host) command(ctx *core.CommandContext) error {
+	switch ctx.Arg(0) {
+	case "":
+	case "reload":
+		h.Reload()
+	default:
+		return fmt.Errorf("unknown action %s, use /plugins or /plugins reload", ctx.Arg(0))
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	ctx.Reply("Plugins: " + strings.Join(slices.Sorted(maps.Keys(h.plugins)), ", "))
+	for _, name := range slices.Sorted(maps.Keys(h.failed)) {
+		ctx.Reply(fmt.Sprintf("Plugin %s failed to load: %v", name, h.failed[name]))
+	}
+	return nil
+}
+
+// watch reloads the plugins after the changes of the *.lua files of the directory
+func (h *Host) watch(watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+
+	var timer *time.Timer
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Ext(event.Name) != ".lua" || event.Has(fsnotify.Chmod) {
+				continue
+			}
+			if timer == nil {
+				timer = time.AfterFunc(reloadDelay, h.Reload)
+			} else {
+				timer.Reset(reloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching plugins: %v\n", err)
+		}
+	}
+}
+
+// validName reports whether a plugin can speak as name
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " []@") && !strings.ContainsFunc(name, unicode.IsControl)
+}
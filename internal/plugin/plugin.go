@@ -0,0 +1,455 @@
+package plugin
+
+import (
+	core "chat-server/internal/server"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Limits of the sandbox: the depth of the call stack, the size of the data stack and the size of
+// a string built by string.rep
+const (
+	callStackSize   = 128
+	registrySize    = 1024
+	registryMaxSize = 64 * 1024
+	maxRepSize      = 1 << 20
+)
+
+// eventQueueSize bounds the events waiting for a plugin, more are dropped
+const eventQueueSize = 256
+
+// events plugins can handle with chat.on
+var events = []string{core.ActivityMessage, core.ActivityJoin, core.ActivityLeave}
+
+// unsafeGlobals reach the file system or load code from outside the plugin
+var unsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "getfenv", "setfenv", "newproxy", "_printregs"}
+
+var errUnloaded = errors.New("plugin unloaded")
+
+// Plugin is a loaded Lua file. Its interpreter runs one call at a time: hooks in the order of the
+// events, on their own goroutine, filters and commands synchronously with the sender.
+type Plugin struct {
+	name   string
+	host   *Host
+	bot    *core.Bot
+	digest [32]byte
+	store  *store
+	events chan core.Activity
+	done   chan struct{}
+
+	// set while the file runs, then read-only
+	handlers map[string][]*lua.LFunction
+	filters  []*lua.LFunction
+	commands []core.Command
+
+	mutex   sync.Mutex
+	state   *lua.LState
+	loading bool
+	closed  bool
+}
+
+// newPlugin runs source, which registers the hooks, filters and commands of the plugin
+func newPlugin(h *Host, name string, bot *core.Bot, source []byte) (*Plugin, error) {
+	kv, err := openStore(h.cfg.DataDir, name, h.cfg.MaxKeys)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plugin{
+		name:     name,
+		host:     h,
+		bot:      bot,
+		store:    kv,
+		events:   make(chan core.Activity, eventQueueSize),
+		done:     make(chan struct{}),
+		handlers: make(map[string][]*lua.LFunction),
+		state: lua.NewState(lua.Options{
+			SkipOpenLibs:    true,
+			CallStackSize:   callStackSize,
+			RegistrySize:    registrySize,
+			RegistryMaxSize: registryMaxSize,
+		}),
+		loading: true,
+	}
+	p.sandbox()
+
+	chunk, err := p.state.Load(strings.NewReader(string(source)), name+".lua")
+	if err != nil {
+		p.state.Close()
+		return nil, errors.New(strings.TrimSpace(err.Error()))
+	}
+	if _, err := p.call(chunk, 0, nil); err != nil {
+		p.state.Close()
+		return nil, err
+	}
+	p.loading = false
+	return p, nil
+}
+
+// sandbox opens the safe standard libraries and the chat table
+func (p *Plugin) sandbox() {
+	L := p.state
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("print", L.NewFunction(p.luaLog))
+	L.GetGlobal("string").(*lua.LTable).RawSetString("rep", L.NewFunction(luaRep))
+
+	chat := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"on":        p.luaOn,
+		"filter":    p.luaFilter,
+		"command":   p.luaCommand,
+		"broadcast": p.luaBroadcast,
+		"send":      p.luaSend,
+		"users":     p.luaUsers,
+		"log":       p.luaLog,
+	})
+	chat.RawSetString("name", lua.LString(p.name))
+	chat.RawSetString("store", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":    p.luaStoreGet,
+		"set":    p.luaStoreSet,
+		"delete": p.luaStoreDelete,
+	}))
+	L.SetGlobal("chat", chat)
+}
+
+// call runs fn with the arguments args builds under the timeout and returns its first nret
+// results. Arguments are built here because the interpreter may only be used under the mutex.
+func (p *Plugin) call(fn *lua.LFunction, nret int, args func(L *lua.LState) []lua.LValue) ([]lua.LValue, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, errUnloaded
+	}
+	L := p.state
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.host.cfg.Timeout)*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	var values []lua.LValue
+	if args != nil {
+		values = args(L)
+	}
+	top := L.GetTop()
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: nret, Protect: true}, values...); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %dms", p.host.cfg.Timeout)
+		}
+		// the message without the stack trace
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) && apiErr.Object != nil {
+			return nil, errors.New(apiErr.Object.String())
+		}
+		return nil, err
+	}
+	results := make([]lua.LValue, nret)
+	for i := range results {
+		results[i] = L.Get(top + 1 + i)
+	}
+	L.SetTop(top)
+	return results, nil
+}
+
+// run calls the hooks of the queued events until the plugin is closed
+func (p *Plugin) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case activity := <-p.events:
+			for _, fn := range p.handlers[activity.Kind] {
+				_, err := p.call(fn, 0, func(L *lua.LState) []lua.LValue {
+					event := L.NewTable()
+					event.RawSetString("user", lua.LString(activity.Username))
+					event.RawSetString("room", lua.LString(activity.Room))
+					event.RawSetString("text", lua.LString(activity.Text))
+					event.RawSetString("time", lua.LNumber(activity.Time.Unix()))
+					return []lua.LValue{event}
+				})
+				if err != nil && !errors.Is(err, errUnloaded) {
+					log.Printf("Plugin %s failed on %s: %v\n", p.name, activity.Kind, err)
+				}
+			}
+		}
+	}
+}
+
+// enqueue queues activity for the hooks of p, it never blocks
+func (p *Plugin) enqueue(activity core.Activity) {
+	if len(p.handlers[activity.Kind]) == 0 {
+		return
+	}
+	select {
+	case p.events <- activity:
+	default:
+		log.Printf("Plugin %s is too slow, dropping a %s event\n", p.name, activity.Kind)
+	}
+}
+
+// filter runs the filters of p. A filter returns nothing to keep the message, a string to replace
+// it or false and a reason to reject it. A failing filter keeps the message.
+func (p *Plugin) filter(msg *core.Message) error {
+	for _, fn := range p.filters {
+		results, err := p.call(fn, 2, func(L *lua.LState) []lua.LValue {
+			message := L.NewTable()
+			message.RawSetString("user", lua.LString(msg.From))
+			message.RawSetString("to", lua.LString(msg.To))
+			message.RawSetString("text", lua.LString(msg.Text))
+			return []lua.LValue{message}
+		})
+		if err != nil {
+			if !errors.Is(err, errUnloaded) {
+				log.Printf("Plugin %s failed filtering a message: %v\n", p.name, err)
+			}
+			continue
+		}
+		switch result := results[0].(type) {
+		case lua.LString:
+			msg.Text = string(result)
+		case lua.LBool:
+			if !result {
+				if reason, ok := results[1].(lua.LString); ok {
+					return errors.New(string(reason))
+				}
+				return fmt.Errorf("blocked by %s", p.name)
+			}
+		}
+	}
+	return nil
+}
+
+// register adds the commands of p to the chat, none when one of them is taken
+func (p *Plugin) register() error {
+	for i, cmd := range p.commands {
+		if err := p.host.core.RegisterCommand(cmd); err != nil {
+			for _, registered := range p.commands[:i] {
+				p.host.core.UnregisterCommand(registered.Name)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) unregister() {
+	for _, cmd := range p.commands {
+		p.host.core.UnregisterCommand(cmd.Name)
+	}
+}
+
+// close stops the hooks of p and frees its interpreter
+func (p *Plugin) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.state.Close()
+}
+
+// runCommand runs the Lua handler of a command. It returns a string to reply or nil and an
+// error message for the user, errors it raises are logged.
+func (p *Plugin) runCommand(fn *lua.LFunction, ctx *core.CommandContext) error {
+	results, err := p.call(fn, 2, func(L *lua.LState) []lua.LValue {
+		args := L.NewTable()
+		for _, arg := range ctx.Args {
+			args.Append(lua.LString(arg))
+		}
+		command := L.NewTable()
+		command.RawSetString("user", lua.LString(ctx.Client.Username))
+		command.RawSetString("role", lua.LString(ctx.Server.Role(ctx.Client).String()))
+		command.RawSetString("args", args)
+		command.RawSetString("reply", L.NewFunction(func(L *lua.LState) int {
+			ctx.Reply(L.CheckString(1))
+			return 0
+		}))
+		return []lua.LValue{command}
+	})
+	if err != nil {
+		log.Printf("Plugin %s failed running a command: %v\n", p.name, err)
+		return fmt.Errorf("plugin %s failed", p.name)
+	}
+	if reply, ok := results[0].(lua.LString); ok {
+		ctx.Reply(string(reply))
+	}
+	if message, ok := results[1].(lua.LString); ok {
+		return errors.New(string(message))
+	}
+	return nil
+}
+
+// ------------Lua API-------------
+
+// mustLoad raises an error unless the file of the plugin is running, registrations happen there
+func (p *Plugin) mustLoad(L *lua.LState, function string) {
+	if !p.loading {
+		L.RaiseError("%s can only be called when the plugin loads", function)
+	}
+}
+
+// chat.on(event, function(event)): calls the function on "message", "join" or "leave" events
+func (p *Plugin) luaOn(L *lua.LState) int {
+	p.mustLoad(L, "chat.on")
+	event := L.CheckString(1)
+	fn := L.CheckFunction(2)
+	valid := false
+	for _, name := range events {
+		valid = valid || name == event
+	}
+	if !valid {
+		L.ArgError(1, fmt.Sprintf("unknown event %q, use %s", event, strings.Join(events, ", ")))
+	}
+	p.handlers[event] = append(p.handlers[event], fn)
+	return 0
+}
+
+// chat.filter(function(message)): see Plugin.filter
+func (p *Plugin) luaFilter(L *lua.LState) int {
+	p.mustLoad(L, "chat.filter")
+	p.filters = append(p.filters, L.CheckFunction(1))
+	return 0
+}
+
+// chat.command{name=, aliases={}, args=, role=, help=, handler=function(command)}
+func (p *Plugin) luaCommand(L *lua.LState) int {
+	p.mustLoad(L, "chat.command")
+	spec := L.CheckTable(1)
+	handler, ok := spec.RawGetString("handler").(*lua.LFunction)
+	if !ok {
+		L.ArgError(1, "handler must be a function")
+	}
+
+	cmd := core.Command{
+		Name: lua.LVAsString(spec.RawGetString("name")),
+		Args: lua.LVAsString(spec.RawGetString("args")),
+		Help: lua.LVAsString(spec.RawGetString("help")),
+		Handler: func(ctx *core.CommandContext) error {
+			return p.runCommand(handler, ctx)
+		},
+	}
+	if aliases, ok := spec.RawGetString("aliases").(*lua.LTable); ok {
+		aliases.ForEach(func(_, alias lua.LValue) {
+			cmd.Aliases = append(cmd.Aliases, lua.LVAsString(alias))
+		})
+	}
+	switch role := lua.LVAsString(spec.RawGetString("role")); role {
+	case "", core.RoleUser.String():
+	case core.RoleModerator.String():
+		cmd.Role = core.RoleModerator
+	case core.RoleAdmin.String():
+		cmd.Role = core.RoleAdmin
+	default:
+		L.ArgError(1, fmt.Sprintf("unknown role %q, use user, moderator or admin", role))
+	}
+	if cmd.Help == "" {
+		cmd.Help = "Added by the " + p.name + " plugin"
+	}
+	p.commands = append(p.commands, cmd)
+	return 0
+}
+
+// chat.broadcast(text): says text to everyone as the plugin
+func (p *Plugin) luaBroadcast(L *lua.LState) int {
+	p.bot.Say(L.CheckString(1))
+	return 0
+}
+
+// chat.send(username, text): says text privately to username, returns true or nil and an error
+func (p *Plugin) luaSend(L *lua.LState) int {
+	if err := p.bot.Tell(L.CheckString(1), L.CheckString(2)); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// chat.users(): the online usernames
+func (p *Plugin) luaUsers(L *lua.LState) int {
+	users := L.NewTable()
+	for _, username := range p.host.core.Usernames() {
+		users.Append(lua.LString(username))
+	}
+	L.Push(users)
+	return 1
+}
+
+// chat.log(...) and print(...): writes to the server log
+func (p *Plugin) luaLog(L *lua.LState) int {
+	parts := make([]string, L.GetTop())
+	for i := range parts {
+		parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	log.Printf("plugin %s: %s\n", p.name, strings.Join(parts, " "))
+	return 0
+}
+
+// chat.store.get(key): the value of key, nil when unset
+func (p *Plugin) luaStoreGet(L *lua.LState) int {
+	if value, ok := p.store.get(L.CheckString(1)); ok {
+		L.Push(lua.LString(value))
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// chat.store.set(key, value): saves value, a string or number, nil deletes the key
+func (p *Plugin) luaStoreSet(L *lua.LState) int {
+	key := L.CheckString(1)
+	var err error
+	if L.Get(2) == lua.LNil {
+		err = p.store.delete(key)
+	} else {
+		err = p.store.set(key, L.CheckString(2))
+	}
+	if err != nil {
+		L.RaiseError("chat.store.set: %v", err)
+	}
+	return 0
+}
+
+// chat.store.delete(key)
+func (p *Plugin) luaStoreDelete(L *lua.LState) int {
+	if err := p.store.delete(L.CheckString(1)); err != nil {
+		L.RaiseError("chat.store.delete: %v", err)
+	}
+	return 0
+}
+
+// luaRep is string.rep refusing to build strings above maxRepSize, a single call could otherwise
+// exhaust the memory before the timeout
+func luaRep(L *lua.LState) int {
+	s := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n > 0 && len(s) > maxRepSize/n {
+		L.RaiseError("string.rep: result larger than %d bytes", maxRepSize)
+	}
+	L.Push(lua.LString(strings.Repeat(s, max(n, 0))))
+	return 1
+}
@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// maxValueSize bounds a value of the key-value store
+const maxValueSize = 64 << 10
+
+// store is the key-value store of a plugin, saved as JSON in the data directory after each change.
+// It is only used by calls of its plugin, which hold the plugin's mutex.
+type store struct {
+	path    string
+	maxKeys int
+	values  map[string]string
+}
+
+// openStore reads the store of the plugin name, empty when it was never saved
+func openStore(dir, name string, maxKeys int) (*store, error) {
+	s := &store{
+		path:    filepath.Join(dir, name+".json"),
+		maxKeys: maxKeys,
+		values:  make(map[string]string),
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", s.path, err)
+	}
+	return s, nil
+}
+
+func (s *store) get(key string) (string, bool) {
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *store) set(key, value string) error {
+	if len(value) > maxValueSize {
+		return fmt.Errorf("value too large (max %d bytes)", maxValueSize)
+	}
+	if _, exists := s.values[key]; !exists && len(s.values) >= s.maxKeys {
+		return fmt.Errorf("store full (max %d keys)", s.maxKeys)
+	}
+	s.values[key] = value
+	return s.save()
+}
+
+func (s *store) delete(key string) error {
+	if _, exists := s.values[key]; !exists {
+		return nil
+	}
+	delete(s.values, key)
+	return s.save()
+}
+
+// save writes the store to a temporary file renamed over the previous one, so that a crash never
+// leaves half a file
+func (s *store) save() error {
+	data, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
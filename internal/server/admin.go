@@ -0,0 +1,283 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+)
+
+// kickFlushTimeout bounds the wait for the reason of a kick to be written before the connection
+// is closed
+const kickFlushTimeout = time.Second
+
+// ClientInfo is a read-only view of a connected client
+type ClientInfo struct {
+	Username    string    `json:"username"`
+	Transport   string    `json:"transport"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Muted       bool      `json:"muted"`
+}
+
+// Stats summarises the state of the chat server
+type Stats struct {
+	Clients     int            `json:"clients"`
+	Transports  map[string]int `json:"transports"`
+	BannedUsers []string       `json:"bannedUsers"`
+	MutedUsers  []string       `json:"mutedUsers"`
+	Draining    bool           `json:"draining"`
+	StartedAt   time.Time      `json:"startedAt"`
+	Uptime      string         `json:"uptime"`
+}
+
+// Clients returns the connected clients sorted by username
+func (s *ChatServer) Clients() []ClientInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	clients := make([]ClientInfo, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, ClientInfo{
+			Username:    client.Username,
+			Transport:   client.Transport,
+			RemoteAddr:  client.RemoteAddr,
+			ConnectedAt: client.ConnectedAt,
+			Muted:       s.isMuted(client.Username),
+		})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Username < clients[j].Username })
+	return clients
+}
+
+// Stats returns the current server statistics
+func (s *ChatServer) Stats() Stats {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	transports := make(map[string]int)
+	for _, client := range s.clients {
+		transports[client.Transport]++
+	}
+	banned := make(map[string]struct{}, len(s.bans)+len(s.configBans))
+	maps.Copy(banned, s.configBans)
+	maps.Copy(banned, s.bans)
+	var muted []string
+	for username := range s.mutes {
+		if s.isMuted(username) {
+			muted = append(muted, username)
+		}
+	}
+	sort.Strings(muted)
+
+	return Stats{
+		Clients:     len(s.clients),
+		Transports:  transports,
+		BannedUsers: slices.Sorted(maps.Keys(banned)),
+		MutedUsers:  muted,
+		Draining:    s.draining,
+		StartedAt:   s.startedAt,
+		Uptime:      time.Since(s.startedAt).Round(time.Second).String(),
+	}
+}
+
+// Kick disconnects a client by closing its connection, the transport handler then cleans it up
+func (s *ChatServer) Kick(username, reason string) error {
+	s.mutex.RLock()
+	client, exists := s.clients[username]
+	s.mutex.RUnlock()
+
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	n, queued := client.trySend(fmt.Sprintf("You have been kicked from the chat (%s).", reason))
+	if client.close == nil {
+		return nil
+	}
+	// a client that doesn't read its messages won't read the reason either
+	if !queued {
+		if err := client.close(); err != nil {
+			log.Printf("Error closing the connection of %s: %v\n", username, err)
+		}
+		return nil
+	}
+	// the connection is closed once the writer wrote the reason, or gave up on a slow client
+	go func() {
+		client.waitWritten(n, kickFlushTimeout)
+		if err := client.close(); err != nil {
+			log.Printf("Error closing the connection of %s: %v\n", username, err)
+		}
+	}()
+	return nil
+}
+
+// Ban refuses future connections of username and kicks it if connected
+func (s *ChatServer) Ban(username string) {
+	s.mutex.Lock()
+	s.bans[username] = struct{}{}
+	s.mutex.Unlock()
+
+	_ = s.Kick(username, "banned")
+}
+
+// Unban lifts a ban set with Ban, bans from the configuration stay in place
+func (s *ChatServer) Unban(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, banned := s.bans[username]; !banned {
+		return ErrUserNotBanned
+	}
+	delete(s.bans, username)
+	return nil
+}
+
+// Announce sends a system message to every connected client, on every replica
+func (s *ChatServer) Announce(message string) {
+	s.publish(Event{Kind: EventAnnounce, Text: message})
+}
+
+// announce sends a system message to the clients of this replica
+func (s *ChatServer) announce(message string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, client := range s.clients {
+		client.Send(fmt.Sprintf("[System]: %s", message))
+	}
+}
+
+// NotifyModerators sends a system message to the moderators and admins connected to this replica
+func (s *ChatServer) NotifyModerators(message string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, client := range s.clients {
+		if s.role(client) >= RoleModerator {
+			client.Send(fmt.Sprintf("[Moderation]: %s", message))
+		}
+	}
+}
+
+// Topic returns the topic of the chat, empty when none was set
+func (s *ChatServer) Topic() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.topic
+}
+
+// SetTopic changes the topic of the chat and tells every connected client who changed it
+func (s *ChatServer) SetTopic(by, topic string) {
+	s.publish(Event{Kind: EventTopic, From: by, Text: topic})
+}
+
+// Mute stops username from sending messages for duration, or until Unmute when duration is 0.
+// The mute is kept by username so it survives reconnects.
+func (s *ChatServer) Mute(username string, duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	s.mutes[username] = until
+	s.pruneMutes()
+}
+
+// Unmute lifts a mute set with Mute
+func (s *ChatServer) Unmute(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	muted := s.isMuted(username)
+	delete(s.mutes, username)
+	if !muted {
+		return ErrUserNotMuted
+	}
+	return nil
+}
+
+// IsMuted reports whether username is currently muted, an expired mute is forgotten
+func (s *ChatServer) IsMuted(username string) bool {
+	s.mutex.RLock()
+	until, muted := s.mutes[username]
+	s.mutex.RUnlock()
+	if !muted || !muteExpired(until) {
+		return muted
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if until, muted := s.mutes[username]; muted && muteExpired(until) {
+		delete(s.mutes, username)
+	}
+	return s.isMuted(username)
+}
+
+// isMuted is IsMuted for callers already holding the mutex
+func (s *ChatServer) isMuted(username string) bool {
+	until, muted := s.mutes[username]
+	return muted && !muteExpired(until)
+}
+
+// pruneMutes forgets the expired mutes of the users who never came back, the caller holds the mutex
+func (s *ChatServer) pruneMutes() {
+	for username, until := range s.mutes {
+		if muteExpired(until) {
+			delete(s.mutes, username)
+		}
+	}
+}
+
+// muteExpired reports whether a mute until until is over, a zero until never ends
+func muteExpired(until time.Time) bool {
+	return !until.IsZero() && !time.Now().Before(until)
+}
+
+// Drain stops accepting new clients and announces message to the connected ones.
+// When deadline is positive, the clients still connected once it expires are kicked.
+func (s *ChatServer) Drain(message string, deadline time.Duration) {
+	s.mutex.Lock()
+	started := !s.draining
+	s.draining = true
+	onDrain := s.onDrain
+	s.mutex.Unlock()
+
+	if started {
+		for _, fn := range onDrain {
+			fn()
+		}
+	}
+
+	// only the clients of this replica are concerned
+	if message != "" {
+		s.announce(message)
+	}
+	if deadline > 0 {
+		time.AfterFunc(deadline, func() {
+			for _, client := range s.Clients() {
+				_ = s.Kick(client.Username, "server shutting down")
+			}
+		})
+	}
+}
+
+// OnDrain adds fn to the functions called when the server starts draining, e.g. to tell the load
+// balancers to stop sending clients
+func (s *ChatServer) OnDrain(fn func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onDrain = append(s.onDrain, fn)
+}
+
+// Draining reports whether Drain was called
+func (s *ChatServer) Draining() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.draining
+}
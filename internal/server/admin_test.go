@@ -0,0 +1,95 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKickClientNotReading(t *testing.T) {
+	s := NewChatServer()
+	closed := make(chan struct{})
+	client, err := s.Connect("alice", ConnectOptions{
+		Transport:  "tcp",
+		MaxClients: 10,
+		RateLimit:  5,
+		Close:      func() error { close(closed); return nil },
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	for len(client.Message) < cap(client.Message) {
+		client.Send("unread")
+	}
+
+	kicked := make(chan error, 1)
+	go func() { kicked <- s.Kick("alice", "spamming") }()
+	select {
+	case err := <-kicked:
+		if err != nil {
+			t.Fatalf("Kick: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Kick blocked on the full queue")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the connection of a client with a full queue wasn't closed")
+	}
+
+	// the transport handler disconnects it once the connection is closed
+	done := make(chan struct{})
+	go func() {
+		s.Disconnect(client)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect blocked after the kick")
+	}
+}
+
+func TestKickWritesReason(t *testing.T) {
+	s := NewChatServer()
+	closed := make(chan struct{})
+	client, err := s.Connect("alice", ConnectOptions{
+		Transport:  "tcp",
+		MaxClients: 10,
+		RateLimit:  5,
+		Close:      func() error { close(closed); return nil },
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	written := make(chan string, 10)
+	go client.Write(func(message string) { written <- message })
+
+	if err := s.Kick("alice", "spamming"); err != nil {
+		t.Fatalf("Kick: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the connection wasn't closed")
+	}
+	if got := <-written; got != "You have been kicked from the chat (spamming)." {
+		t.Fatalf("wrote %q before closing, want the reason", got)
+	}
+	s.Disconnect(client)
+}
+
+func TestOnDrain(t *testing.T) {
+	s := NewChatServer()
+	calls := 0
+	s.OnDrain(func() { calls++ })
+
+	s.Drain("", 0)
+	s.Drain("", 0)
+	if calls != 1 {
+		t.Fatalf("OnDrain functions called %d times, want once", calls)
+	}
+	if _, err := s.Connect("alice", ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 5}); err != ErrServerDraining {
+		t.Fatalf("Connect while draining: got %v, want ErrServerDraining", err)
+	}
+}
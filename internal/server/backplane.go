@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// backplaneTimeout bounds each backplane call made while serving a client
+const backplaneTimeout = 5 * time.Second
+
+// Kinds of events published on the backplane
+const (
+	EventBroadcast = "broadcast"
+	EventPrivate   = "private"
+	EventAnnounce  = "announce"
+	EventTopic     = "topic"
+)
+
+// Event is a message routed through the backplane to the replicas holding its recipients
+type Event struct {
+	Kind string `json:"kind"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	Text string `json:"text"`
+	// Meta holds the annotations of the inbound middlewares
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// Backplane connects the chat servers of several replicas. Messages, presence and usernames go
+// through it, so users see each other whichever replica they are connected to.
+type Backplane interface {
+	// Reserve claims username on every replica, ErrUsernameAlreadyTaken when it is in use
+	Reserve(ctx context.Context, username string) error
+	// Release frees a username claimed with Reserve
+	Release(ctx context.Context, username string) error
+	// Online reports whether username is connected to any replica
+	Online(ctx context.Context, username string) (bool, error)
+	// Users returns the usernames connected to any replica
+	Users(ctx context.Context) ([]string, error)
+	// Publish delivers event to the handlers of every replica, this one included
+	Publish(ctx context.Context, event Event) error
+	// Subscribe sets the handler receiving the published events, it is called once
+	Subscribe(handler func(Event)) error
+	Close() error
+}
+
+// MemoryBackplane is the backplane of a single replica, events are delivered synchronously
+type MemoryBackplane struct {
+	mutex   sync.RWMutex
+	users   map[string]struct{}
+	handler func(Event)
+}
+
+// NewMemoryBackplane creates a backplane for a server running alone
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{users: make(map[string]struct{})}
+}
+
+func (b *MemoryBackplane) Reserve(ctx context.Context, username string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, exists := b.users[username]; exists {
+		return ErrUsernameAlreadyTaken
+	}
+	b.users[username] = struct{}{}
+	return nil
+}
+
+func (b *MemoryBackplane) Release(ctx context.Context, username string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.users, username)
+	return nil
+}
+
+func (b *MemoryBackplane) Online(ctx context.Context, username string) (bool, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	_, exists := b.users[username]
+	return exists, nil
+}
+
+func (b *MemoryBackplane) Users(ctx context.Context) ([]string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return slices.Sorted(maps.Keys(b.users)), nil
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, event Event) error {
+	b.mutex.RLock()
+	handler := b.handler
+	b.mutex.RUnlock()
+
+	if handler != nil {
+		handler(event)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(handler func(Event)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.handler = handler
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	return nil
+}
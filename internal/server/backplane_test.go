@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestMemoryBackplaneReserve(t *testing.T) {
+	b := NewMemoryBackplane()
+	ctx := context.Background()
+
+	if err := b.Reserve(ctx, "alice"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := b.Reserve(ctx, "alice"); !errors.Is(err, ErrUsernameAlreadyTaken) {
+		t.Fatalf("Reserve twice: got %v, want ErrUsernameAlreadyTaken", err)
+	}
+	if err := b.Reserve(ctx, "bob"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if online, _ := b.Online(ctx, "alice"); !online {
+		t.Fatal("alice isn't online after Reserve")
+	}
+	if users, _ := b.Users(ctx); !slices.Equal(users, []string{"alice", "bob"}) {
+		t.Fatalf("Users = %v, want [alice bob]", users)
+	}
+
+	if err := b.Release(ctx, "alice"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if online, _ := b.Online(ctx, "alice"); online {
+		t.Fatal("alice is online after Release")
+	}
+	if err := b.Reserve(ctx, "alice"); err != nil {
+		t.Fatalf("Reserve after Release: %v", err)
+	}
+}
+
+func TestMemoryBackplanePublish(t *testing.T) {
+	b := NewMemoryBackplane()
+	ctx := context.Background()
+
+	// nothing to deliver to before Subscribe
+	if err := b.Publish(ctx, Event{Kind: EventBroadcast, Text: "lost"}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	var got []Event
+	if err := b.Subscribe(func(event Event) { got = append(got, event) }); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	event := Event{Kind: EventPrivate, From: "alice", To: "bob", Text: "hi"}
+	if err := b.Publish(ctx, event); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if len(got) != 1 || got[0].Text != event.Text || got[0].To != event.To {
+		t.Fatalf("handler received %v, want [%v]", got, event)
+	}
+}
+
+func TestMemoryBackplaneServer(t *testing.T) {
+	s := NewChatServer()
+	connect := func(username string) *Client {
+		t.Helper()
+		client, err := s.Connect(username, ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 5})
+		if err != nil {
+			t.Fatalf("Connect %s: %v", username, err)
+		}
+		return client
+	}
+	alice, bob := connect("alice"), connect("bob")
+	if _, err := s.Connect("alice", ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 5}); !errors.Is(err, ErrUsernameAlreadyTaken) {
+		t.Fatalf("Connect alice twice: got %v, want ErrUsernameAlreadyTaken", err)
+	}
+
+	s.Broadcast(alice, "hello")
+	if got := <-bob.Message; got != "[alice]: hello" {
+		t.Fatalf("bob received %q, want the broadcast", got)
+	}
+	if len(alice.Message) != 0 {
+		t.Fatal("the sender received its own broadcast")
+	}
+
+	s.Disconnect(bob)
+	if err := s.PrivateMessage(alice, "bob", "hi"); !errors.Is(err, ErrRecipientNotFound) {
+		t.Fatalf("PrivateMessage after Disconnect: got %v, want ErrRecipientNotFound", err)
+	}
+	if _, err := s.Connect("bob", ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 5}); err != nil {
+		t.Fatalf("Connect after Disconnect: %v", err)
+	}
+}
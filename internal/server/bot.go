@@ -0,0 +1,81 @@
+package server
+
+import (
+	"chat-server/internal/server/network"
+	"fmt"
+	"time"
+)
+
+// Bot is a user living in the server process, e.g. a helper answering its own commands. Its
+// messages look like anyone's and nobody can connect with its name.
+type Bot struct {
+	server *ChatServer
+	client *Client
+}
+
+// NewBot creates the bot named name, the name must be free. Every replica of the chat should run
+// the same bots.
+func (s *ChatServer) NewBot(name string) (*Bot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.clients[name]; exists || reservedUsername(name) {
+		return nil, ErrUsernameAlreadyTaken
+	}
+	if _, exists := s.bots[name]; exists {
+		return nil, ErrUsernameAlreadyTaken
+	}
+
+	bot := &Bot{
+		server: s,
+		client: &Client{
+			Username:    name,
+			Transport:   network.TransportBot,
+			ConnectedAt: time.Now(),
+			connected:   true,
+		},
+	}
+	s.bots[name] = bot
+	return bot, nil
+}
+
+// Name returns the username of b
+func (b *Bot) Name() string {
+	return b.client.Username
+}
+
+// Close frees the name of b, its commands and hooks stay registered
+func (b *Bot) Close() {
+	b.server.mutex.Lock()
+	defer b.server.mutex.Unlock()
+
+	delete(b.server.bots, b.Name())
+}
+
+// Command registers a command of b, like ChatServer.RegisterCommand
+func (b *Bot) Command(cmd Command) error {
+	if err := b.server.RegisterCommand(cmd); err != nil {
+		return fmt.Errorf("bot %s: %w", b.Name(), err)
+	}
+	return nil
+}
+
+// OnMessage calls handler with the messages of the others, it is called synchronously with the
+// sender like the hooks of ChatServer.AddHook
+func (b *Bot) OnMessage(handler func(Activity)) {
+	b.server.AddHook(func(activity Activity) {
+		if activity.Kind == ActivityMessage && activity.Username != b.Name() {
+			handler(activity)
+		}
+	})
+}
+
+// Say sends text to everyone
+func (b *Bot) Say(text string) {
+	b.server.Broadcast(b.client, text)
+}
+
+// Tell sends text privately to username
+func (b *Bot) Tell(username, text string) error {
+	return b.server.PrivateMessage(b.client, username, text)
+}
@@ -1,24 +1,109 @@
 package server
 
-import "sync"
+import (
+	"chat-server/internal/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Client represent a connected chat client
 type Client struct {
-	Username  string
-	Message   chan string
-	connected bool
-	mutex     sync.RWMutex
-	limiter   *TokenBucket
+	Username    string
+	Transport   string
+	RemoteAddr  string // the real client address, behind trusted proxies too
+	ConnectedAt time.Time
+	Message     chan string
+	connected   bool
+	mutex       sync.RWMutex
+	limiter     *TokenBucket
+	close       func() error
+	// authenticated clients proved they own their username, only they get their role
+	authenticated bool
+
+	// sent and written count the messages queued and handed to the connection, so that Kick can
+	// close it once its reason went out
+	sent    uint64
+	written atomic.Uint64
+	flushed chan struct{}
+}
+
+// NewSender returns a client that never connects, for transports sending a user's messages
+// without a session. Its messages are rate limited to rateLimit per second like a client's.
+func NewSender(username, transport string, rateLimit int) *Client {
+	return &Client{
+		Username:  username,
+		Transport: transport,
+		Message:   make(chan string, 1),
+		limiter:   NewTokenBucket(rateLimit, time.Second/time.Duration(rateLimit)),
+	}
 }
 
 // Send sends a message to the client
 func (c *Client) Send(message string) {
+	c.send(message)
+}
+
+// send queues message and returns its number, 0 when the client is disconnected
+func (c *Client) send(message string) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.connected {
+		metrics.MessagesTotal.WithLabelValues(metrics.KindDropped).Inc()
+		return 0
+	}
+	metrics.ClientQueueDepth.Observe(float64(len(c.Message)))
+	c.Message <- message
+	c.sent++
+	return c.sent
+}
+
+// trySend queues message unless the queue is full, it returns its number, 0 when the client is
+// disconnected, and false when the message couldn't be queued
+func (c *Client) trySend(message string) (uint64, bool) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if c.connected {
-		c.Message <- message
+	if !c.connected {
+		return 0, true
+	}
+	select {
+	case c.Message <- message:
+		c.sent++
+		return c.sent, true
+	default:
+		metrics.MessagesTotal.WithLabelValues(metrics.KindDropped).Inc()
+		return 0, false
+	}
+}
+
+// Write hands the messages of the client to write, in order, until it disconnects
+func (c *Client) Write(write func(message string)) {
+	for message := range c.Message {
+		write(message)
+		c.written.Add(1)
+		select {
+		case c.flushed <- struct{}{}:
+		default:
+		}
 	}
-	return
+}
+
+// waitWritten waits until the message numbered n was written, at most timeout
+func (c *Client) waitWritten(n uint64, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for c.written.Load() < n {
+		select {
+		case <-c.flushed:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Allow reports whether the client may send a message now, according to its rate limit
+func (c *Client) Allow() bool {
+	return c.limiter.Allow()
 }
 
 // Receive returns the next message for the client
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Role grants commands, every role has the commands of the roles below it
+type Role int
+
+const (
+	RoleUser Role = iota
+	RoleModerator
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleModerator:
+		return "moderator"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "user"
+	}
+}
+
+// Command is a slash command, e.g. /pm bob hello
+type Command struct {
+	Name    string
+	Aliases []string
+	// Args describes the arguments, e.g. "<username> [reason...]": <required>, [optional], and
+	// "..." on the last one to take the rest of the line, spaces included
+	Args string
+	// Role is the least role allowed to run the command
+	Role Role
+	// Help is the one line description shown by /help
+	Help    string
+	Handler func(ctx *CommandContext) error
+}
+
+// CommandContext is a command being run
+type CommandContext struct {
+	Server *ChatServer
+	Client *Client
+	Args   []string
+	// Reply sends text to the user who ran the command, through their transport
+	Reply func(text string)
+	quit  bool
+}
+
+// Arg returns the i-th argument, empty when it was left out
+func (c *CommandContext) Arg(i int) string {
+	if i < len(c.Args) {
+		return c.Args[i]
+	}
+	return ""
+}
+
+// Quit ends the session of the user once the command returns
+func (c *CommandContext) Quit() {
+	c.quit = true
+}
+
+// command is a registered Command with its parsed argument spec
+type command struct {
+	Command
+	minArgs int
+	maxArgs int
+	rest    bool
+}
+
+// RegisterCommand adds cmd to the commands of every transport, its name and aliases must be free
+func (s *ChatServer) RegisterCommand(cmd Command) error {
+	if cmd.Handler == nil || !validCommandName(cmd.Name) {
+		return fmt.Errorf("%w: /%s", ErrInvalidCommand, cmd.Name)
+	}
+	minArgs, maxArgs, rest, err := parseArgSpec(cmd.Args)
+	if err != nil {
+		return fmt.Errorf("%w: /%s: %v", ErrInvalidCommand, cmd.Name, err)
+	}
+	registered := &command{Command: cmd, minArgs: minArgs, maxArgs: maxArgs, rest: rest}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if !validCommandName(name) {
+			return fmt.Errorf("%w: /%s", ErrInvalidCommand, name)
+		}
+		if _, exists := s.commands[strings.ToLower(name)]; exists {
+			return fmt.Errorf("%w: /%s", ErrCommandExists, name)
+		}
+	}
+	for _, name := range names {
+		s.commands[strings.ToLower(name)] = registered
+	}
+	return nil
+}
+
+// UnregisterCommand removes the command named name with its aliases
+func (s *ChatServer) UnregisterCommand(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cmd, exists := s.commands[strings.ToLower(name)]
+	if !exists {
+		return
+	}
+	for registered, other := range s.commands {
+		if other == cmd {
+			delete(s.commands, registered)
+		}
+	}
+}
+
+// Command returns the command named name, or having it as alias
+func (s *ChatServer) Command(name string) (Command, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	cmd, exists := s.commands[strings.ToLower(name)]
+	if !exists {
+		return Command{}, false
+	}
+	return cmd.Command, true
+}
+
+// Commands returns the commands role may run, sorted by name
+func (s *ChatServer) Commands(role Role) []Command {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var commands []Command
+	for name, cmd := range s.commands {
+		if name == strings.ToLower(cmd.Name) && cmd.Role <= role {
+			commands = append(commands, cmd.Command)
+		}
+	}
+	slices.SortFunc(commands, func(a, b Command) int { return strings.Compare(a.Name, b.Name) })
+	return commands
+}
+
+// SetRoles replaces the moderators and admins, the other users have RoleUser
+func (s *ChatServer) SetRoles(moderators, admins []string) {
+	roles := make(map[string]Role, len(moderators)+len(admins))
+	for _, username := range moderators {
+		roles[username] = RoleModerator
+	}
+	for _, username := range admins {
+		roles[username] = RoleAdmin
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.roles = roles
+}
+
+// Role returns the role of client, RoleUser unless its transport authenticated it
+func (s *ChatServer) Role(client *Client) Role {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.role(client)
+}
+
+// role is Role for callers already holding the mutex
+func (s *ChatServer) role(client *Client) Role {
+	if !client.authenticated {
+		return RoleUser
+	}
+	return s.roles[client.Username]
+}
+
+// HandleLine acts on a line typed by client: commands run, "//text" sends "/text" and anything else
+// is broadcast. Replies go through reply, it returns true when the client asked to leave.
+func (s *ChatServer) HandleLine(client *Client, line string, reply func(string)) (quit bool) {
+	msg := &Message{Kind: MessageBroadcast, Sender: client, From: client.Username, Text: line}
+	if strings.HasPrefix(line, "//") {
+		msg.Text = line[1:]
+	} else if strings.HasPrefix(line, "/") {
+		msg.Kind = MessageCommand
+	}
+	// the messages of muted users are dropped before the filters see them
+	if msg.Kind == MessageBroadcast && s.IsMuted(client.Username) {
+		reply("You are muted and cannot send messages.")
+		return false
+	}
+	if err := s.Inbound(msg); err != nil {
+		reply(Rejection(err))
+		return false
+	}
+
+	if msg.Kind == MessageBroadcast {
+		if err := s.Send(msg); err != nil {
+			reply("ERROR: " + err.Error())
+			return false
+		}
+		reply("ME: " + msg.Text)
+		return false
+	}
+
+	name, args, _ := strings.Cut(strings.TrimSpace(msg.Text[1:]), " ")
+	s.mutex.RLock()
+	cmd, exists := s.commands[strings.ToLower(name)]
+	s.mutex.RUnlock()
+	if !exists {
+		reply(fmt.Sprintf("ERROR: Unknown command /%s, see /help", name))
+		return false
+	}
+	if role := s.Role(client); cmd.Role > role {
+		reply(fmt.Sprintf("ERROR: /%s requires the %s role", cmd.Name, cmd.Role))
+		return false
+	}
+
+	ctx := &CommandContext{Server: s, Client: client, Reply: reply}
+	var ok bool
+	if ctx.Args, ok = cmd.split(args); !ok {
+		reply(fmt.Sprintf("ERROR: Invalid /%s format. Use %s", cmd.Name, usage(cmd.Command)))
+		return false
+	}
+	if err := cmd.Handler(ctx); err != nil {
+		reply("ERROR: " + err.Error())
+	}
+	return ctx.quit
+}
+
+// split splits args by the spec of cmd, reporting false when their number doesn't match it
+func (cmd *command) split(args string) ([]string, bool) {
+	var split []string
+	if cmd.rest {
+		for args = strings.TrimSpace(args); args != "" && len(split) < cmd.maxArgs-1; {
+			arg, remainder, _ := strings.Cut(args, " ")
+			split = append(split, arg)
+			args = strings.TrimLeftFunc(remainder, unicode.IsSpace)
+		}
+		if args != "" {
+			split = append(split, args)
+		}
+	} else {
+		split = strings.Fields(args)
+	}
+	return split, len(split) >= cmd.minArgs && len(split) <= cmd.maxArgs
+}
+
+// parseArgSpec reads an argument spec like "<username> [reason...]"
+func parseArgSpec(spec string) (minArgs, maxArgs int, rest bool, err error) {
+	fields := strings.Fields(spec)
+	for i, field := range fields {
+		optional := strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]")
+		if !optional && !(strings.HasPrefix(field, "<") && strings.HasSuffix(field, ">")) {
+			return 0, 0, false, fmt.Errorf("argument %q is neither <required> nor [optional]", field)
+		}
+		if strings.HasSuffix(field[:len(field)-1], "...") {
+			if i != len(fields)-1 {
+				return 0, 0, false, fmt.Errorf("only the last argument can take the rest of the line, not %q", field)
+			}
+			rest = true
+		}
+		if !optional {
+			if minArgs != i {
+				return 0, 0, false, fmt.Errorf("required argument %q follows an optional one", field)
+			}
+			minArgs++
+		}
+	}
+	return minArgs, len(fields), rest, nil
+}
+
+func validCommandName(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || r == '/'
+	})
+}
+
+// usage is how cmd is typed, e.g. "/pm <username> <message...>"
+func usage(cmd Command) string {
+	return strings.TrimSpace("/" + cmd.Name + " " + cmd.Args)
+}
+
+// registerBuiltinCommands adds the commands every server has
+func (s *ChatServer) registerBuiltinCommands() {
+	for _, cmd := range []Command{
+		{Name: "help", Args: "[command]", Help: "List the commands you can use, or explain one", Handler: helpCommand},
+		{Name: "users", Aliases: []string{"who"}, Help: "List the online users", Handler: func(ctx *CommandContext) error {
+			ctx.Reply("Online users: " + strings.Join(ctx.Server.Usernames(), ", "))
+			return nil
+		}},
+		{Name: "pm", Aliases: []string{"msg"}, Args: "<username> <message...>", Help: "Send a private message, to user@server for a federated user", Handler: pmCommand},
+		{Name: "topic", Args: "[topic...]", Help: "Show the topic, or change it", Handler: topicCommand},
+		{Name: "quit", Aliases: []string{"exit"}, Help: "Leave the chat", Handler: func(ctx *CommandContext) error {
+			ctx.Reply("You have left the chat.")
+			ctx.Quit()
+			return nil
+		}},
+		{Name: "kick", Args: "<username> [reason...]", Role: RoleModerator, Help: "Disconnect a user", Handler: func(ctx *CommandContext) error {
+			if err := ctx.Server.Kick(ctx.Arg(0), cmp.Or(ctx.Arg(1), "kicked by "+ctx.Client.Username)); err != nil {
+				return err
+			}
+			ctx.Reply(ctx.Arg(0) + " was kicked")
+			return nil
+		}},
+		{Name: "mute", Args: "<username> [minutes]", Role: RoleModerator, Help: "Stop a user from sending messages, for good without minutes", Handler: muteCommand},
+		{Name: "unmute", Args: "<username>", Role: RoleModerator, Help: "Let a muted user send messages again", Handler: func(ctx *CommandContext) error {
+			if err := ctx.Server.Unmute(ctx.Arg(0)); err != nil {
+				return err
+			}
+			ctx.Reply(ctx.Arg(0) + " is no longer muted")
+			return nil
+		}},
+		{Name: "ban", Args: "<username>", Role: RoleAdmin, Help: "Disconnect a user and refuse their connections", Handler: func(ctx *CommandContext) error {
+			ctx.Server.Ban(ctx.Arg(0))
+			ctx.Reply(ctx.Arg(0) + " is banned")
+			return nil
+		}},
+		{Name: "unban", Args: "<username>", Role: RoleAdmin, Help: "Lift a ban", Handler: func(ctx *CommandContext) error {
+			if err := ctx.Server.Unban(ctx.Arg(0)); err != nil {
+				return err
+			}
+			ctx.Reply(ctx.Arg(0) + " is no longer banned")
+			return nil
+		}},
+		{Name: "announce", Args: "<message...>", Role: RoleAdmin, Help: "Send a system message to everyone", Handler: func(ctx *CommandContext) error {
+			ctx.Server.Announce(ctx.Arg(0))
+			return nil
+		}},
+	} {
+		if err := s.RegisterCommand(cmd); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func helpCommand(ctx *CommandContext) error {
+	role := ctx.Server.Role(ctx.Client)
+	commands := ctx.Server.Commands(role)
+
+	if name := strings.TrimPrefix(ctx.Arg(0), "/"); name != "" {
+		i := slices.IndexFunc(commands, func(cmd Command) bool {
+			return strings.EqualFold(cmd.Name, name) || slices.ContainsFunc(cmd.Aliases, func(alias string) bool { return strings.EqualFold(alias, name) })
+		})
+		if i < 0 {
+			return fmt.Errorf("no command /%s, see /help", name)
+		}
+		cmd := commands[i]
+		ctx.Reply(fmt.Sprintf("%s: %s", usage(cmd), cmd.Help))
+		if len(cmd.Aliases) > 0 {
+			ctx.Reply("Aliases: /" + strings.Join(cmd.Aliases, ", /"))
+		}
+		return nil
+	}
+
+	ctx.Reply(fmt.Sprintf("Commands (%s):", role))
+	for _, cmd := range commands {
+		ctx.Reply(fmt.Sprintf("  %s - %s", usage(cmd), cmd.Help))
+	}
+	ctx.Reply("Anything else is sent to everyone, start it with // to send a line starting with /")
+	return nil
+}
+
+func pmCommand(ctx *CommandContext) error {
+	if ctx.Server.IsMuted(ctx.Client.Username) {
+		ctx.Reply("You are muted and cannot send messages.")
+		return nil
+	}
+	msg := &Message{
+		Kind:    MessagePrivate,
+		Sender:  ctx.Client,
+		From:    ctx.Client.Username,
+		To:      ctx.Arg(0),
+		Text:    ctx.Arg(1),
+		Command: "pm",
+	}
+	if err := ctx.Server.Inbound(msg); err != nil {
+		ctx.Reply(Rejection(err))
+		return nil
+	}
+	if err := ctx.Server.Send(msg); err != nil {
+		ctx.Reply("ERROR: Invalid private message " + err.Error())
+		return nil
+	}
+	ctx.Reply("ME: " + msg.Text)
+	return nil
+}
+
+func topicCommand(ctx *CommandContext) error {
+	if len(ctx.Args) == 0 {
+		if topic := ctx.Server.Topic(); topic != "" {
+			ctx.Reply("Topic: " + topic)
+		} else {
+			ctx.Reply("No topic is set")
+		}
+		return nil
+	}
+	if ctx.Server.IsMuted(ctx.Client.Username) {
+		ctx.Reply("You are muted and cannot send messages.")
+		return nil
+	}
+	// the topic is shown to everyone, it goes through the filters of a broadcast
+	msg := &Message{
+		Kind:    MessageBroadcast,
+		Sender:  ctx.Client,
+		From:    ctx.Client.Username,
+		Text:    ctx.Arg(0),
+		Command: "topic",
+	}
+	if err := ctx.Server.Inbound(msg); err != nil {
+		ctx.Reply(Rejection(err))
+		return nil
+	}
+	ctx.Server.SetTopic(ctx.Client.Username, msg.Text)
+	return nil
+}
+
+func muteCommand(ctx *CommandContext) error {
+	var duration time.Duration
+	if minutes := ctx.Arg(1); minutes != "" {
+		n, err := strconv.Atoi(minutes)
+		if err != nil || n <= 0 {
+			return errors.New("minutes must be a positive number")
+		}
+		duration = time.Duration(n) * time.Minute
+	}
+	ctx.Server.Mute(ctx.Arg(0), duration)
+	ctx.Reply(ctx.Arg(0) + " is muted")
+	return nil
+}
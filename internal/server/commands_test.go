@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRolesNeedAuthentication(t *testing.T) {
+	s := NewChatServer()
+	s.SetRoles([]string{"mod"}, []string{"root"})
+
+	for _, username := range []string{"mod", "root"} {
+		if _, err := s.Connect(username, ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 5}); !errors.Is(err, ErrNotAuthenticated) {
+			t.Fatalf("Connect %s without authentication: got %v, want ErrNotAuthenticated", username, err)
+		}
+	}
+
+	root, err := s.Connect("root", ConnectOptions{Transport: "ssh", MaxClients: 10, RateLimit: 5, Authenticated: true})
+	if err != nil {
+		t.Fatalf("Connect root over SSH: %v", err)
+	}
+	if role := s.Role(root); role != RoleAdmin {
+		t.Fatalf("Role of root = %v, want admin", role)
+	}
+
+	// named moderator by a reload, alice still has no key
+	alice, err := s.Connect("alice", ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 5})
+	if err != nil {
+		t.Fatalf("Connect alice: %v", err)
+	}
+	s.SetRoles([]string{"mod", "alice"}, []string{"root"})
+	if role := s.Role(alice); role != RoleUser {
+		t.Fatalf("Role of alice = %v, want user", role)
+	}
+	var replies []string
+	s.HandleLine(alice, "/kick root", func(reply string) { replies = append(replies, reply) })
+	if len(replies) != 1 || replies[0] != "ERROR: /kick requires the moderator role" {
+		t.Fatalf("/kick by alice replied %q, want the role error", replies)
+	}
+}
+
+func TestMutedSkipsInbound(t *testing.T) {
+	s := NewChatServer()
+	s.UseInbound("rateLimit", RateLimit())
+	var seen []string
+	s.UseInbound("record", func(msg *Message) error {
+		seen = append(seen, msg.Text)
+		return nil
+	})
+	alice, err := s.Connect("alice", ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 1})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	s.Mute("alice", 0)
+	var replies []string
+	reply := func(reply string) { replies = append(replies, reply) }
+	s.HandleLine(alice, "hello", reply)
+	s.HandleLine(alice, "hello again", reply)
+	if len(seen) != 0 {
+		t.Fatalf("the inbound chain saw %q from a muted user", seen)
+	}
+
+	// the only token of alice is still there
+	if err := s.Unmute("alice"); err != nil {
+		t.Fatalf("Unmute: %v", err)
+	}
+	replies = nil
+	s.HandleLine(alice, "back", reply)
+	if len(replies) != 1 || replies[0] != "ME: back" {
+		t.Fatalf("HandleLine after Unmute replied %q, want the echo", replies)
+	}
+}
@@ -8,5 +8,16 @@ var (
 	ErrClientDisconnected   = errors.New("client disconnected")
 	ErrServerFull           = errors.New("server full")
 	ErrInvalidCommand       = errors.New("invalid command")
+	ErrCommandExists        = errors.New("command already registered")
 	ErrRecipientNotFound    = errors.New("recipient not found")
+	ErrUserBanned           = errors.New("user banned")
+	ErrClientNotFound       = errors.New("client not found")
+	ErrUserNotBanned        = errors.New("user not banned")
+	ErrUserMuted            = errors.New("user muted")
+	ErrUserNotMuted         = errors.New("user not muted")
+	ErrServerDraining       = errors.New("server draining, try again later")
+	ErrBackplaneUnavailable = errors.New("chat backplane unavailable, try again later")
+	ErrMessageTooLong       = errors.New("message too long")
+	ErrRateLimited          = errors.New("rate limit exceeded")
+	ErrNotAuthenticated     = errors.New("moderators and admins must log in with their SSH key")
 )
@@ -0,0 +1,352 @@
+// Package federation peers chat servers run by different teams. Peers exchange the messages of the
+// rooms they share and private messages addressed to user@server over a gRPC service secured with
+// mTLS: a peer is identified by the name its certificate is valid for.
+package federation
+
+import (
+	"chat-server/internal/config"
+	core "chat-server/internal/server"
+	"chat-server/internal/server/network"
+	chatpb "chat-server/internal/server/network/grpc"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// deliverTimeout bounds each call to a peer
+	deliverTimeout = 5 * time.Second
+	// queueSize is the number of room messages waiting for a peer before new ones are dropped
+	queueSize = 256
+	// seenTTL is how long message ids are remembered to drop duplicates
+	seenTTL = 5 * time.Minute
+)
+
+// ErrPeerUnavailable is returned when a private message can't be handed to the recipient's server
+var ErrPeerUnavailable = errors.New("federated server unavailable, try again later")
+
+// Federation relays messages between the chat server and its peers. It implements the
+// FederationService peers call and core.Relay for the messages of local users.
+type Federation struct {
+	core  *core.ChatServer
+	store *config.Store
+	name  string
+	peers map[string]*remote
+
+	seenMutex sync.Mutex
+	seen      map[string]time.Time
+
+	chatpb.UnimplementedFederationServiceServer
+}
+
+// remote is a peer with its connection, outbound queue and inbound rate limit
+type remote struct {
+	cfg     config.PeerConfig
+	client  chatpb.FederationServiceClient
+	queue   chan *chatpb.FederatedMessage
+	limiter *core.TokenBucket
+}
+
+// New creates the federation of a chat server
+func New(coreServer *core.ChatServer, store *config.Store) *Federation {
+	return &Federation{
+		core:  coreServer,
+		store: store,
+		peers: make(map[string]*remote),
+		seen:  make(map[string]time.Time),
+	}
+}
+
+// Serve accepts peers on federation.port, connects to the configured peers and starts relaying
+// the messages of local users
+func (f *Federation) Serve(cfg *config.Config) error {
+	fc := cfg.Federation
+	f.name = fc.Name
+	tlsCfg := config.TLSConfig{CertFile: fc.CertFile, KeyFile: fc.KeyFile, MinVersion: cfg.TLS.MinVersion}
+
+	for _, peerCfg := range fc.Peers {
+		creds, err := network.NewPeerTLSCredentials(tlsCfg, fc.CAFile, peerCfg.Name)
+		if err != nil {
+			return err
+		}
+		conn, err := grpc.NewClient(peerCfg.Address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return fmt.Errorf("failed to set up peer %s: %w", peerCfg.Name, err)
+		}
+		rateLimit := peerCfg.RateLimit
+		if rateLimit == 0 {
+			rateLimit = fc.RateLimit
+		}
+		f.peers[peerCfg.Name] = &remote{
+			cfg:     peerCfg,
+			client:  chatpb.NewFederationServiceClient(conn),
+			queue:   make(chan *chatpb.FederatedMessage, queueSize),
+			limiter: core.NewTokenBucket(rateLimit, time.Second/time.Duration(rateLimit)),
+		}
+	}
+
+	creds, err := network.NewMutualTLSCredentials(tlsCfg, fc.CAFile)
+	if err != nil {
+		return err
+	}
+	listener, err := network.Listen(network.ListenerFederation, cfg.Server.Host, fc.Port)
+	if err != nil {
+		return err
+	}
+	grpcSrv := grpc.NewServer(grpc.Creds(creds))
+	chatpb.RegisterFederationServiceServer(grpcSrv, f)
+	log.Printf("Federation %s listening on %s with %d peers\n", f.name, listener.Addr(), len(f.peers))
+	go func() {
+		log.Printf("Federation listener stopped: %v\n", grpcSrv.Serve(listener))
+	}()
+
+	for _, p := range f.peers {
+		go f.send(p)
+	}
+	go f.expireSeen()
+	f.core.SetRelay(f)
+	return nil
+}
+
+// ----------OUTBOUND---------
+
+// RelayBroadcast sends a message of a local user to the peers sharing the lobby
+func (f *Federation) RelayBroadcast(from, text string) {
+	msg := &chatpb.FederatedMessage{
+		Id:     newID(),
+		Origin: f.name,
+		From:   from,
+		Room:   core.Lobby,
+		Text:   text,
+	}
+	f.markSeen(msg.Id)
+	f.forward(msg, "")
+}
+
+// IsRemote reports whether recipient is user@server with server one of the peers
+func (f *Federation) IsRemote(recipient string) bool {
+	_, server, ok := splitAddress(recipient)
+	_, known := f.peers[server]
+	return ok && known
+}
+
+// RelayPrivate hands a private message to the peer the recipient is a user of
+func (f *Federation) RelayPrivate(ctx context.Context, from, recipient, text string) error {
+	username, server, _ := splitAddress(recipient)
+	p, ok := f.peers[server]
+	if !ok {
+		return core.ErrRecipientNotFound
+	}
+
+	_, err := p.client.Deliver(ctx, &chatpb.FederatedMessage{
+		Id:     newID(),
+		Origin: f.name,
+		From:   from,
+		To:     username,
+		Text:   text,
+		Path:   []string{f.name},
+	})
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.NotFound:
+		return core.ErrRecipientNotFound
+	default:
+		log.Printf("Error sending private message to %s: %v\n", recipient, err)
+		return ErrPeerUnavailable
+	}
+}
+
+// forward queues a room message for every peer sharing the room that it didn't go through yet,
+// except the one it came from. This server is added to its path.
+func (f *Federation) forward(msg *chatpb.FederatedMessage, from string) {
+	path := append(slices.Clone(msg.Path), f.name)
+	for name, p := range f.peers {
+		if name == from || !slices.Contains(p.cfg.Rooms, msg.Room) || slices.Contains(path, name) {
+			continue
+		}
+		out := &chatpb.FederatedMessage{
+			Id:     msg.Id,
+			Origin: msg.Origin,
+			From:   msg.From,
+			Room:   msg.Room,
+			Text:   msg.Text,
+			Path:   path,
+		}
+		select {
+		case p.queue <- out:
+		default:
+			log.Printf("Dropping message for peer %s: queue full\n", name)
+		}
+	}
+}
+
+// send delivers the queued room messages to p one at a time, messages p doesn't take are dropped
+func (f *Federation) send(p *remote) {
+	for msg := range p.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), deliverTimeout)
+		_, err := p.client.Deliver(ctx, msg)
+		cancel()
+		if err != nil {
+			log.Printf("Error relaying message to peer %s: %v\n", p.cfg.Name, err)
+		}
+	}
+}
+
+// ----------INBOUND---------
+
+// Deliver implements FederationService: it takes a message from an authenticated peer, shows it
+// to the local users and relays room messages further
+func (f *Federation) Deliver(ctx context.Context, msg *chatpb.FederatedMessage) (*chatpb.DeliverResponse, error) {
+	p, err := f.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !p.limiter.Allow() {
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit of peer %s exceeded", p.cfg.Name)
+	}
+	if err := f.validate(p, msg); err != nil {
+		return nil, err
+	}
+
+	// a message that went round a loop, or reached this server twice through different peers
+	if slices.Contains(msg.Path, f.name) || !f.markSeen(msg.Id) {
+		return &chatpb.DeliverResponse{}, nil
+	}
+	if len(msg.Path) > f.store.Get().Federation.MaxHops {
+		log.Printf("Dropping message from %s: more than %d hops\n", msg.Origin, f.store.Get().Federation.MaxHops)
+		return &chatpb.DeliverResponse{}, nil
+	}
+
+	from := msg.From + "@" + msg.Origin
+	if msg.Room == "" {
+		switch err := f.core.DeliverRemotePrivate(from, msg.To, msg.Text); {
+		case errors.Is(err, core.ErrRecipientNotFound):
+			return nil, status.Errorf(codes.NotFound, "user %s not found on %s", msg.To, f.name)
+		case err != nil:
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return &chatpb.DeliverResponse{}, nil
+	}
+
+	f.core.DeliverRemote(from, msg.Text)
+	f.forward(msg, p.cfg.Name)
+	return &chatpb.DeliverResponse{}, nil
+}
+
+// authenticate returns the peer the client certificate of the caller is valid for
+func (f *Federation) authenticate(ctx context.Context) (*remote, error) {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "no peer information")
+	}
+	tlsInfo, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "client certificate required")
+	}
+
+	cert := tlsInfo.State.PeerCertificates[0]
+	for name, p := range f.peers {
+		if cert.VerifyHostname(name) == nil {
+			return p, nil
+		}
+	}
+	log.Printf("Rejected federation call from %s: certificate %q matches no peer\n", pr.Addr, cert.Subject.CommonName)
+	return nil, status.Error(codes.PermissionDenied, "not a peer of this server")
+}
+
+// validate checks msg is well formed, came from p and may be delivered here
+func (f *Federation) validate(p *remote, msg *chatpb.FederatedMessage) error {
+	switch {
+	case msg.Id == "" || msg.From == "" || msg.Text == "":
+		return status.Error(codes.InvalidArgument, "id, from and text are required")
+	case len(msg.Path) == 0 || msg.Path[0] != msg.Origin || msg.Path[len(msg.Path)-1] != p.cfg.Name:
+		return status.Error(codes.InvalidArgument, "path must start at the origin and end with the sending peer")
+	case strings.ContainsAny(msg.From, "@ ") || strings.ContainsAny(msg.Origin, "@ ") || hasControl(msg.From) || hasControl(msg.Origin):
+		return status.Error(codes.InvalidArgument, "invalid sender")
+	case strings.ContainsAny(msg.To, "@ ") || hasControl(msg.To):
+		return status.Error(codes.InvalidArgument, "invalid recipient")
+	case !utf8.ValidString(msg.Text) || hasControl(msg.Text):
+		return status.Error(codes.InvalidArgument, "text must be a single line of valid UTF-8")
+	case len(msg.Text) > f.store.Get().Message.MaxLength:
+		return status.Errorf(codes.InvalidArgument, "message too long (max %d chars)", f.store.Get().Message.MaxLength)
+	}
+
+	if msg.Room == "" {
+		if msg.To == "" || len(msg.Path) != 1 {
+			return status.Error(codes.InvalidArgument, "private messages go to a user of the receiving server")
+		}
+		return nil
+	}
+	if !slices.Contains(p.cfg.Rooms, msg.Room) {
+		return status.Errorf(codes.PermissionDenied, "room %s is not shared with %s", msg.Room, p.cfg.Name)
+	}
+	return nil
+}
+
+// hasControl reports whether s has newlines or other control characters, which would let a peer
+// forge lines of the chat
+func hasControl(s string) bool {
+	return strings.ContainsFunc(s, unicode.IsControl)
+}
+
+// ----------LOOP PREVENTION---------
+
+// markSeen records id, it returns false when id was already seen
+func (f *Federation) markSeen(id string) bool {
+	f.seenMutex.Lock()
+	defer f.seenMutex.Unlock()
+
+	if _, seen := f.seen[id]; seen {
+		return false
+	}
+	f.seen[id] = time.Now()
+	return true
+}
+
+// expireSeen forgets the ids older than seenTTL
+func (f *Federation) expireSeen() {
+	ticker := time.NewTicker(seenTTL / 5)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-seenTTL)
+		f.seenMutex.Lock()
+		for id, at := range f.seen {
+			if at.Before(cutoff) {
+				delete(f.seen, id)
+			}
+		}
+		f.seenMutex.Unlock()
+	}
+}
+
+// splitAddress splits user@server at the last @
+func splitAddress(address string) (username, server string, ok bool) {
+	i := strings.LastIndex(address, "@")
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+	return address[:i], address[i+1:], true
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
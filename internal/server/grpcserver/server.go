@@ -2,26 +2,62 @@ package grpcserver
 
 import (
 	"context"
-	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"chat-server/internal/config"
 	core "chat-server/internal/server"
+	"chat-server/internal/metrics"
+	"chat-server/internal/server/network"
 	chatpb "chat-server/internal/server/network/grpc"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 )
 
 // ChatGRPCServer implements the generated gRPC service and bridges to the core ChatServer
 type ChatGRPCServer struct {
 	core *core.ChatServer
-	cfg  *config.Config
+	cfg  *config.Store
 	chatpb.UnimplementedChatServiceServer
+
+	// senders rate limit SendMessage per user, like the clients of Chat
+	sendersMutex sync.Mutex
+	senders      map[string]*sender
+}
+
+// sender is the client SendMessage sends the messages of a user as
+type sender struct {
+	client   *core.Client
+	lastSeen time.Time
 }
 
-func New(coreServer *core.ChatServer, cfg *config.Config) *ChatGRPCServer {
-	return &ChatGRPCServer{core: coreServer, cfg: cfg}
+func New(coreServer *core.ChatServer, cfg *config.Store) *ChatGRPCServer {
+	return &ChatGRPCServer{core: coreServer, cfg: cfg, senders: make(map[string]*sender)}
+}
+
+// sender returns the client of user for SendMessage, the ones idle for a minute are forgotten
+func (s *ChatGRPCServer) sender(user string) *core.Client {
+	s.sendersMutex.Lock()
+	defer s.sendersMutex.Unlock()
+
+	now := time.Now()
+	if len(s.senders) >= 1024 {
+		for name, idle := range s.senders {
+			if now.Sub(idle.lastSeen) > time.Minute {
+				delete(s.senders, name)
+			}
+		}
+	}
+	last, ok := s.senders[user]
+	if !ok {
+		last = &sender{client: core.NewSender(user, network.TransportGRPC, s.cfg.Get().RateLimit.MessagePerSecond)}
+		s.senders[user] = last
+	}
+	last.lastSeen = now
+	return last.client
 }
 
 func (s *ChatGRPCServer) SendMessage(ctx context.Context, req *chatpb.ChatMessage) (*chatpb.ChatResponse, error) {
@@ -30,14 +66,18 @@ func (s *ChatGRPCServer) SendMessage(ctx context.Context, req *chatpb.ChatMessag
 	}
 	user := req.GetUser()
 	text := req.GetText()
+	if s.core.IsMuted(user) {
+		return &chatpb.ChatResponse{Status: core.ErrUserMuted.Error()}, nil
+	}
 
-	if len(text) > s.cfg.Message.MaxLength {
-		return &chatpb.ChatResponse{Status: fmt.Sprintf("message too long (max %d chars)", s.cfg.Message.MaxLength)}, nil
+	msg := &core.Message{Kind: core.MessageBroadcast, Sender: s.sender(user), From: user, Text: text}
+	if err := s.core.Inbound(msg); err != nil {
+		return &chatpb.ChatResponse{Status: err.Error()}, nil
 	}
 
-	// Create a lightweight sender representation to reuse Broadcast formatting
-	sender := &core.Client{Username: user, Message: make(chan string, 1)}
-	s.core.Broadcast(sender, text)
+	if err := s.core.Send(msg); err != nil {
+		return &chatpb.ChatResponse{Status: err.Error()}, nil
+	}
 
 	return &chatpb.ChatResponse{Status: "ok"}, nil
 }
@@ -59,9 +99,10 @@ func (s *ChatGRPCServer) Chat(stream grpc.BidiStreamingServer[chatpb.ClientEvent
 		return nil
 	}
 	username := join.GetUsername()
+	cfg := s.cfg.Get()
 
 	// Password if required
-	if s.cfg.Security.RequirePassword {
+	if cfg.Security.RequirePassword {
 		if strings.TrimSpace(join.GetPassword()) == "" {
 			if err := stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Prompt{Prompt: &chatpb.Prompt{Text: "Enter password: "}}}); err != nil {
 				return err
@@ -76,84 +117,110 @@ func (s *ChatGRPCServer) Chat(stream grpc.BidiStreamingServer[chatpb.ClientEvent
 				join = &chatpb.Join{Username: username, Password: t.GetMessage()}
 			}
 		}
-		if join.GetPassword() != s.cfg.Security.Password {
+		if join.GetPassword() != cfg.Security.Password.Value() {
+			metrics.AuthFailures.WithLabelValues(network.TransportGRPC).Inc()
 			_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Notice{Notice: &chatpb.Notice{Text: "Passwords do not match"}}})
 			return nil
 		}
 	}
 
-	// Connect client
-	client, err := s.core.Connect(username, s.cfg.Server.MaxClients, s.cfg.RateLimit.MessagePerSecond)
+	// Connect client, kicking it stops the read loop below
+	kicked := make(chan struct{})
+	var kickOnce sync.Once
+	client, err := s.core.Connect(username, core.ConnectOptions{
+		Transport:  network.TransportGRPC,
+		RemoteAddr: remoteAddr(stream.Context()),
+		MaxClients: cfg.Server.MaxClients,
+		RateLimit:  cfg.RateLimit.MessagePerSecond,
+		Close: func() error {
+			kickOnce.Do(func() { close(kicked) })
+			return nil
+		},
+	})
 	if err != nil {
 		_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Notice{Notice: &chatpb.Notice{Text: err.Error()}}})
 		return nil
 	}
 	defer func() {
-		s.core.Broadcast(client, fmt.Sprintf("%s has left the chat", username))
+		s.core.Leave(client)
 		s.core.Disconnect(client)
 	}()
 
 	// Welcome and join notice
 	_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Notice{Notice: &chatpb.Notice{Text: username + ", Welcome to the Anophel Chat service"}}})
-	s.core.Broadcast(client, "has joined the chat")
+	s.core.Join(client)
 
 	// Forward outbound messages to the stream
+	go client.Write(func(msg string) {
+		if strings.HasPrefix(msg, "ME: ") {
+			_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Echo{Echo: &chatpb.Echo{Text: strings.TrimPrefix(msg, "ME: ")}}})
+			return
+		}
+		// Try to extract [from]: text
+		from := ""
+		text := msg
+		re := regexp.MustCompile(`^\[(.+?)\]:\s*(.*)$`)
+		if m := re.FindStringSubmatch(msg); len(m) == 3 {
+			from = m[1]
+			text = m[2]
+		}
+		_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Chat{Chat: &chatpb.Chat{From: from, Text: text}}})
+	})
+
+	// Receive client events in the background so a kick can end the stream while Recv blocks
+	done := make(chan struct{})
+	defer close(done)
+	events := make(chan *chatpb.ClientEvent)
 	go func() {
-		for msg := range client.Message {
-			if strings.HasPrefix(msg, "ME: ") {
-				_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Echo{Echo: &chatpb.Echo{Text: strings.TrimPrefix(msg, "ME: ")}}})
-				continue
+		defer close(events)
+		for {
+			evt, err := stream.Recv()
+			if err != nil {
+				return
 			}
-			// Try to extract [from]: text
-			from := ""
-			text := msg
-			re := regexp.MustCompile(`^\[(.+?)\]:\s*(.*)$`)
-			if m := re.FindStringSubmatch(msg); len(m) == 3 {
-				from = m[1]
-				text = m[2]
+			select {
+			case events <- evt:
+			case <-done:
+				return
 			}
-			_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Chat{Chat: &chatpb.Chat{From: from, Text: text}}})
 		}
 	}()
 
 	// Read incoming client events
 	for {
-		evt, err := stream.Recv()
-		if err != nil {
+		var evt *chatpb.ClientEvent
+		select {
+		case <-kicked:
 			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			evt = e
 		}
 		if t := evt.GetText(); t != nil {
 			message := t.GetMessage()
 
-			if len(message) > s.cfg.Message.MaxLength {
-				_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Notice{Notice: &chatpb.Notice{Text: fmt.Sprintf("❌ message too long (max: %d chars)", s.cfg.Message.MaxLength)}}})
-				continue
-			}
-			// Rate limiting: reuse client.limiter if available via Send path
-			// Fallback: rely on core handler policy
-
-			// Commands
-			if strings.TrimSpace(message) == "/quit" {
-				_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Notice{Notice: &chatpb.Notice{Text: "You have left the chat."}}})
-				return nil
-			}
-
-			if strings.HasPrefix(message, "/pm") {
-				parts := strings.SplitN(message, " ", 3)
-				if len(parts) < 3 {
-					_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Notice{Notice: &chatpb.Notice{Text: "ERROR: Invalid private message format. Use /pm <username> <message>"}}})
-					continue
+			// Commands and messages go through the inbound chain, echoes are Echo events and the
+			// other replies notices
+			quit := s.core.HandleLine(client, message, func(text string) {
+				if echo, ok := strings.CutPrefix(text, "ME: "); ok {
+					_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Echo{Echo: &chatpb.Echo{Text: echo}}})
+					return
 				}
-				recipient, pm := parts[1], parts[2]
-				if err := s.core.PrivateMessage(client, recipient, pm); err != nil {
-					_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Notice{Notice: &chatpb.Notice{Text: "ERROR: Invalid private message " + err.Error()}}})
-				} else {
-					_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Echo{Echo: &chatpb.Echo{Text: pm}}})
-				}
-			} else {
-				s.core.Broadcast(client, message)
-				_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Echo{Echo: &chatpb.Echo{Text: message}}})
+				_ = stream.Send(&chatpb.ServerEvent{Payload: &chatpb.ServerEvent_Notice{Notice: &chatpb.Notice{Text: text}}})
+			})
+			if quit {
+				return nil
 			}
 		}
 	}
 }
+
+// remoteAddr returns the address of the peer, the client's when a trusted proxy sent a PROXY header
+func remoteAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
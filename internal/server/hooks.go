@@ -0,0 +1,86 @@
+package server
+
+import (
+	"strings"
+	"time"
+)
+
+// Lobby is the room of the chat, the only one there is
+const Lobby = "lobby"
+
+// Kinds of activity reported to hooks
+const (
+	ActivityMessage = "message"
+	ActivityJoin    = "join"
+	ActivityLeave   = "leave"
+)
+
+// Texts of the join and leave announcements, the leave text follows the username
+const (
+	joinedText = "has joined the chat"
+	leftText   = " has left the chat"
+)
+
+// Activity is something a user did in the chat
+type Activity struct {
+	Kind string
+	Room string
+	// Username is the user, as user@server for the users of federated servers
+	Username string
+	Text     string
+	Time     time.Time
+}
+
+// AddHook registers hook to be told about the joins, leaves and messages of the users of this
+// replica and of the messages received from federated servers. Hooks are called synchronously
+// with the sender, they must hand slow work to another goroutine.
+func (s *ChatServer) AddHook(hook func(Activity)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.hooks = append(s.hooks, hook)
+}
+
+func (s *ChatServer) notify(kind, username, text string) {
+	s.mutex.RLock()
+	hooks := s.hooks
+	s.mutex.RUnlock()
+
+	activity := Activity{Kind: kind, Room: Lobby, Username: username, Text: text, Time: time.Now()}
+	for _, hook := range hooks {
+		hook(activity)
+	}
+}
+
+// Join tells everyone that client joined the chat
+func (s *ChatServer) Join(client *Client) {
+	s.publish(Event{Kind: EventBroadcast, From: client.Username, Text: joinedText})
+	if relay := s.getRelay(); relay != nil {
+		relay.RelayBroadcast(client.Username, joinedText)
+	}
+	s.notify(ActivityJoin, client.Username, "")
+}
+
+// Leave tells everyone that client left the chat, before it is disconnected
+func (s *ChatServer) Leave(client *Client) {
+	text := client.Username + leftText
+	s.publish(Event{Kind: EventBroadcast, From: client.Username, Text: text})
+	if relay := s.getRelay(); relay != nil {
+		relay.RelayBroadcast(client.Username, text)
+	}
+	s.notify(ActivityLeave, client.Username, "")
+}
+
+// remoteActivity tells the announcements of federated users, whose joins and leaves arrive as
+// messages, from what they say
+func remoteActivity(from, text string) string {
+	username, _, _ := strings.Cut(from, "@")
+	switch text {
+	case joinedText:
+		return ActivityJoin
+	case username + leftText:
+		return ActivityLeave
+	default:
+		return ActivityMessage
+	}
+}
@@ -0,0 +1,500 @@
+// Package irc is a gateway letting IRC clients (irssi, weechat, ...) join the chat. The chat is
+// the #lobby channel, private messages map to PRIVMSG between nicknames.
+package irc
+
+import (
+	"chat-server/internal/config"
+	"chat-server/internal/metrics"
+	core "chat-server/internal/server"
+	"chat-server/internal/server/network"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lobby is the channel mapped onto the chat, the only one there is
+const lobby = "#lobby"
+
+// Gateway accepts IRC connections and connects them to the chat server
+type Gateway struct {
+	core      *core.ChatServer
+	store     *config.Store
+	name      string
+	startedAt time.Time
+}
+
+// New creates an IRC gateway for core
+func New(core *core.ChatServer, store *config.Store) *Gateway {
+	return &Gateway{
+		core:      core,
+		store:     store,
+		name:      store.Get().IRC.ServerName,
+		startedAt: time.Now(),
+	}
+}
+
+// Serve listens on server.host:irc.port (or the "irc" socket passed by systemd), with TLS when irc.tls is set, and handles connections in the background
+func (g *Gateway) Serve(cfg *config.Config) error {
+	listener, err := network.Listen(network.ListenerIRC, cfg.Server.Host, cfg.IRC.Port)
+	if err != nil {
+		return err
+	}
+	if cfg.IRC.TLS {
+		if listener, err = network.NewTLS(listener, cfg.TLS); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("IRC gateway listening on %s (TLS: %v)\n", listener.Addr(), cfg.IRC.TLS)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("Error accepting IRC connection: %v\n", err)
+				continue
+			}
+			go g.handle(conn)
+		}
+	}()
+	return nil
+}
+
+// session is one IRC connection, registered once NICK and USER were received
+type session struct {
+	gateway    *Gateway
+	conn       *network.TCPConnection
+	writeMutex sync.Mutex
+	host       string
+	pass       string
+	nick       string
+	user       string
+	client     *core.Client
+	inLobby    atomic.Bool
+}
+
+func (g *Gateway) handle(netConn net.Conn) {
+	conn := network.NewTCPConnection(netConn)
+	conn.SetReadLimit(network.ReadLimit(g.store.Get().Message.MaxLength))
+
+	host, _, err := net.SplitHostPort(netConn.RemoteAddr().String())
+	if err != nil {
+		host = netConn.RemoteAddr().String()
+	}
+	s := &session{gateway: g, conn: conn, host: host}
+	defer s.close()
+
+	for {
+		line, err := conn.ReadLine()
+		if network.IsProtocolError(err) {
+			s.numeric(errInputTooLong, fmt.Sprintf("Input line rejected: %v", err))
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		msg, ok := parseMessage(line)
+		if !ok {
+			continue
+		}
+		if !s.handle(msg) {
+			return
+		}
+	}
+}
+
+// close leaves the chat if the session registered and closes the connection
+func (s *session) close() {
+	if s.client != nil {
+		s.gateway.core.Leave(s.client)
+		s.gateway.core.Disconnect(s.client)
+	}
+	_ = s.conn.Close()
+}
+
+// handle runs one command, it returns false when the connection must be closed
+func (s *session) handle(msg message) bool {
+	switch msg.command {
+	case "CAP":
+		// no capabilities, clients negotiating them carry on with plain IRC
+		switch strings.ToUpper(msg.param(0)) {
+		case "LS", "LIST":
+			s.send(s.gateway.name, "CAP", s.target(), strings.ToUpper(msg.param(0)), "")
+		case "REQ":
+			s.send(s.gateway.name, "CAP", s.target(), "NAK", msg.param(1))
+		}
+		return true
+
+	case "PASS":
+		if s.client != nil {
+			s.numeric(errAlreadyRegistred, "You may not reregister")
+			return true
+		}
+		if len(msg.params) == 0 {
+			s.numeric(errNeedMoreParams, "PASS", "Not enough parameters")
+			return true
+		}
+		s.pass = msg.param(0)
+		return true
+
+	case "NICK":
+		nick := msg.param(0)
+		if nick == "" {
+			s.numeric(errNoNicknameGiven, "No nickname given")
+			return true
+		}
+		if !validNick(nick) {
+			s.numeric(errErroneusNickname, nick, "Erroneous nickname")
+			return true
+		}
+		if s.client != nil {
+			if nick != s.nick {
+				s.notice("Nickname changes are not supported, reconnect with the new nickname")
+			}
+			return true
+		}
+		s.nick = nick
+		return s.register()
+
+	case "USER":
+		if s.client != nil {
+			s.numeric(errAlreadyRegistred, "You may not reregister")
+			return true
+		}
+		if len(msg.params) < 4 {
+			s.numeric(errNeedMoreParams, "USER", "Not enough parameters")
+			return true
+		}
+		s.user = msg.param(0)
+		return s.register()
+
+	case "PING":
+		s.send(s.gateway.name, "PONG", s.gateway.name, msg.param(0))
+		return true
+
+	case "PONG":
+		return true
+
+	case "QUIT":
+		s.send("", "ERROR", fmt.Sprintf("Closing link: %s (Quit)", s.host))
+		return false
+	}
+
+	if s.client == nil {
+		s.numeric(errNotRegistered, "You have not registered")
+		return true
+	}
+
+	switch msg.command {
+	case "JOIN":
+		s.join(msg)
+	case "PART":
+		s.part(msg)
+	case "PRIVMSG":
+		s.privmsg(msg, false)
+	case "NOTICE":
+		s.privmsg(msg, true)
+	case "NAMES":
+		if channel := msg.param(0); channel == "" || strings.EqualFold(channel, lobby) {
+			s.names()
+		} else {
+			s.numeric(rplEndOfNames, channel, "End of /NAMES list")
+		}
+	case "WHO":
+		s.who(msg.param(0))
+	case "TOPIC":
+		s.topic(msg)
+	case "MODE":
+		switch target := msg.param(0); {
+		case strings.EqualFold(target, lobby):
+			s.numeric(rplChannelModeIs, lobby, "+nt")
+		case target == s.nick:
+			s.numeric(rplUModeIs, "+")
+		}
+	default:
+		return s.command(msg)
+	}
+	return true
+}
+
+// register connects to the chat once both NICK and USER were received
+func (s *session) register() bool {
+	if s.nick == "" || s.user == "" {
+		return true
+	}
+
+	cfg := s.gateway.store.Get()
+	if cfg.Security.RequirePassword && s.pass != cfg.Security.Password.Value() {
+		metrics.AuthFailures.WithLabelValues(network.TransportIRC).Inc()
+		s.numeric(errPasswdMismatch, "Password incorrect")
+		return false
+	}
+
+	client, err := s.gateway.core.Connect(s.nick, core.ConnectOptions{
+		Transport:  network.TransportIRC,
+		RemoteAddr: s.conn.RemoteAddr(),
+		MaxClients: cfg.Server.MaxClients,
+		RateLimit:  cfg.RateLimit.MessagePerSecond,
+		Close:      s.conn.Close,
+	})
+	if errors.Is(err, core.ErrUsernameAlreadyTaken) {
+		s.numeric(errNicknameInUse, s.nick, "Nickname is already in use")
+		s.nick = ""
+		return true
+	}
+	if err != nil {
+		s.send("", "ERROR", fmt.Sprintf("Closing link: %s (%v)", s.host, err))
+		return false
+	}
+	s.client = client
+
+	name := s.gateway.name
+	s.numeric(rplWelcome, fmt.Sprintf("Welcome to the Anophel Chat IRC gateway %s", s.mask()))
+	s.numeric(rplYourHost, fmt.Sprintf("Your host is %s, running chat-server", name))
+	s.numeric(rplCreated, "This server was created "+s.gateway.startedAt.Format(time.RFC1123))
+	s.numeric(rplMyInfo, name, "chat-server", "i", "nt")
+	s.numeric(errNoMOTD, "MOTD File is missing")
+
+	go client.Write(s.relay)
+
+	s.gateway.core.Join(client)
+	s.joinLobby()
+	return true
+}
+
+func (s *session) joinLobby() {
+	s.inLobby.Store(true)
+	s.send(s.mask(), "JOIN", lobby)
+	if topic := s.gateway.core.Topic(); topic != "" {
+		s.numeric(rplTopic, lobby, topic)
+	}
+	s.names()
+}
+
+func (s *session) join(msg message) {
+	if len(msg.params) == 0 {
+		s.numeric(errNeedMoreParams, "JOIN", "Not enough parameters")
+		return
+	}
+	for _, channel := range strings.Split(msg.param(0), ",") {
+		switch {
+		case channel == "0":
+			// JOIN 0 leaves every channel
+			if s.inLobby.Swap(false) {
+				s.send(s.mask(), "PART", lobby)
+			}
+		case strings.EqualFold(channel, lobby):
+			if !s.inLobby.Load() {
+				s.joinLobby()
+			}
+		default:
+			s.numeric(errNoSuchChannel, channel, "No such channel, the chat is "+lobby)
+		}
+	}
+}
+
+// part leaves #lobby: the user stays connected and can still send and receive private messages
+func (s *session) part(msg message) {
+	if len(msg.params) == 0 {
+		s.numeric(errNeedMoreParams, "PART", "Not enough parameters")
+		return
+	}
+	for _, channel := range strings.Split(msg.param(0), ",") {
+		switch {
+		case !strings.EqualFold(channel, lobby):
+			s.numeric(errNoSuchChannel, channel, "No such channel")
+		case !s.inLobby.Swap(false):
+			s.numeric(errNotOnChannel, channel, "You're not on that channel")
+		case msg.param(1) != "":
+			s.send(s.mask(), "PART", lobby, msg.param(1))
+		default:
+			s.send(s.mask(), "PART", lobby)
+		}
+	}
+}
+
+// privmsg sends to #lobby or to users, NOTICE never gets error replies
+func (s *session) privmsg(msg message, notice bool) {
+	reply := func(code string, params ...string) {
+		if !notice {
+			s.numeric(code, params...)
+		}
+	}
+	if len(msg.params) == 0 {
+		reply(errNoRecipient, "No recipient given ("+msg.command+")")
+		return
+	}
+	text := msg.param(1)
+	if text == "" {
+		reply(errNoTextToSend, "No text to send")
+		return
+	}
+
+	for _, target := range strings.Split(msg.param(0), ",") {
+		msg := &core.Message{Kind: core.MessagePrivate, Sender: s.client, From: s.nick, To: target, Text: text}
+		if strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&") {
+			switch {
+			case !strings.EqualFold(target, lobby):
+				reply(errNoSuchChannel, target, "No such channel")
+				continue
+			case !s.inLobby.Load():
+				reply(errCannotSendToChan, target, "Cannot send to channel, join it first")
+				continue
+			}
+			msg.Kind, msg.To = core.MessageBroadcast, ""
+			if s.gateway.core.IsMuted(s.nick) {
+				reply(errCannotSendToChan, target, "You are muted and cannot send messages.")
+				continue
+			}
+		}
+
+		err := s.gateway.core.Inbound(msg)
+		switch {
+		case errors.Is(err, core.ErrRateLimited):
+			s.notice(core.Rejection(err))
+			return
+		case errors.Is(err, core.ErrMessageTooLong):
+			reply(errInputTooLong, err.Error())
+			return
+		case err != nil:
+			reply(errCannotSendToChan, target, "Message rejected: "+err.Error())
+			continue
+		}
+
+		err = s.gateway.core.Send(msg)
+		switch {
+		case errors.Is(err, core.ErrRecipientNotFound), errors.Is(err, core.ErrClientDisconnected):
+			reply(errNoSuchNick, target, "No such nick")
+		case errors.Is(err, core.ErrUserMuted):
+			reply(errCannotSendToChan, target, "You are muted and cannot send messages.")
+		case err != nil:
+			reply(errCannotSendToChan, target, err.Error())
+		}
+	}
+}
+
+// command runs the chat commands IRC doesn't have, clients send the /commands they don't know
+// as they are (/help pm arrives as HELP pm). Replies are notices, false ends the session.
+func (s *session) command(msg message) bool {
+	if _, exists := s.gateway.core.Command(msg.command); !exists {
+		s.numeric(errUnknownCommand, msg.command, "Unknown command")
+		return true
+	}
+
+	line := "/" + strings.ToLower(msg.command) + " " + strings.Join(msg.params, " ")
+	quit := s.gateway.core.HandleLine(s.client, line, func(text string) {
+		// IRC clients show what they send themselves
+		if !strings.HasPrefix(text, "ME: ") {
+			s.notice(text)
+		}
+	})
+	if quit {
+		s.send("", "ERROR", fmt.Sprintf("Closing link: %s (Quit)", s.host))
+	}
+	return !quit
+}
+
+func (s *session) names() {
+	// several replies keep each line under the IRC limit
+	var line []string
+	size := 0
+	for _, username := range s.gateway.core.Usernames() {
+		if size+len(username) > maxTextBytes {
+			s.numeric(rplNamReply, "=", lobby, strings.Join(line, " "))
+			line, size = nil, 0
+		}
+		line = append(line, username)
+		size += len(username) + 1
+	}
+	if len(line) > 0 {
+		s.numeric(rplNamReply, "=", lobby, strings.Join(line, " "))
+	}
+	s.numeric(rplEndOfNames, lobby, "End of /NAMES list")
+}
+
+// who lists the chat users matching mask, the host field tells which transport they use
+func (s *session) who(mask string) {
+	all := mask == "" || mask == "*" || strings.EqualFold(mask, lobby)
+	for _, info := range s.gateway.core.Clients() {
+		if !all && !strings.EqualFold(info.Username, mask) {
+			continue
+		}
+		s.numeric(rplWhoReply, lobby, info.Username, info.Transport, s.gateway.name, info.Username, "H", "0 via "+info.Transport)
+	}
+	if mask == "" {
+		mask = "*"
+	}
+	s.numeric(rplEndOfWho, mask, "End of /WHO list")
+}
+
+func (s *session) topic(msg message) {
+	channel := msg.param(0)
+	if channel == "" {
+		s.numeric(errNeedMoreParams, "TOPIC", "Not enough parameters")
+		return
+	}
+	if !strings.EqualFold(channel, lobby) {
+		s.numeric(errNoSuchChannel, channel, "No such channel")
+		return
+	}
+
+	if len(msg.params) < 2 {
+		if topic := s.gateway.core.Topic(); topic != "" {
+			s.numeric(rplTopic, lobby, topic)
+		} else {
+			s.numeric(rplNoTopic, lobby, "No topic is set")
+		}
+		return
+	}
+	if s.gateway.core.IsMuted(s.nick) {
+		s.numeric(errCannotSendToChan, lobby, "You are muted and cannot send messages.")
+		return
+	}
+	// the topic is shown to everyone, it goes through the filters of a broadcast
+	topic := &core.Message{Kind: core.MessageBroadcast, Sender: s.client, From: s.nick, Text: msg.param(1), Command: "topic"}
+	if err := s.gateway.core.Inbound(topic); errors.Is(err, core.ErrRateLimited) {
+		s.notice(core.Rejection(err))
+		return
+	} else if err != nil {
+		s.numeric(errCannotSendToChan, lobby, "Topic rejected: "+err.Error())
+		return
+	}
+	// everyone gets the change as a system message, relayed to IRC clients as TOPIC
+	s.gateway.core.SetTopic(s.nick, topic.Text)
+}
+
+// mask is the nick!user@host prefix of the session's own messages
+func (s *session) mask() string {
+	return fmt.Sprintf("%s!%s@%s", s.nick, s.user, s.host)
+}
+
+// target is the nickname replies are addressed to, * before one was accepted
+func (s *session) target() string {
+	if s.nick == "" {
+		return "*"
+	}
+	return s.nick
+}
+
+func (s *session) send(prefix, command string, params ...string) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	_ = s.conn.WriteLine(formatMessage(prefix, command, params...) + "\r")
+}
+
+func (s *session) numeric(code string, params ...string) {
+	s.send(s.gateway.name, code, append([]string{s.target()}, params...)...)
+}
+
+func (s *session) notice(text string) {
+	s.send(s.gateway.name, "NOTICE", s.target(), text)
+}
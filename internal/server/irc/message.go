@@ -0,0 +1,133 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Numeric replies used by the gateway (RFC 1459/2812)
+const (
+	rplWelcome          = "001"
+	rplYourHost         = "002"
+	rplCreated          = "003"
+	rplMyInfo           = "004"
+	rplUModeIs          = "221"
+	rplEndOfWho         = "315"
+	rplChannelModeIs    = "324"
+	rplNoTopic          = "331"
+	rplTopic            = "332"
+	rplWhoReply         = "352"
+	rplNamReply         = "353"
+	rplEndOfNames       = "366"
+	errNoSuchNick       = "401"
+	errNoSuchChannel    = "403"
+	errCannotSendToChan = "404"
+	errNoRecipient      = "411"
+	errNoTextToSend     = "412"
+	errInputTooLong     = "417"
+	errUnknownCommand   = "421"
+	errNoMOTD           = "422"
+	errNoNicknameGiven  = "431"
+	errErroneusNickname = "432"
+	errNicknameInUse    = "433"
+	errNotOnChannel     = "442"
+	errNotRegistered    = "451"
+	errNeedMoreParams   = "461"
+	errAlreadyRegistred = "462"
+	errPasswdMismatch   = "464"
+)
+
+// maxTextBytes keeps relayed lines under the 512 bytes IRC limit once the prefix and command are added
+const maxTextBytes = 400
+
+// message is one protocol line: [:prefix] COMMAND param... [:trailing]
+type message struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+// parseMessage splits a line received from a client, ok is false when it holds no command
+func parseMessage(line string) (message, bool) {
+	var msg message
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		prefix, rest, found := strings.Cut(line[1:], " ")
+		if !found {
+			return msg, false
+		}
+		msg.prefix, line = prefix, strings.TrimLeft(rest, " ")
+	}
+
+	for line != "" {
+		if msg.command != "" && strings.HasPrefix(line, ":") {
+			msg.params = append(msg.params, line[1:])
+			break
+		}
+		param, rest, _ := strings.Cut(line, " ")
+		if msg.command == "" {
+			msg.command = strings.ToUpper(param)
+		} else {
+			msg.params = append(msg.params, param)
+		}
+		line = strings.TrimLeft(rest, " ")
+	}
+	return msg, msg.command != ""
+}
+
+// param returns the i-th parameter or "" when missing
+func (m message) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+	return ""
+}
+
+// formatMessage builds a line to send, the last of several parameters is always sent as a trailing one
+func formatMessage(prefix, command string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+	for i, param := range params {
+		// newlines would end the line early
+		param = strings.NewReplacer("\r", " ", "\n", " ").Replace(param)
+		if i == len(params)-1 && (len(params) > 1 || param == "" || strings.Contains(param, " ") || strings.HasPrefix(param, ":")) {
+			b.WriteString(" :" + param)
+		} else {
+			b.WriteString(" " + param)
+		}
+	}
+	return b.String()
+}
+
+// validNick follows the RFC 2812 nickname grammar, with a more generous length
+func validNick(nick string) bool {
+	if nick == "" || len(nick) > 30 {
+		return false
+	}
+	for i, r := range nick {
+		letter := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		special := strings.ContainsRune("[]\\`_^{|}", r)
+		digitOrDash := (r >= '0' && r <= '9') || r == '-'
+		if !letter && !special && (i == 0 || !digitOrDash) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitText cuts text into chunks of at most maxTextBytes, on rune boundaries
+func splitText(text string) []string {
+	var chunks []string
+	for len(text) > maxTextBytes {
+		cut := maxTextBytes
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+	return append(chunks, text)
+}
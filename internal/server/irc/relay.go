@@ -0,0 +1,69 @@
+package irc
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	privateLine = regexp.MustCompile(`^\[Private\] (\S+) : (.*)$`)
+	chatLine    = regexp.MustCompile(`^\[(.+?)\]: ?(.*)$`)
+	topicLine   = regexp.MustCompile(`^(\S+) changed the topic to: (.*)$`)
+)
+
+// relay translates a line the chat server sent to the client into IRC messages
+func (s *session) relay(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "ME: ") {
+		// IRC clients show their own messages
+		return
+	}
+
+	if m := privateLine.FindStringSubmatch(line); m != nil {
+		for _, chunk := range splitText(m[2]) {
+			s.send(userMask(m[1]), "PRIVMSG", s.nick, chunk)
+		}
+		return
+	}
+
+	m := chatLine.FindStringSubmatch(line)
+	if m == nil {
+		// server replies such as kick reasons
+		s.notice(line)
+		return
+	}
+	from, text := m[1], m[2]
+	inLobby := s.inLobby.Load()
+
+	if from == "System" {
+		if t := topicLine.FindStringSubmatch(text); t != nil && inLobby {
+			s.send(userMask(t[1]), "TOPIC", lobby, t[2])
+			return
+		}
+		target := s.nick
+		if inLobby {
+			target = lobby
+		}
+		s.send(s.gateway.name, "NOTICE", target, text)
+		return
+	}
+
+	if !inLobby {
+		return
+	}
+	switch text {
+	case "has joined the chat":
+		s.send(userMask(from), "JOIN", lobby)
+	case from + " has left the chat":
+		s.send(userMask(from), "QUIT", "Left the chat")
+	default:
+		for _, chunk := range splitText(text) {
+			s.send(userMask(from), "PRIVMSG", lobby, chunk)
+		}
+	}
+}
+
+// userMask is the prefix of messages from other chat users, who have no IRC user or host
+func userMask(username string) string {
+	return username + "!" + username + "@chat"
+}
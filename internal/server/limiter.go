@@ -42,3 +42,13 @@ func (tb *TokenBucket) Allow() bool {
 
 	return false
 }
+
+// SetRate changes the bucket capacity and refill rate, keeping at most maxTokens available
+func (tb *TokenBucket) SetRate(maxTokens int, refillRate time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.maxTokens = maxTokens
+	tb.refillRate = refillRate
+	tb.tokens = min(tb.tokens, maxTokens)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"chat-server/internal/metrics"
+	"errors"
+)
+
+// Kinds of Message
+const (
+	MessageBroadcast = "broadcast"
+	MessagePrivate   = "private"
+	MessageCommand   = "command"
+)
+
+// Directions of the middleware chains, in logs and metrics
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// Message is a message going through the middleware chains. Inbound it is what a user of this
+// replica typed, a command line or a message; outbound a message about to reach the clients of
+// this replica, whoever sent it.
+type Message struct {
+	Kind string
+	// Sender is the client who typed an inbound message, nil outbound
+	Sender *Client
+	From   string
+	// To is the recipient of a private message
+	To   string
+	Text string
+	// Command is the command that sent an inbound message, e.g. "pm" or "topic". Its line went
+	// through the inbound chain as a MessageCommand already, except for the IRC TOPIC.
+	Command string
+	// Meta holds the annotations of the middlewares, they travel with the message to every replica
+	Meta map[string]string
+}
+
+// Annotate attaches value to m under key
+func (m *Message) Annotate(key, value string) {
+	if m.Meta == nil {
+		m.Meta = make(map[string]string)
+	}
+	m.Meta[key] = value
+}
+
+// Middleware is a stage of a chain: it may inspect msg, rewrite msg.Text, annotate msg, or reject
+// msg by returning an error. Inbound the error is shown to the sender, outbound the message is
+// dropped.
+type Middleware func(msg *Message) error
+
+type stage struct {
+	name       string
+	middleware Middleware
+}
+
+// UseInbound appends middleware, called name in logs and metrics, to the stages the lines users
+// type go through before they run or are sent
+func (s *ChatServer) UseInbound(name string, middleware Middleware) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.inbound = append(s.inbound, stage{name: name, middleware: middleware})
+}
+
+// UseOutbound appends middleware to the stages broadcasts and private messages go through before
+// they reach the clients of this replica
+func (s *ChatServer) UseOutbound(name string, middleware Middleware) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.outbound = append(s.outbound, stage{name: name, middleware: middleware})
+}
+
+// Inbound runs the inbound chain on msg, then Send delivers it
+func (s *ChatServer) Inbound(msg *Message) error {
+	s.mutex.RLock()
+	stages := s.inbound
+	s.mutex.RUnlock()
+	return runChain(DirectionInbound, stages, msg)
+}
+
+// runOutbound runs the outbound chain on msg, the caller must not hold the mutex
+func (s *ChatServer) runOutbound(msg *Message) error {
+	s.mutex.RLock()
+	stages := s.outbound
+	s.mutex.RUnlock()
+	return runChain(DirectionOutbound, stages, msg)
+}
+
+func runChain(direction string, stages []stage, msg *Message) error {
+	for _, stage := range stages {
+		if err := stage.middleware(msg); err != nil {
+			metrics.MiddlewareRejections.WithLabelValues(direction, stage.name).Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// Rejection is the line telling a user why the inbound chain rejected their message
+func Rejection(err error) string {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return "You are sending message too fast! slow down."
+	case errors.Is(err, ErrMessageTooLong):
+		return "❌ " + err.Error()
+	default:
+		return "ERROR: Message rejected: " + err.Error()
+	}
+}
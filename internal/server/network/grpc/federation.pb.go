@@ -0,0 +1,218 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        v6.32.1
+// source: federation.proto
+
+package __
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type FederatedMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`         // unique per message, a message seen twice is dropped
+	Origin        string                 `protobuf:"bytes,2,opt,name=origin,proto3" json:"origin,omitempty"` // server of the sender
+	From          string                 `protobuf:"bytes,3,opt,name=from,proto3" json:"from,omitempty"`     // username of the sender on origin
+	Room          string                 `protobuf:"bytes,4,opt,name=room,proto3" json:"room,omitempty"`     // shared room of a room message, empty for a private message
+	To            string                 `protobuf:"bytes,5,opt,name=to,proto3" json:"to,omitempty"`         // recipient of a private message, a user of the receiving server
+	Text          string                 `protobuf:"bytes,6,opt,name=text,proto3" json:"text,omitempty"`
+	Path          []string               `protobuf:"bytes,7,rep,name=path,proto3" json:"path,omitempty"` // servers the message went through, origin first and the sending peer last
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FederatedMessage) Reset() {
+	*x = FederatedMessage{}
+	mi := &file_federation_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FederatedMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FederatedMessage) ProtoMessage() {}
+
+func (x *FederatedMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_federation_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FederatedMessage.ProtoReflect.Descriptor instead.
+func (*FederatedMessage) Descriptor() ([]byte, []int) {
+	return file_federation_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *FederatedMessage) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *FederatedMessage) GetOrigin() string {
+	if x != nil {
+		return x.Origin
+	}
+	return ""
+}
+
+func (x *FederatedMessage) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *FederatedMessage) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *FederatedMessage) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+func (x *FederatedMessage) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *FederatedMessage) GetPath() []string {
+	if x != nil {
+		return x.Path
+	}
+	return nil
+}
+
+type DeliverResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeliverResponse) Reset() {
+	*x = DeliverResponse{}
+	mi := &file_federation_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeliverResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeliverResponse) ProtoMessage() {}
+
+func (x *DeliverResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_federation_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeliverResponse.ProtoReflect.Descriptor instead.
+func (*DeliverResponse) Descriptor() ([]byte, []int) {
+	return file_federation_proto_rawDescGZIP(), []int{1}
+}
+
+var File_federation_proto protoreflect.FileDescriptor
+
+const file_federation_proto_rawDesc = "" +
+	"\n" +
+	"\x10federation.proto\x12\x04chat\"\x9a\x01\n" +
+	"\x10FederatedMessage\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
+	"\x06origin\x18\x02 \x01(\tR\x06origin\x12\x12\n" +
+	"\x04from\x18\x03 \x01(\tR\x04from\x12\x12\n" +
+	"\x04room\x18\x04 \x01(\tR\x04room\x12\x0e\n" +
+	"\x02to\x18\x05 \x01(\tR\x02to\x12\x12\n" +
+	"\x04text\x18\x06 \x01(\tR\x04text\x12\x12\n" +
+	"\x04path\x18\a \x03(\tR\x04path\"\x11\n" +
+	"\x0fDeliverResponse2M\n" +
+	"\x11FederationService\x128\n" +
+	"\aDeliver\x12\x16.chat.FederatedMessage\x1a\x15.chat.DeliverResponseB\x03Z\x01/b\x06proto3"
+
+var (
+	file_federation_proto_rawDescOnce sync.Once
+	file_federation_proto_rawDescData []byte
+)
+
+func file_federation_proto_rawDescGZIP() []byte {
+	file_federation_proto_rawDescOnce.Do(func() {
+		file_federation_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_federation_proto_rawDesc), len(file_federation_proto_rawDesc)))
+	})
+	return file_federation_proto_rawDescData
+}
+
+var file_federation_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_federation_proto_goTypes = []any{
+	(*FederatedMessage)(nil), // 0: chat.FederatedMessage
+	(*DeliverResponse)(nil),  // 1: chat.DeliverResponse
+}
+var file_federation_proto_depIdxs = []int32{
+	0, // 0: chat.FederationService.Deliver:input_type -> chat.FederatedMessage
+	1, // 1: chat.FederationService.Deliver:output_type -> chat.DeliverResponse
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_federation_proto_init() }
+func file_federation_proto_init() {
+	if File_federation_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_federation_proto_rawDesc), len(file_federation_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_federation_proto_goTypes,
+		DependencyIndexes: file_federation_proto_depIdxs,
+		MessageInfos:      file_federation_proto_msgTypes,
+	}.Build()
+	File_federation_proto = out.File
+	file_federation_proto_goTypes = nil
+	file_federation_proto_depIdxs = nil
+}
@@ -0,0 +1,44 @@
+package network
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultReadLimit bounds the lines read from a TCP connection until SetReadLimit is called
+const DefaultReadLimit = 64 * 1024
+
+// readLimitSlack is added to message.maxLength for the line size limit, so slightly too long
+// messages still get the usual "message too long" answer
+const readLimitSlack = 4096
+
+// Protocol errors: the offending line was discarded but the connection is still usable
+var (
+	ErrLineTooLong = errors.New("line too long")
+	ErrInvalidUTF8 = errors.New("line is not valid UTF-8")
+)
+
+// ReadLimit is the largest line, in bytes, accepted from a client for the given message.maxLength
+func ReadLimit(maxLength int) int64 {
+	return int64(maxLength) + readLimitSlack
+}
+
+// IsProtocolError tells whether err is a malformed line the client can be told about
+func IsProtocolError(err error) bool {
+	return errors.Is(err, ErrLineTooLong) || errors.Is(err, ErrInvalidUTF8)
+}
+
+// cleanLine rejects invalid UTF-8 and strips control characters (terminal escapes, NUL, ...) except tabs
+func cleanLine(line []byte) (string, error) {
+	if !utf8.Valid(line) {
+		return "", ErrInvalidUTF8
+	}
+	return strings.Map(func(r rune) rune {
+		if r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, string(line)), nil
+}
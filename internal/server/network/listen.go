@@ -0,0 +1,347 @@
+package network
+
+import (
+	"chat-server/internal/config"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the listening sockets. Sockets passed by systemd are matched by FileDescriptorName=
+// in the .socket unit, the ones without a name are used by the chat server. An upgrade hands
+// every socket to the new process under these names.
+const (
+	ListenerChat        = "chat"
+	ListenerChatSocket  = "chat-socket"
+	ListenerIRC         = "irc"
+	ListenerSSH         = "ssh"
+	ListenerAdmin       = "admin"
+	ListenerAdminGRPC   = "admin-grpc"
+	ListenerAdminSocket = "admin-socket"
+	ListenerFederation  = "federation"
+
+	unnamedListener = "unknown"
+)
+
+// listenerNames are the names the listeners take their inherited sockets by
+var listenerNames = []string{
+	ListenerChat, ListenerChatSocket, ListenerIRC, ListenerSSH,
+	ListenerAdmin, ListenerAdminGRPC, ListenerAdminSocket, ListenerFederation,
+}
+
+// UpgradeFDNamesEnv names the sockets an upgrading process passes to its successor, from fd 3 on
+const UpgradeFDNamesEnv = "UPGRADE_LISTEN_FDNAMES"
+
+// listenFDsStart is the first file descriptor passed with socket activation (sd_listen_fds)
+const listenFDsStart = 3
+
+var (
+	inheritOnce sync.Once
+	inherited   map[string][]net.Listener
+
+	registryMutex sync.Mutex
+	registry      []namedListener
+)
+
+type namedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// inheritedListeners returns the sockets passed by a previous process or systemd, by name. They
+// are taken once, the variables are removed so child processes don't claim them.
+func inheritedListeners() map[string][]net.Listener {
+	inheritOnce.Do(func() {
+		inherited = make(map[string][]net.Listener)
+
+		var names []string
+		if upgrade := os.Getenv(UpgradeFDNamesEnv); upgrade != "" {
+			names = strings.Split(upgrade, ":")
+		} else {
+			pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+			if err != nil || pid != os.Getpid() {
+				return
+			}
+			count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+			if err != nil || count <= 0 {
+				return
+			}
+			names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+			names = append(names, make([]string, max(count-len(names), 0))...)[:count]
+		}
+		for _, key := range []string{UpgradeFDNamesEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			_ = os.Unsetenv(key)
+		}
+
+		for i, name := range names {
+			fd := listenFDsStart + i
+			if name == "" {
+				name = unnamedListener
+			}
+			// FileListener works on a duplicate, the inherited descriptor is closed
+			file := os.NewFile(uintptr(fd), name)
+			listener, err := net.FileListener(file)
+			_ = file.Close()
+			if err != nil {
+				log.Printf("Ignoring inherited socket %d (%s): %v\n", fd, name, err)
+				continue
+			}
+			log.Printf("Using inherited socket %s (%s)\n", listener.Addr(), name)
+			inherited[name] = append(inherited[name], listener)
+		}
+	})
+	return inherited
+}
+
+// takeInherited removes the inherited sockets named name and registers them as in use
+func takeInherited(names ...string) []net.Listener {
+	var listeners []net.Listener
+	for _, name := range names {
+		for _, listener := range inheritedListeners()[name] {
+			register(name, listener)
+			listeners = append(listeners, listener)
+		}
+		delete(inheritedListeners(), name)
+	}
+	return listeners
+}
+
+// takeUnmatched takes the inherited sockets when they all have one name no listener uses. systemd
+// names the sockets of a .socket unit without FileDescriptorName= after the unit, e.g.
+// "chat-server.socket", those are meant for the chat server.
+func takeUnmatched() []net.Listener {
+	var unmatched []string
+	for name := range inheritedListeners() {
+		if !slices.Contains(listenerNames, name) {
+			unmatched = append(unmatched, name)
+		}
+	}
+	if len(unmatched) != 1 {
+		if len(unmatched) > 1 {
+			log.Printf("Ignoring inherited sockets %s, set FileDescriptorName=chat on the chat server socket\n", strings.Join(unmatched, ", "))
+		}
+		return nil
+	}
+	listeners := inheritedListeners()[unmatched[0]]
+	for _, listener := range listeners {
+		register(ListenerChat, listener)
+	}
+	delete(inheritedListeners(), unmatched[0])
+	return listeners
+}
+
+// CloseUnusedInherited closes the inherited sockets no listener took, e.g. after a transport
+// was disabled, so connections to them are refused instead of hanging
+func CloseUnusedInherited() {
+	for name, listeners := range inheritedListeners() {
+		for _, listener := range listeners {
+			log.Printf("Closing unused inherited socket %s (%s)\n", listener.Addr(), name)
+			_ = listener.Close()
+		}
+		delete(inheritedListeners(), name)
+	}
+}
+
+func register(name string, listener net.Listener) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, namedListener{name: name, listener: listener})
+}
+
+// ListenerFiles duplicates the listening sockets for a new process, with their names
+func ListenerFiles() ([]string, []*os.File, error) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	var names []string
+	var files []*os.File
+	for _, l := range registry {
+		filer, ok := l.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		file, err := filer.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to duplicate socket %s (%s): %w", l.listener.Addr(), l.name, err)
+		}
+		names = append(names, l.name)
+		files = append(files, file)
+	}
+	return names, files, nil
+}
+
+// CloseListeners stops accepting on every listening socket. Unix socket files are left in
+// place, they belong to the process the sockets were handed to.
+func CloseListeners() {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	for _, l := range registry {
+		if unixListener, ok := l.listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+		_ = l.listener.Close()
+	}
+	registry = nil
+}
+
+// Listen returns the sockets inherited under name, or a new TCP listener on host:port
+func Listen(name, host string, port int) (net.Listener, error) {
+	if listeners := takeInherited(name); len(listeners) > 0 {
+		return joinListeners(listeners), nil
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	register(name, listener)
+	return listener, nil
+}
+
+// ListenServer returns the chat server listener. It accepts on the inherited sockets named
+// "chat", unnamed or with a name no listener uses, or else on server.host:server.port, plus
+// server.socket when set.
+func ListenServer(cfg config.ServerConfig) (net.Listener, error) {
+	listeners := takeInherited(ListenerChat, unnamedListener)
+	if len(listeners) == 0 {
+		listeners = takeUnmatched()
+	}
+	if len(listeners) == 0 {
+		listener, err := Listen(ListenerChat, cfg.Host, cfg.Port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if cfg.Socket != "" {
+		mode, err := cfg.SocketFileMode()
+		if err != nil {
+			return nil, err
+		}
+		listener, err := ListenUnix(ListenerChatSocket, cfg.Socket, mode)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return joinListeners(listeners), nil
+}
+
+// ListenUnix returns the socket inherited under name, or listens on a Unix socket with the given
+// permissions, replacing a stale socket left by a previous run
+func ListenUnix(name, path string, mode os.FileMode) (net.Listener, error) {
+	if listeners := takeInherited(name); len(listeners) > 0 {
+		return joinListeners(listeners), nil
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %w", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions of unix socket %s: %w", path, err)
+	}
+	register(name, listener)
+	return listener, nil
+}
+
+// ----------MULTI LISTENER---------
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts connections from several listeners, so every transport can serve
+// TCP, Unix and inherited sockets with a single accept loop. It is closed once all of them are.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func joinListeners(listeners []net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.acceptFrom(listener)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		m.closeOnce.Do(func() { close(m.closed) })
+	}()
+	return m
+}
+
+func (m *multiListener) acceptFrom(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-m.accepted:
+		return result.conn, result.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var errs []error
+	for _, listener := range m.listeners {
+		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	m.closeOnce.Do(func() { close(m.closed) })
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -2,41 +2,88 @@ package network
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
 	"net"
-	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Transport names reported by connections
+const (
+	TransportTCP       = "tcp"
+	TransportWebSocket = "websocket"
+	TransportGRPC      = "gRPC"
+	TransportSSE       = "sse"
+	TransportIRC       = "irc"
+	TransportSSH       = "ssh"
+	TransportWebhook   = "webhook"
+	TransportBot       = "bot"
+)
+
 type Connection interface {
 	ReadLine() (string, error)
 	WriteLine(msg string) error
 	Close() error
+	Transport() string
+	// RemoteAddr is the client's address, as reported by a trusted proxy when there is one
+	RemoteAddr() string
 }
 
 // ------------TCP-------------
 
 type TCPConnection struct {
-	conn   net.Conn
-	reader *bufio.Reader
-	writer *bufio.Writer
+	conn      net.Conn
+	reader    *bufio.Reader
+	writer    *bufio.Writer
+	readLimit int64
 }
 
 func NewTCPConnection(conn net.Conn) *TCPConnection {
 	return &TCPConnection{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
-		writer: bufio.NewWriter(conn),
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		writer:    bufio.NewWriter(conn),
+		readLimit: DefaultReadLimit,
 	}
 }
 
+// SetReadLimit caps the length of a line in bytes, longer lines are discarded up to the next newline
+func (c *TCPConnection) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// ReadLine reads the next line without buffering more than the read limit,
+// it returns ErrLineTooLong or ErrInvalidUTF8 for lines it discarded
 func (c *TCPConnection) ReadLine() (string, error) {
-	line, err := c.reader.ReadString('\n')
-	if err != nil {
-		return "", err
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+		// the limit leaves room for the \r\n terminator
+		if !tooLong && int64(len(line)+len(chunk)) > c.readLimit+2 {
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if err == nil {
+			break
+		}
 	}
+
 	// remove trailing \r and \n for Windows and Unix newlines
-	return strings.TrimRight(line, "\r\n"), nil
+	line = bytes.TrimRight(line, "\r\n")
+	if tooLong || int64(len(line)) > c.readLimit {
+		return "", ErrLineTooLong
+	}
+	return cleanLine(line)
 }
 
 func (c *TCPConnection) WriteLine(msg string) error {
@@ -51,25 +98,61 @@ func (c *TCPConnection) Close() error {
 	return c.conn.Close()
 }
 
+func (c *TCPConnection) Transport() string {
+	return TransportTCP
+}
+
+func (c *TCPConnection) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
 // ----------WEBSOCKET---------
 
 type WSConnection struct {
-	conn *websocket.Conn
+	conn       *websocket.Conn
+	readLimit  int64
+	remoteAddr string
 }
 
 func NewWSConnection(conn *websocket.Conn) *WSConnection {
 	return &WSConnection{
-		conn: conn,
+		conn:       conn,
+		remoteAddr: conn.RemoteAddr().String(),
 	}
 }
 
+// SetReadLimit caps the size of a message in bytes, after decompression when compression is on.
+// Larger messages close the connection with a "message too big" close frame.
+func (c *WSConnection) SetReadLimit(limit int64) {
+	c.readLimit = limit
+	c.conn.SetReadLimit(limit)
+}
+
 func (c *WSConnection) ReadLine() (string, error) {
-	_, msg, err := c.conn.ReadMessage()
+	_, reader, err := c.conn.NextReader()
+	if err != nil {
+		if errors.Is(err, websocket.ErrReadLimit) {
+			log.Printf("Closing websocket connection from %s: message exceeds the read limit\n", c.conn.RemoteAddr())
+		}
+		return "", err
+	}
+
+	if c.readLimit > 0 {
+		// compressed frames are only limited on the wire, bound what they inflate to as well
+		reader = io.LimitReader(reader, c.readLimit+1)
+	}
+	msg, err := io.ReadAll(reader)
 	if err != nil {
 		return "", err
 	}
+	if c.readLimit > 0 && int64(len(msg)) > c.readLimit {
+		log.Printf("Closing websocket connection from %s: message exceeds the read limit\n", c.conn.RemoteAddr())
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+		_ = c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		return "", websocket.ErrReadLimit
+	}
 
-	return string(msg), nil
+	return cleanLine(msg)
 }
 
 func (c *WSConnection) WriteLine(msg string) error {
@@ -79,3 +162,11 @@ func (c *WSConnection) WriteLine(msg string) error {
 func (c *WSConnection) Close() error {
 	return c.conn.Close()
 }
+
+func (c *WSConnection) Transport() string {
+	return TransportWebSocket
+}
+
+func (c *WSConnection) RemoteAddr() string {
+	return c.remoteAddr
+}
@@ -0,0 +1,292 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"chat-server/internal/config"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a trusted proxy may take to send the PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrNoProxyHeader      = errors.New("missing PROXY protocol header")
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// ---------TRUSTED PROXIES--------
+
+// trustedProxies are the networks of proxy.trustedProxies, entries are CIDRs or single addresses
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(entries []string) trustedProxies {
+	var nets trustedProxies
+	for _, entry := range entries {
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, ipNet)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		}
+	}
+	return nets
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAddr reports whether addr ("host:port" or "host") is a trusted proxy
+func (t trustedProxies) containsAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && t.contains(ip)
+}
+
+// ---------PROXY PROTOCOL---------
+
+type proxyListener struct {
+	net.Listener
+	store *config.Store
+}
+
+// NewProxyListener accepts PROXY protocol v1 and v2 headers when proxy.proxyProtocol is on.
+// Only connections from proxy.trustedProxies are expected to send one, and must; the header
+// replaces the connection's RemoteAddr with the client's. Both settings are read on every accept.
+func NewProxyListener(listener net.Listener, store *config.Store) net.Listener {
+	return &proxyListener{Listener: listener, store: store}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := l.store.Get().Proxy
+	if !cfg.ProxyProtocol || !parseTrustedProxies(cfg.TrustedProxies).containsAddr(conn.RemoteAddr().String()) {
+		return conn, nil
+	}
+	// the header is read by the connection's goroutine, a slow proxy doesn't block the accept loop
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the PROXY header before the first Read or RemoteAddr
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+
+	mutex        sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+
+		c.mutex.Lock()
+		_ = c.Conn.SetReadDeadline(c.readDeadline)
+		c.mutex.Unlock()
+
+		if c.err != nil {
+			log.Printf("Closing connection from proxy %s: %v\n", c.Conn.RemoteAddr(), c.err)
+			_ = c.Conn.Close()
+		}
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+// SetDeadline and SetReadDeadline remember the read deadline, it is restored after the header is read
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readProxyHeader reads a v1 or v2 header. The address is nil for v1 UNKNOWN, v2 LOCAL
+// and non-IP families, the connection's own address applies then.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoProxyHeader, err)
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, proxyV1Prefix):
+		return readProxyV1(r)
+	default:
+		return nil, ErrNoProxyHeader
+	}
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst srcport dstport\r\n", at most 107 bytes
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header: signature, version/command, family, length, addresses
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, e.g. health checks of the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// addresses come first in the payload, TLVs after them are ignored
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// ---------FORWARDED HEADERS-------
+
+// ClientAddr returns the address of the client that sent r. Forwarded and X-Forwarded-For are
+// only used when the request comes from proxy.trustedProxies; the chain is read from the right,
+// skipping trusted proxies, so clients can't spoof their address by sending the header themselves.
+func ClientAddr(r *http.Request, store *config.Store) string {
+	trusted := parseTrustedProxies(store.Get().Proxy.TrustedProxies)
+	if !trusted.containsAddr(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+
+	chain := forwardedFor(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			// obfuscated or unknown node, nothing further left can be trusted
+			break
+		}
+		if i == 0 || !trusted.contains(ip) {
+			return ip.String()
+		}
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor returns the client chain from the Forwarded header (RFC 7239), or else from
+// X-Forwarded-For, the proxy closest to the server last
+func forwardedFor(header http.Header) []string {
+	var chain []string
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, forwardedNode(node))
+				}
+			}
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(node))
+		}
+	}
+	return chain
+}
+
+// forwardedNode strips the quotes, brackets and port of a Forwarded node, e.g. "[2001:db8::1]:4711"
+func forwardedNode(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
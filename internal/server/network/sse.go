@@ -0,0 +1,393 @@
+package network
+
+import (
+	"chat-server/internal/config"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment, so proxies don't time it out
+const sseKeepAlive = 15 * time.Second
+
+// sseEvent is one line written to the client, numbered for Last-Event-ID
+type sseEvent struct {
+	id   uint64
+	data string
+}
+
+// SSEConnection is a client speaking plain HTTP: it receives lines over a Server-Sent Events
+// stream and sends lines with POST requests. The connection outlives the HTTP requests, a
+// dropped stream can reconnect and resume with Last-Event-ID.
+type SSEConnection struct {
+	inbox     chan string
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+
+	mutex      sync.Mutex
+	events     []sseEvent
+	replaySize int
+	nextID     uint64
+	notify     chan struct{}
+	generation uint64
+	timeout    time.Duration
+	expiry     *time.Timer
+
+	remoteAddr string
+}
+
+func newSSEConnection(remoteAddr string, replaySize int, timeout time.Duration, onClose func()) *SSEConnection {
+	c := &SSEConnection{
+		remoteAddr: remoteAddr,
+		inbox:      make(chan string),
+		closed:     make(chan struct{}),
+		onClose:    onClose,
+		replaySize: replaySize,
+		notify:     make(chan struct{}),
+		timeout:    timeout,
+	}
+	// the first stream has to attach within the timeout too
+	c.expiry = time.AfterFunc(timeout, func() { c.Close() })
+	return c
+}
+
+func (c *SSEConnection) ReadLine() (string, error) {
+	select {
+	case line := <-c.inbox:
+		return line, nil
+	case <-c.closed:
+		return "", io.EOF
+	}
+}
+
+// WriteLine queues msg for the event stream, it never blocks on the network.
+// Only the last replaySize lines are kept for clients resuming with Last-Event-ID.
+func (c *SSEConnection) WriteLine(msg string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	c.nextID++
+	c.events = append(c.events, sseEvent{id: c.nextID, data: msg})
+	if len(c.events) > c.replaySize {
+		c.events = c.events[len(c.events)-c.replaySize:]
+	}
+	c.wake()
+	return nil
+}
+
+func (c *SSEConnection) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		c.expiry.Stop()
+		close(c.closed)
+		c.wake()
+		c.mutex.Unlock()
+		c.onClose()
+	})
+	return nil
+}
+
+func (c *SSEConnection) Transport() string {
+	return TransportSSE
+}
+
+// RemoteAddr is the address that created the session
+func (c *SSEConnection) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+// wake tells the attached stream something changed, the caller holds the mutex
+func (c *SSEConnection) wake() {
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// attach makes a new event stream the current one, a previous stream of the connection ends
+func (c *SSEConnection) attach() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expiry.Stop()
+	c.generation++
+	c.wake()
+	return c.generation
+}
+
+// detach starts the session timeout unless another stream took over
+func (c *SSEConnection) detach(generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation == c.generation {
+		c.expiry.Reset(c.timeout)
+	}
+}
+
+// pending returns the events after lastID and a channel closed on the next change.
+// ok is false once another stream attached.
+func (c *SSEConnection) pending(generation, lastID uint64) ([]sseEvent, <-chan struct{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return nil, nil, false
+	}
+	var events []sseEvent
+	for i, evt := range c.events {
+		if evt.id > lastID {
+			events = append(events, c.events[i:]...)
+			break
+		}
+	}
+	return events, c.notify, true
+}
+
+// ----------HTTP HANDLERS---------
+
+type sseHandler struct {
+	store       *config.Store
+	handle      func(conn Connection)
+	checkOrigin func(r *http.Request) bool
+	mux         *http.ServeMux
+
+	mutex sync.Mutex
+	// sessions are found by their token, which sends messages, and their streams by a read-only
+	// stream token: it goes in the /events URL and may end up in the logs of proxies
+	sessions map[string]*SSEConnection
+	streams  map[string]*SSEConnection
+}
+
+// NewSSEHandler serves the HTTP transport:
+//
+//	POST /sessions  starts a session and returns its token and its read-only stream token
+//	GET  /events    streams the lines sent to the session (?stream=<streamToken>), resumes after Last-Event-ID
+//	POST /messages  sends the lines of the body (Authorization: Bearer <token>)
+//
+// Each session is passed to handle as a Connection. It is closed when no event stream has been
+// attached for sse.sessionTimeout.
+func NewSSEHandler(store *config.Store, handle func(conn Connection)) http.Handler {
+	h := &sseHandler{
+		store:       store,
+		handle:      handle,
+		checkOrigin: checkOrigin(store),
+		mux:         http.NewServeMux(),
+		sessions:    make(map[string]*SSEConnection),
+		streams:     make(map[string]*SSEConnection),
+	}
+	h.mux.HandleFunc("POST /sessions", h.createSession)
+	h.mux.HandleFunc("GET /events", h.streamEvents)
+	h.mux.HandleFunc("POST /messages", h.postMessages)
+	return h
+}
+
+func (h *sseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *sseHandler) createSession(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	streamToken, err := newToken()
+	if err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	cfg := h.store.Get()
+	h.mutex.Lock()
+	// every session may become a client, sessions that haven't joined yet count too
+	if len(h.sessions) >= cfg.Server.MaxClients {
+		h.mutex.Unlock()
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+	conn := newSSEConnection(ClientAddr(r, h.store), cfg.SSE.ReplayBuffer, time.Duration(cfg.SSE.SessionTimeout)*time.Second, func() {
+		h.mutex.Lock()
+		delete(h.sessions, token)
+		delete(h.streams, streamToken)
+		h.mutex.Unlock()
+	})
+	h.sessions[token] = conn
+	h.streams[streamToken] = conn
+	h.mutex.Unlock()
+
+	go h.handle(conn)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{"token": token, "streamToken": streamToken})
+}
+
+// newToken returns a random token of 32 bytes, hex encoded
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (h *sseHandler) streamEvents(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn := h.lookup(h.streams, r.URL.Query().Get("stream"))
+	if conn == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// EventSource sends the header when it reconnects, other clients may use the query parameter
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	lastID, _ := strconv.ParseUint(lastEventID, 10, 64)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 2000\n\n")
+	flusher.Flush()
+
+	generation := conn.attach()
+	defer conn.detach(generation)
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		events, changed, ok := conn.pending(generation, lastID)
+		if !ok {
+			return
+		}
+		for _, evt := range events {
+			if err := writeSSEEvent(w, evt); err != nil {
+				return
+			}
+			lastID = evt.id
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+			select {
+			case <-conn.closed:
+				// deliver what was written before the close, then end the stream
+				events, _, _ = conn.pending(generation, lastID)
+				for _, evt := range events {
+					_ = writeSSEEvent(w, evt)
+				}
+				flusher.Flush()
+				return
+			default:
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSEEvent writes evt, a line holding newlines becomes several data fields
+func writeSSEEvent(w io.Writer, evt sseEvent) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id: %d\n", evt.id)
+	for _, line := range strings.Split(evt.data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (h *sseHandler) postMessages(w http.ResponseWriter, r *http.Request) {
+	// the token isn't taken from the URL, where it would end up in the logs of proxies
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	conn := h.lookup(h.sessions, token)
+	if conn == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ReadLimit(h.store.Get().Message.MaxLength)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, ErrLineTooLong.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	// one line per message, a trailing newline does not add an empty message
+	var lines []string
+	for _, raw := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+		line, err := cleanLine([]byte(strings.TrimSuffix(raw, "\r")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lines = append(lines, line)
+	}
+
+	for _, line := range lines {
+		select {
+		case conn.inbox <- line:
+		case <-conn.closed:
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// lookup returns the session of token in tokens, sessions or streams
+func (h *sseHandler) lookup(tokens map[string]*SSEConnection, token string) *SSEConnection {
+	if token == "" {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return tokens[token]
+}
@@ -0,0 +1,57 @@
+package network
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// SSHConnection is a chat session over an SSH channel with a PTY. Lines are read with
+// terminal line editing (arrows, history, ...) and the input line is redrawn when messages arrive.
+type SSHConnection struct {
+	conn     ssh.Conn
+	channel  ssh.Channel
+	terminal *term.Terminal
+	mutex    sync.Mutex
+}
+
+func NewSSHConnection(conn ssh.Conn, channel ssh.Channel, terminal *term.Terminal) *SSHConnection {
+	return &SSHConnection{
+		conn:     conn,
+		channel:  channel,
+		terminal: terminal,
+	}
+}
+
+// ReadLine reads the next line typed in the terminal, which caps lines at 4096 characters
+func (c *SSHConnection) ReadLine() (string, error) {
+	line, err := c.terminal.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	return cleanLine([]byte(line))
+}
+
+func (c *SSHConnection) WriteLine(msg string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, err := c.terminal.Write([]byte(msg + "\n"))
+	return err
+}
+
+// Close ends the session with exit status 0 so the ssh client exits cleanly
+func (c *SSHConnection) Close() error {
+	_, _ = c.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+	_ = c.channel.Close()
+	return c.conn.Close()
+}
+
+func (c *SSHConnection) Transport() string {
+	return TransportSSH
+}
+
+func (c *SSHConnection) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
@@ -1,10 +1,15 @@
 package network
 
 import (
+	"bytes"
 	"chat-server/internal/config"
+	"chat-server/internal/metrics"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"log"
 	"net"
+	"os"
 
 	"google.golang.org/grpc/credentials"
 )
@@ -48,5 +53,98 @@ func NewGRPCTLSCredentials(tlsCfg config.TLSConfig) (credentials.TransportCreden
 	if err != nil {
 		return nil, err
 	}
+	return countingCredentials{credentials.NewTLS(cfg)}, nil
+}
+
+// NewMutualTLSCredentials builds gRPC transport credentials that also require a client certificate signed by clientCAFile
+func NewMutualTLSCredentials(tlsCfg config.TLSConfig, clientCAFile string) (credentials.TransportCredentials, error) {
+	cfg, err := tlsConfig(tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return countingCredentials{credentials.NewTLS(cfg)}, nil
+}
+
+// NewPeerTLSCredentials builds gRPC client credentials presenting the certificate of tlsCfg, which
+// only accept servers whose certificate is signed by caFile and valid for serverName
+func NewPeerTLSCredentials(tlsCfg config.TLSConfig, caFile, serverName string) (credentials.TransportCredentials, error) {
+	cfg, err := tlsConfig(tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+
+	cfg.RootCAs = pool
+	cfg.ServerName = serverName
 	return credentials.NewTLS(cfg), nil
 }
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// Handshake completes the TLS handshake of a connection accepted from a TLS listener,
+// so failures are reported here instead of on the first read. Plain connections are left untouched.
+func Handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		metrics.TLSHandshakeErrors.WithLabelValues(TransportTCP).Inc()
+		return err
+	}
+	return nil
+}
+
+// NewHTTPErrorLog returns a logger for http.Server.ErrorLog that counts the TLS handshake errors net/http reports
+func NewHTTPErrorLog() *log.Logger {
+	return log.New(handshakeErrorWriter{}, "", 0)
+}
+
+type handshakeErrorWriter struct{}
+
+func (handshakeErrorWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		metrics.TLSHandshakeErrors.WithLabelValues(TransportWebSocket).Inc()
+	}
+	log.Print(string(p))
+	return len(p), nil
+}
+
+// countingCredentials counts failed server handshakes of the wrapped gRPC credentials
+type countingCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c countingCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	secureConn, info, err := c.TransportCredentials.ServerHandshake(conn)
+	if err != nil {
+		metrics.TLSHandshakeErrors.WithLabelValues(TransportGRPC).Inc()
+	}
+	return secureConn, info, err
+}
+
+func (c countingCredentials) Clone() credentials.TransportCredentials {
+	return countingCredentials{c.TransportCredentials.Clone()}
+}
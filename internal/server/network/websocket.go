@@ -0,0 +1,63 @@
+package network
+
+import (
+	"chat-server/internal/config"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewWSHandler upgrades requests to WebSocket connections and passes them to handle.
+// The client address is taken from the forwarded headers of trusted proxies.
+// Buffer sizes and compression are read once, the allowed origins and the read limit on every upgrade.
+func NewWSHandler(store *config.Store, handle func(conn Connection)) http.Handler {
+	cfg := store.Get().WebSocket
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		EnableCompression: cfg.Compression,
+		CheckOrigin:       checkOrigin(store),
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("Error upgrading websocket: %s\n", err)
+			return
+		}
+		conn := NewWSConnection(wsConn)
+		conn.remoteAddr = ClientAddr(r, store)
+		conn.SetReadLimit(ReadLimit(store.Get().Message.MaxLength))
+		go handle(conn)
+	})
+}
+
+// checkOrigin accepts requests without an Origin header (non-browser clients), then either the
+// configured websocket.allowedOrigins or, when none are configured, only pages served by this host
+func checkOrigin(store *config.Store) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		allowed := store.Get().WebSocket.AllowedOrigins
+		if len(allowed) == 0 {
+			u, err := url.Parse(origin)
+			if err == nil && strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+				return true
+			}
+		}
+
+		log.Printf("Rejected %s %s from %s: origin %q not allowed\n", r.Method, r.URL.Path, r.RemoteAddr, origin)
+		return false
+	}
+}
@@ -0,0 +1,231 @@
+// Package redisbackplane shares users and messages between chat server replicas through Redis:
+// usernames are keys owned by a replica, events are published on a pub/sub channel.
+package redisbackplane
+
+import (
+	"chat-server/internal/config"
+	core "chat-server/internal/server"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// presenceTTL is how long a username outlives its replica, e.g. after a crash.
+// The replica refreshes its usernames every presenceTTL/3.
+const presenceTTL = 30 * time.Second
+
+// releaseScript deletes a username only when this replica owns it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// refreshScript extends the TTL of a username only when this replica owns it
+var refreshScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// Backplane implements core.Backplane on Redis
+type Backplane struct {
+	client  redis.UniversalClient
+	prefix  string
+	replica string
+
+	mutex  sync.Mutex
+	owned  map[string]struct{}
+	pubsub *redis.PubSub
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Dial connects to the Redis server of cfg
+func Dial(cfg config.RedisConfig) (*Backplane, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Address,
+		Username: cfg.Username,
+		Password: cfg.Password.Value(),
+		DB:       cfg.DB,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", cfg.Address, err)
+	}
+	return New(client, cfg.Prefix), nil
+}
+
+// New creates a backplane on client, keys and channels are prefixed with prefix
+func New(client redis.UniversalClient, prefix string) *Backplane {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	b := &Backplane{
+		client:  client,
+		prefix:  prefix,
+		replica: hex.EncodeToString(id),
+		owned:   make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.refresh()
+	return b
+}
+
+func (b *Backplane) userKey(username string) string {
+	return b.prefix + ":user:" + username
+}
+
+func (b *Backplane) channel() string {
+	return b.prefix + ":events"
+}
+
+func (b *Backplane) Reserve(ctx context.Context, username string) error {
+	ok, err := b.client.SetNX(ctx, b.userKey(username), b.replica, presenceTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return core.ErrUsernameAlreadyTaken
+	}
+
+	b.mutex.Lock()
+	b.owned[username] = struct{}{}
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *Backplane) Release(ctx context.Context, username string) error {
+	b.mutex.Lock()
+	delete(b.owned, username)
+	b.mutex.Unlock()
+
+	return releaseScript.Run(ctx, b.client, []string{b.userKey(username)}, b.replica).Err()
+}
+
+func (b *Backplane) Online(ctx context.Context, username string) (bool, error) {
+	n, err := b.client.Exists(ctx, b.userKey(username)).Result()
+	return n > 0, err
+}
+
+func (b *Backplane) Users(ctx context.Context) ([]string, error) {
+	var usernames []string
+	prefix := b.userKey("")
+	iter := b.client.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		usernames = append(usernames, strings.TrimPrefix(iter.Val(), prefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	// SCAN may return a key twice
+	slices.Sort(usernames)
+	return slices.Compact(usernames), nil
+}
+
+func (b *Backplane) Publish(ctx context.Context, event core.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel(), data).Err()
+}
+
+// Subscribe listens on the events channel. It returns once the subscription is active, so
+// no event published afterwards is missed; the client reconnects by itself after errors.
+func (b *Backplane) Subscribe(handler func(core.Event)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pubsub := b.client.Subscribe(ctx, b.channel())
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe to %s: %w", b.channel(), err)
+	}
+	b.mutex.Lock()
+	b.pubsub = pubsub
+	b.mutex.Unlock()
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			var event core.Event
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("Ignoring invalid backplane event: %v\n", err)
+				continue
+			}
+			handler(event)
+		}
+	}()
+	return nil
+}
+
+// refresh keeps the usernames of this replica alive until they are released
+func (b *Backplane) refresh() {
+	ticker := time.NewTicker(presenceTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), presenceTTL/3)
+		b.refreshOwned(ctx)
+		cancel()
+	}
+}
+
+// refreshOwned extends the TTL of the usernames this replica still owns
+func (b *Backplane) refreshOwned(ctx context.Context) {
+	b.mutex.Lock()
+	usernames := make([]string, 0, len(b.owned))
+	for username := range b.owned {
+		usernames = append(usernames, username)
+	}
+	b.mutex.Unlock()
+
+	pipe := b.client.Pipeline()
+	for _, username := range usernames {
+		// EVALSHA can't fall back to EVAL inside a pipeline
+		refreshScript.Eval(ctx, pipe, []string{b.userKey(username)}, b.replica, presenceTTL.Milliseconds())
+	}
+	if _, err := pipe.Exec(ctx); err != nil && len(usernames) > 0 {
+		log.Printf("Error refreshing %d usernames on redis: %v\n", len(usernames), err)
+	}
+}
+
+// Close releases the usernames of this replica and disconnects from Redis
+func (b *Backplane) Close() error {
+	b.once.Do(func() { close(b.done) })
+
+	b.mutex.Lock()
+	usernames := make([]string, 0, len(b.owned))
+	for username := range b.owned {
+		usernames = append(usernames, username)
+	}
+	pubsub := b.pubsub
+	b.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, username := range usernames {
+		_ = b.Release(ctx, username)
+	}
+	if pubsub != nil {
+		pubsub.Close()
+	}
+	return b.client.Close()
+}
@@ -0,0 +1,178 @@
+package redisbackplane
+
+import (
+	core "chat-server/internal/server"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newReplicas returns n backplanes sharing one miniredis, as n replicas of the chat would
+func newReplicas(t *testing.T, n int) (*miniredis.Miniredis, []*Backplane) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	replicas := make([]*Backplane, n)
+	for i := range replicas {
+		replicas[i] = New(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test")
+		t.Cleanup(func() { replicas[i].Close() })
+	}
+	return mr, replicas
+}
+
+func TestReserveRelease(t *testing.T) {
+	mr, replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+	ctx := context.Background()
+
+	if err := a.Reserve(ctx, "alice"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := b.Reserve(ctx, "alice"); !errors.Is(err, core.ErrUsernameAlreadyTaken) {
+		t.Fatalf("Reserve on another replica: got %v, want ErrUsernameAlreadyTaken", err)
+	}
+	if online, err := b.Online(ctx, "alice"); err != nil || !online {
+		t.Fatalf("Online = %v, %v, want true", online, err)
+	}
+
+	// only the owner can release a username
+	if err := b.Release(ctx, "alice"); err != nil {
+		t.Fatalf("Release by another replica: %v", err)
+	}
+	if !mr.Exists("test:user:alice") {
+		t.Fatal("a replica released a username it doesn't own")
+	}
+	if err := a.Release(ctx, "alice"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if mr.Exists("test:user:alice") {
+		t.Fatal("username still reserved after Release")
+	}
+	if err := b.Reserve(ctx, "alice"); err != nil {
+		t.Fatalf("Reserve after Release: %v", err)
+	}
+}
+
+func TestRefreshOwned(t *testing.T) {
+	mr, replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+	ctx := context.Background()
+
+	if err := a.Reserve(ctx, "alice"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := b.Reserve(ctx, "bob"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	mr.FastForward(presenceTTL - 5*time.Second)
+
+	a.refreshOwned(ctx)
+	if ttl := mr.TTL("test:user:alice"); ttl != presenceTTL {
+		t.Fatalf("TTL of a refreshed username = %v, want %v", ttl, presenceTTL)
+	}
+	if ttl := mr.TTL("test:user:bob"); ttl != 5*time.Second {
+		t.Fatalf("TTL of another replica's username = %v, want 5s", ttl)
+	}
+
+	// a crashed replica stops refreshing, its usernames expire
+	mr.FastForward(10 * time.Second)
+	if mr.Exists("test:user:bob") {
+		t.Fatal("username not refreshed by its replica didn't expire")
+	}
+	if !mr.Exists("test:user:alice") {
+		t.Fatal("refreshed username expired")
+	}
+
+	// a released username isn't refreshed again
+	if err := a.Release(ctx, "alice"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	a.refreshOwned(ctx)
+	if mr.Exists("test:user:alice") {
+		t.Fatal("released username came back")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	_, replicas := newReplicas(t, 2)
+	ctx := context.Background()
+
+	var want []string
+	for i, username := range []string{"carol", "alice", "bob", "dave"} {
+		if err := replicas[i%2].Reserve(ctx, username); err != nil {
+			t.Fatalf("Reserve %s: %v", username, err)
+		}
+		want = append(want, username)
+	}
+	slices.Sort(want)
+
+	for i, replica := range replicas {
+		users, err := replica.Users(ctx)
+		if err != nil {
+			t.Fatalf("Users: %v", err)
+		}
+		if !slices.Equal(users, want) {
+			t.Fatalf("Users of replica %d = %v, want %v", i, users, want)
+		}
+	}
+}
+
+func TestPublishReachesReplicas(t *testing.T) {
+	_, replicas := newReplicas(t, 2)
+	servers := make([]*core.ChatServer, len(replicas))
+	for i, replica := range replicas {
+		server, err := core.NewChatServerWithBackplane(replica)
+		if err != nil {
+			t.Fatalf("NewChatServerWithBackplane: %v", err)
+		}
+		servers[i] = server
+	}
+
+	connect := func(server *core.ChatServer, username string) *core.Client {
+		t.Helper()
+		client, err := server.Connect(username, core.ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 5})
+		if err != nil {
+			t.Fatalf("Connect %s: %v", username, err)
+		}
+		return client
+	}
+	alice := connect(servers[0], "alice")
+	bob := connect(servers[1], "bob")
+	carol := connect(servers[0], "carol")
+	if _, err := servers[1].Connect("alice", core.ConnectOptions{Transport: "tcp", MaxClients: 10, RateLimit: 5}); !errors.Is(err, core.ErrUsernameAlreadyTaken) {
+		t.Fatalf("Connect alice on the other replica: got %v, want ErrUsernameAlreadyTaken", err)
+	}
+
+	servers[0].Broadcast(alice, "hello")
+	for _, client := range []*core.Client{bob, carol} {
+		if got := receive(t, client); got != "[alice]: hello" {
+			t.Fatalf("%s received %q, want the broadcast", client.Username, got)
+		}
+	}
+
+	if err := servers[1].PrivateMessage(bob, "alice", "hi"); err != nil {
+		t.Fatalf("PrivateMessage across replicas: %v", err)
+	}
+	if got := receive(t, alice); got != "[Private] bob : hi" {
+		t.Fatalf("alice received %q, want the private message", got)
+	}
+	if err := servers[1].PrivateMessage(bob, "nobody", "hi"); !errors.Is(err, core.ErrRecipientNotFound) {
+		t.Fatalf("PrivateMessage to nobody: got %v, want ErrRecipientNotFound", err)
+	}
+}
+
+// receive returns the next message of client, failing when none arrives
+func receive(t *testing.T, client *core.Client) string {
+	t.Helper()
+	select {
+	case message := <-client.Message:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s received nothing", client.Username)
+		return ""
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"log"
+
+	"chat-server/internal/metrics"
+)
+
+// Relay carries the messages of local users to other chat servers, e.g. federated peers
+type Relay interface {
+	// RelayBroadcast forwards a message a local user sent to the chat
+	RelayBroadcast(from, text string)
+	// IsRemote reports whether recipient is a user of another server (user@server)
+	IsRemote(recipient string) bool
+	// RelayPrivate delivers a private message to a user of another server, ErrRecipientNotFound
+	// when that server doesn't know the user
+	RelayPrivate(ctx context.Context, from, recipient, text string) error
+}
+
+// SetRelay sets the relay messages of local users are forwarded to
+func (s *ChatServer) SetRelay(relay Relay) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.relay = relay
+}
+
+func (s *ChatServer) getRelay() Relay {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.relay
+}
+
+// DeliverRemote shows a message received from another server to the users of every replica,
+// from is the sender as user@server. It isn't relayed again.
+func (s *ChatServer) DeliverRemote(from, text string) {
+	metrics.MessagesTotal.WithLabelValues(metrics.KindBroadcast).Inc()
+	s.publish(Event{Kind: EventBroadcast, From: from, Text: text})
+	kind := remoteActivity(from, text)
+	if kind != ActivityMessage {
+		text = ""
+	}
+	s.notify(kind, from, text)
+}
+
+// DeliverRemotePrivate hands a private message received from another server to recipient,
+// ErrRecipientNotFound when recipient isn't connected to any replica
+func (s *ChatServer) DeliverRemotePrivate(from, recipient, text string) error {
+	return s.publishPrivate(Event{Kind: EventPrivate, From: from, To: recipient, Text: text})
+}
+
+// publishPrivate sends a private message to the replica its recipient is connected to
+func (s *ChatServer) publishPrivate(event Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	online, err := s.backplane.Online(ctx, event.To)
+	if err != nil {
+		log.Printf("Error looking up %s: %v\n", event.To, err)
+		return ErrBackplaneUnavailable
+	}
+	if !online {
+		return ErrRecipientNotFound
+	}
+	if err := s.backplane.Publish(ctx, event); err != nil {
+		log.Printf("Error publishing private message: %v\n", err)
+		return ErrBackplaneUnavailable
+	}
+	metrics.MessagesTotal.WithLabelValues(metrics.KindPrivate).Inc()
+	return nil
+}
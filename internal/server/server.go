@@ -2,106 +2,402 @@ package server
 
 import (
 	"chat-server/internal/config"
+	"chat-server/internal/metrics"
 	"chat-server/internal/server/network"
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
 // ChatServer manages client connections and message routing
 type ChatServer struct {
-	clients map[string]*Client
-	mutex   sync.RWMutex
+	clients    map[string]*Client
+	configBans map[string]struct{}
+	bans       map[string]struct{}
+	mutes      map[string]time.Time
+	draining   bool
+	onDrain    []func()
+	topic      string
+	startedAt  time.Time
+	backplane  Backplane
+	relay      Relay
+	hooks      []func(Activity)
+	inbound    []stage
+	outbound   []stage
+	commands   map[string]*command
+	roles      map[string]Role
+	bots       map[string]*Bot
+	mutex      sync.RWMutex
 }
 
-// NewChatServer creates a new chat server instance
+// ConnectOptions describes a connecting client and the limits applied to it
+type ConnectOptions struct {
+	Transport  string
+	RemoteAddr string
+	MaxClients int
+	RateLimit  int
+	// Authenticated is set when the transport proved the user owns the username, e.g. with an SSH
+	// key. Only authenticated clients may use the usernames of moderators and admins.
+	Authenticated bool
+	// Close terminates the client's underlying connection, it is used to kick the client
+	Close func() error
+}
+
+// NewChatServer creates a new chat server instance running alone
 func NewChatServer() *ChatServer {
-	return &ChatServer{
-		clients: make(map[string]*Client),
+	server, _ := NewChatServerWithBackplane(NewMemoryBackplane())
+	return server
+}
+
+// NewChatServerWithBackplane creates a chat server sharing its users and messages with the
+// other replicas on backplane
+func NewChatServerWithBackplane(backplane Backplane) (*ChatServer, error) {
+	s := &ChatServer{
+		clients:    make(map[string]*Client),
+		configBans: make(map[string]struct{}),
+		bans:       make(map[string]struct{}),
+		mutes:      make(map[string]time.Time),
+		startedAt:  time.Now(),
+		backplane:  backplane,
+		commands:   make(map[string]*command),
+		bots:       make(map[string]*Bot),
 	}
+	s.registerBuiltinCommands()
+	if err := backplane.Subscribe(s.deliver); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-// Connect Add a new client to the chat server
-func (s *ChatServer) Connect(username string, maxClients, rateLimit int) (*Client, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// Connect Add a new client to the chat server, its username is reserved on every replica
+func (s *ChatServer) Connect(username string, opts ConnectOptions) (*Client, error) {
+	s.mutex.RLock()
+	err := s.canConnect(username, opts)
+	s.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
 
-	if _, exists := s.clients[username]; exists {
-		return nil, ErrUsernameAlreadyTaken
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	if err := s.backplane.Reserve(ctx, username); errors.Is(err, ErrUsernameAlreadyTaken) {
+		return nil, err
+	} else if err != nil {
+		log.Printf("Error reserving username %s: %v\n", username, err)
+		return nil, ErrBackplaneUnavailable
 	}
 
-	if len(s.clients) >= maxClients {
-		return nil, ErrServerFull
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// checked again, the lock was released while reserving
+	if err := s.canConnect(username, opts); err != nil {
+		_ = s.backplane.Release(ctx, username)
+		return nil, err
 	}
 
-	refillRate := time.Second / time.Duration(rateLimit)
+	refillRate := time.Second / time.Duration(opts.RateLimit)
 	client := &Client{
-		Username:  username,
-		Message:   make(chan string, 10),
-		connected: true,
-		limiter:   NewTokenBucket(rateLimit, refillRate),
+		Username:      username,
+		Transport:     opts.Transport,
+		RemoteAddr:    opts.RemoteAddr,
+		authenticated: opts.Authenticated,
+		ConnectedAt:   time.Now(),
+		Message:       make(chan string, 10),
+		connected:     true,
+		limiter:       NewTokenBucket(opts.RateLimit, refillRate),
+		close:         opts.Close,
+		flushed:       make(chan struct{}, 1),
 	}
 
 	s.clients[username] = client
+	metrics.ConnectedClients.WithLabelValues(Lobby, opts.Transport).Inc()
 	return client, nil
 }
 
-// Disconnect removes a client form the chat server
-func (s *ChatServer) Disconnect(client *Client) {
+// canConnect checks username may join this replica, the caller must hold the mutex
+func (s *ChatServer) canConnect(username string, opts ConnectOptions) error {
+	if s.draining {
+		return ErrServerDraining
+	}
+
+	if s.isBanned(username) {
+		return ErrUserBanned
+	}
+
+	if reservedUsername(username) {
+		return ErrUsernameAlreadyTaken
+	}
+
+	// a shared password doesn't tell who connects, the moderators and admins need a key
+	if s.roles[username] > RoleUser && !opts.Authenticated {
+		return ErrNotAuthenticated
+	}
+
+	if _, exists := s.clients[username]; exists {
+		return ErrUsernameAlreadyTaken
+	}
+
+	if _, isBot := s.bots[username]; isBot {
+		return ErrUsernameAlreadyTaken
+	}
+
+	if len(s.clients) >= opts.MaxClients {
+		return ErrServerFull
+	}
+	return nil
+}
+
+// reservedUsername reports whether username is the one of the server's own lines, "[System]: ..."
+// announcements that clients show as coming from the operators
+func reservedUsername(username string) bool {
+	return strings.EqualFold(username, "System")
+}
+
+// SetBannedUsers replaces the usernames banned by the configuration and kicks the ones connected
+func (s *ChatServer) SetBannedUsers(usernames []string) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	s.configBans = make(map[string]struct{}, len(usernames))
+	for _, username := range usernames {
+		s.configBans[username] = struct{}{}
+	}
+	s.mutex.Unlock()
+
+	for _, username := range usernames {
+		_ = s.Kick(username, "banned")
+	}
+}
+
+// isBanned reports whether username is banned by the configuration or an operator, the caller must hold the mutex
+func (s *ChatServer) isBanned(username string) bool {
+	_, configBanned := s.configBans[username]
+	_, banned := s.bans[username]
+	return configBanned || banned
+}
 
+// SetRateLimit applies a new per-client message rate to every connected client
+func (s *ChatServer) SetRateLimit(rateLimit int) {
+	if rateLimit <= 0 {
+		return
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	refillRate := time.Second / time.Duration(rateLimit)
+	for _, client := range s.clients {
+		client.limiter.SetRate(rateLimit, refillRate)
+	}
+}
+
+// Disconnect removes a client form the chat server and releases its username
+func (s *ChatServer) Disconnect(client *Client) {
+	s.mutex.Lock()
 	delete(s.clients, client.Username)
+	// under the client's mutex too, Send may be running without the server's
+	client.mutex.Lock()
 	client.connected = false
 	close(client.Message)
+	client.mutex.Unlock()
+	metrics.ConnectedClients.WithLabelValues(Lobby, client.Transport).Dec()
+	s.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	if err := s.backplane.Release(ctx, client.Username); err != nil {
+		log.Printf("Error releasing username %s: %v\n", client.Username, err)
+	}
 }
 
-// Broadcast sends a message to all connected clients
+// Broadcast sends a message to all connected clients, on every replica and the federated servers,
+// without going through the inbound chain
 func (s *ChatServer) Broadcast(sender *Client, message string) {
+	_ = s.Send(&Message{Kind: MessageBroadcast, Sender: sender, From: sender.Username, Text: message})
+}
+
+// PrivateMessage sends a message to recipient without going through the inbound chain
+func (s *ChatServer) PrivateMessage(sender *Client, recipient, message string) error {
+	return s.Send(&Message{Kind: MessagePrivate, Sender: sender, From: sender.Username, To: recipient, Text: message})
+}
+
+// Send delivers a broadcast or private message that went through the inbound chain
+func (s *ChatServer) Send(msg *Message) error {
+	if msg.Kind == MessagePrivate {
+		return s.sendPrivate(msg)
+	}
+
+	if err := s.publish(Event{Kind: EventBroadcast, From: msg.From, Text: msg.Text, Meta: msg.Meta}); err != nil {
+		return err
+	}
+	metrics.MessagesTotal.WithLabelValues(metrics.KindBroadcast).Inc()
+	if relay := s.getRelay(); relay != nil {
+		relay.RelayBroadcast(msg.From, msg.Text)
+	}
+	s.notify(ActivityMessage, msg.From, msg.Text)
+	return nil
+}
+
+func (s *ChatServer) sendPrivate(msg *Message) error {
+	sender, recipient, message := msg.Sender, msg.To, msg.Text
 	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	connected := sender.connected
+	muted := s.isMuted(sender.Username)
+	_, local := s.clients[recipient]
+	s.mutex.RUnlock()
 
-	for _, client := range s.clients {
-		if client.Username != sender.Username {
-			client.Send(fmt.Sprintf("[%s]: %s", sender.Username, message))
+	if !connected {
+		return ErrClientDisconnected
+	}
+
+	if muted {
+		return ErrUserMuted
+	}
+
+	if local {
+		s.deliver(Event{Kind: EventPrivate, From: sender.Username, To: recipient, Text: message, Meta: msg.Meta})
+		metrics.MessagesTotal.WithLabelValues(metrics.KindPrivate).Inc()
+		return nil
+	}
+
+	if relay := s.getRelay(); relay != nil && relay.IsRemote(recipient) {
+		ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+		defer cancel()
+		if err := relay.RelayPrivate(ctx, sender.Username, recipient, message); err != nil {
+			return err
 		}
+		metrics.MessagesTotal.WithLabelValues(metrics.KindPrivate).Inc()
+		return nil
 	}
+
+	// the recipient may be connected to another replica
+	return s.publishPrivate(Event{Kind: EventPrivate, From: sender.Username, To: recipient, Text: message, Meta: msg.Meta})
 }
 
-func (s *ChatServer) PrivateMessage(sender *Client, recipient, message string) error {
+// Usernames returns the usernames connected to any replica, sorted
+func (s *ChatServer) Usernames() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	usernames, err := s.backplane.Users(ctx)
+	if err == nil {
+		return usernames
+	}
+	log.Printf("Error listing users: %v\n", err)
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
+	return slices.Sorted(maps.Keys(s.clients))
+}
 
-	if !sender.connected {
-		return ErrClientDisconnected
+// publish sends event to every replica, failures are logged and the event dropped with
+// ErrBackplaneUnavailable
+func (s *ChatServer) publish(event Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	if err := s.backplane.Publish(ctx, event); err != nil {
+		log.Printf("Error publishing %s event: %v\n", event.Kind, err)
+		metrics.MessagesTotal.WithLabelValues(metrics.KindDropped).Inc()
+		return ErrBackplaneUnavailable
 	}
+	return nil
+}
 
-	if client, exists := s.clients[recipient]; !exists {
-		return ErrRecipientNotFound
-	} else if !client.connected {
-		return ErrClientDisconnected
-	} else {
-		client.Send(fmt.Sprintf("[Private] %s : %s", sender.Username, message))
-		return nil
+// deliver hands an event from the backplane to the clients of this replica, messages after the
+// outbound chain
+func (s *ChatServer) deliver(event Event) {
+	switch event.Kind {
+	case EventBroadcast, EventPrivate:
+		kind := MessageBroadcast
+		if event.Kind == EventPrivate {
+			kind = MessagePrivate
+		}
+		msg := &Message{Kind: kind, From: event.From, To: event.To, Text: event.Text, Meta: event.Meta}
+		if err := s.runOutbound(msg); err != nil {
+			metrics.MessagesTotal.WithLabelValues(metrics.KindDropped).Inc()
+			return
+		}
+		event.Text, event.Meta = msg.Text, msg.Meta
+	}
+
+	switch event.Kind {
+	case EventBroadcast:
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+
+		start := time.Now()
+		defer func() { metrics.BroadcastFanoutSeconds.Observe(time.Since(start).Seconds()) }()
+		for _, client := range s.clients {
+			if client.Username != event.From {
+				client.Send(fmt.Sprintf("[%s]: %s", event.From, event.Text))
+			}
+		}
+
+	case EventPrivate:
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+
+		if client, exists := s.clients[event.To]; exists {
+			client.Send(fmt.Sprintf("[Private] %s : %s", event.From, event.Text))
+		}
+
+	case EventAnnounce:
+		s.announce(event.Text)
+
+	case EventTopic:
+		s.mutex.Lock()
+		s.topic = event.Text
+		s.mutex.Unlock()
+		s.announce(fmt.Sprintf("%s changed the topic to: %s", event.From, event.Text))
 	}
 }
 
 // HandleConnection handles a new client connection to the chat server
-func HandleConnection(conn network.Connection, server *ChatServer, cfg *config.Config) {
+func HandleConnection(conn network.Connection, server *ChatServer, store *config.Store) {
 	defer conn.Close()
 
 	conn.WriteLine("Enter your username: ")
 	username, err := conn.ReadLine()
+	if network.IsProtocolError(err) {
+		conn.WriteLine(fmt.Sprintf("protocol error: %v", err))
+		return
+	}
 	if err != nil {
 		return
 	}
 
-	correctPass := passwordChecker(cfg.Security.RequirePassword, cfg.Security.Password, conn)
+	cfg := store.Get()
+	correctPass := passwordChecker(cfg.Security.RequirePassword, cfg.Security.Password.Value(), conn)
 	if !correctPass {
 		return
 	}
 
-	client, err := server.Connect(username, cfg.Server.MaxClients, cfg.RateLimit.MessagePerSecond)
+	serve(conn, username, false, server, store)
+}
+
+// HandleAuthenticated serves a connection whose user the transport already identified (e.g. by an
+// SSH key), without the username and password prompts
+func HandleAuthenticated(conn network.Connection, username string, server *ChatServer, store *config.Store) {
+	defer conn.Close()
+	serve(conn, username, true, server, store)
+}
+
+// serve joins the chat as username and relays messages until the connection ends, authenticated
+// tells whether the transport identified the user
+func serve(conn network.Connection, username string, authenticated bool, server *ChatServer, store *config.Store) {
+	cfg := store.Get()
+	client, err := server.Connect(username, ConnectOptions{
+		Transport:     conn.Transport(),
+		RemoteAddr:    conn.RemoteAddr(),
+		MaxClients:    cfg.Server.MaxClients,
+		RateLimit:     cfg.RateLimit.MessagePerSecond,
+		Authenticated: authenticated,
+		Close:         conn.Close,
+	})
 	if err != nil {
 		conn.WriteLine(err.Error())
 		return
@@ -109,19 +405,17 @@ func HandleConnection(conn network.Connection, server *ChatServer, cfg *config.C
 
 	conn.WriteLine(username + ", Welcome to the Anophel Chat service")
 
-	server.Broadcast(client, "has joined the chat")
+	server.Join(client)
 	defer func() {
-		server.Broadcast(client, fmt.Sprintf("%s has left the chat\n", username))
+		server.Leave(client)
 		server.Disconnect(client)
 	}()
 
-	go func() {
-		for msg := range client.Message {
-			conn.WriteLine(msg)
-		}
-	}()
+	go client.Write(func(msg string) {
+		conn.WriteLine(msg)
+	})
 
-	HandleInputs(conn, client, server, cfg)
+	HandleInputs(conn, client, server)
 }
 
 // passwordChecker check password is required if required match password and return result
@@ -135,6 +429,7 @@ func passwordChecker(requirePassword bool, cfgPassword string, conn network.Conn
 			return false
 		}
 		if password != enteredPassword {
+			metrics.AuthFailures.WithLabelValues(conn.Transport()).Inc()
 			conn.WriteLine("Passwords do not match")
 			return false
 		}
@@ -0,0 +1,232 @@
+// Package sshserver lets users join the chat with `ssh`, their public key is their identity.
+package sshserver
+
+import (
+	"bufio"
+	"bytes"
+	"chat-server/internal/config"
+	"chat-server/internal/metrics"
+	core "chat-server/internal/server"
+	"chat-server/internal/server/network"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Server accepts SSH connections and connects them to the chat server
+type Server struct {
+	core  *core.ChatServer
+	store *config.Store
+}
+
+// New creates an SSH front-end for core
+func New(core *core.ChatServer, store *config.Store) *Server {
+	return &Server{core: core, store: store}
+}
+
+// Serve listens on server.host:ssh.port (or the "ssh" socket passed by systemd) and handles connections in the background. The host key is
+// generated on first start when ssh.hostKeyFile does not exist.
+func (s *Server) Serve(cfg *config.Config) error {
+	hostKey, err := loadHostKey(cfg.SSH.HostKeyFile)
+	if err != nil {
+		return err
+	}
+	sshCfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return authorize(s.store.Get().SSH.AuthorizedKeysFile, key)
+		},
+	}
+	sshCfg.AddHostKey(hostKey)
+
+	listener, err := network.Listen(network.ListenerSSH, cfg.Server.Host, cfg.SSH.Port)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("SSH server listening on %s, host key %s\n", listener.Addr(), ssh.FingerprintSHA256(hostKey.PublicKey()))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("Error accepting SSH connection: %v\n", err)
+				continue
+			}
+			go s.handle(conn, sshCfg)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) handle(netConn net.Conn, sshCfg *ssh.ServerConfig) {
+	conn, channels, requests, err := ssh.NewServerConn(netConn, sshCfg)
+	if err != nil {
+		var authErr *ssh.ServerAuthError
+		if errors.As(err, &authErr) {
+			metrics.AuthFailures.WithLabelValues(network.TransportSSH).Inc()
+		}
+		log.Printf("SSH handshake with %s failed: %v\n", netConn.RemoteAddr(), err)
+		_ = netConn.Close()
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(requests)
+
+	username := conn.Permissions.Extensions["username"]
+	started := false
+	for newChannel := range channels {
+		// one chat session per connection, no port forwarding or other channels
+		if newChannel.ChannelType() != "session" || started {
+			_ = newChannel.Reject(ssh.Prohibited, "only one chat session is supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("Error accepting SSH channel from %s: %v\n", netConn.RemoteAddr(), err)
+			return
+		}
+		started = true
+		go s.session(conn, channel, channelRequests, username)
+	}
+}
+
+// ptyRequest is the payload of a "pty-req" request (RFC 4254 6.2)
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// windowChange is the payload of a "window-change" request (RFC 4254 6.7)
+type windowChange struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// session answers the channel requests, the chat starts with the shell once a PTY was allocated
+func (s *Server) session(conn ssh.Conn, channel ssh.Channel, requests <-chan *ssh.Request, username string) {
+	var terminal *term.Terminal
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			var pty ptyRequest
+			if err := ssh.Unmarshal(req.Payload, &pty); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			terminal = term.NewTerminal(channel, "> ")
+			_ = terminal.SetSize(int(pty.Columns), int(pty.Rows))
+			_ = req.Reply(true, nil)
+
+		case "window-change":
+			var size windowChange
+			if err := ssh.Unmarshal(req.Payload, &size); err == nil && terminal != nil {
+				_ = terminal.SetSize(int(size.Columns), int(size.Rows))
+			}
+
+		case "shell":
+			if terminal == nil {
+				_ = req.Reply(true, nil)
+				fmt.Fprint(channel.Stderr(), "The chat needs a terminal, connect with: ssh -t\r\n")
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+				_ = channel.Close()
+				return
+			}
+			_ = req.Reply(true, nil)
+			go core.HandleAuthenticated(network.NewSSHConnection(conn, channel, terminal), username, s.core, s.store)
+
+		default:
+			// exec, subsystems, env and forwarding are not supported
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// authorize maps key to its username in the authorized keys file, which is read on every login
+// so keys can be added and removed without a restart
+func authorize(path string, key ssh.PublicKey) (*ssh.Permissions, error) {
+	keys, err := readAuthorizedKeys(path)
+	if err != nil {
+		log.Printf("Error reading SSH authorized keys: %v\n", err)
+		return nil, err
+	}
+	username, ok := keys[string(key.Marshal())]
+	if !ok {
+		return nil, fmt.Errorf("unknown public key %s", ssh.FingerprintSHA256(key))
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"username": username}}, nil
+}
+
+// readAuthorizedKeys parses lines of "<username> <authorized_keys entry>", e.g.
+// "alice ssh-ed25519 AAAA... alice@laptop". Invalid lines are logged and skipped.
+func readAuthorizedKeys(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, entry, _ := strings.Cut(line, " ")
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry))
+		if err != nil {
+			log.Printf("Skipping %s line %d: %v\n", path, n, err)
+			continue
+		}
+		keys[string(key.Marshal())] = username
+	}
+	return keys, scanner.Err()
+}
+
+// loadHostKey reads the host private key, generating an ed25519 key when the file does not exist
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate SSH host key: %w", err)
+		}
+		block, err := ssh.MarshalPrivateKey(private, "chat-server host key")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode SSH host key: %w", err)
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write SSH host key: %w", err)
+		}
+		log.Printf("Generated SSH host key %s\n", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read SSH host key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH host key %s: %w", path, err)
+	}
+	return signer, nil
+}
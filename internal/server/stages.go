@@ -0,0 +1,126 @@
+package server
+
+import (
+	"chat-server/internal/config"
+	"chat-server/internal/metrics"
+	"chat-server/utils"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// LengthLimit rejects messages longer than message.maxLength
+func LengthLimit(store *config.Store) Middleware {
+	return func(msg *Message) error {
+		maxLength := store.Get().Message.MaxLength
+		if len(msg.Text) > maxLength {
+			metrics.MessagesTotal.WithLabelValues(metrics.KindDropped).Inc()
+			return fmt.Errorf("%w (max: %d chars)", ErrMessageTooLong, maxLength)
+		}
+		return nil
+	}
+}
+
+// RateLimit rejects the messages of clients over their rate limit. The message a command sends
+// isn't charged again, its line was.
+func RateLimit() Middleware {
+	return func(msg *Message) error {
+		if msg.Sender == nil || msg.Sender.limiter == nil || msg.Command != "" {
+			return nil
+		}
+		if !msg.Sender.Allow() {
+			metrics.RateLimitRejections.WithLabelValues(msg.Sender.Transport).Inc()
+			return ErrRateLimited
+		}
+		return nil
+	}
+}
+
+// ProfanityFilter masks the words of message.profanity in messages, as whole words ignoring case
+func ProfanityFilter(store *config.Store) Middleware {
+	var mutex sync.Mutex
+	var words []string
+	var pattern *regexp.Regexp
+
+	return func(msg *Message) error {
+		current := store.Get().Message.Profanity
+		if msg.Kind == MessageCommand || len(current) == 0 {
+			return nil
+		}
+
+		mutex.Lock()
+		if pattern == nil || !slices.Equal(words, current) {
+			quoted := make([]string, len(current))
+			for i, word := range current {
+				quoted[i] = regexp.QuoteMeta(word)
+			}
+			words, pattern = current, regexp.MustCompile(`(?i)\b(?:`+strings.Join(quoted, "|")+`)\b`)
+		}
+		matcher := pattern
+		mutex.Unlock()
+
+		masked := matcher.ReplaceAllStringFunc(msg.Text, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		})
+		if masked != msg.Text {
+			msg.Text = masked
+			msg.Annotate("profanity", "masked")
+		}
+		return nil
+	}
+}
+
+// Hashing annotates messages with the hash of their text when security.hashMessage is on, the
+// logs then show the hash instead of the text
+func Hashing(store *config.Store) Middleware {
+	return func(msg *Message) error {
+		security := store.Get().Security
+		if !security.HashMessage || msg.Kind == MessageCommand {
+			return nil
+		}
+		hash, err := utils.HashMessage(msg.Text, security.HashAlgorithm, security.HashKey.Value())
+		if err != nil {
+			log.Printf("Error hashing message: %v\n", err)
+			return nil
+		}
+		msg.Annotate("hash", strings.ToLower(security.HashAlgorithm)+":"+hash)
+		return nil
+	}
+}
+
+// Logging logs the messages going through a chain at the debug level, with their hash rather than
+// their text when they have one. Command lines are logged by name, their arguments may be private.
+func Logging(direction string) Middleware {
+	return func(msg *Message) error {
+		if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+			return nil
+		}
+
+		attrs := []any{"direction", direction, "kind", msg.Kind, "from", msg.From}
+		if msg.To != "" {
+			attrs = append(attrs, "to", msg.To)
+		}
+		switch name, _, _ := strings.Cut(msg.Text, " "); {
+		case msg.Kind == MessageCommand:
+			attrs = append(attrs, "command", name)
+		case msg.Meta["hash"] != "":
+			attrs = append(attrs, "hash", msg.Meta["hash"])
+		default:
+			attrs = append(attrs, "text", msg.Text)
+		}
+		for _, key := range slices.Sorted(maps.Keys(msg.Meta)) {
+			if key != "hash" {
+				attrs = append(attrs, key, msg.Meta[key])
+			}
+		}
+		slog.Debug("message", attrs...)
+		return nil
+	}
+}
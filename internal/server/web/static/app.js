@@ -0,0 +1,405 @@
+// Browser client for the chat server. It speaks the same line protocol as the
+// TCP and WebSocket clients: answer the username/password prompts, then every
+// frame is one line such as "[alice]: hi" or "[Private] bob : hello".
+// When WebSockets are blocked (e.g. by a proxy) it falls back to the SSE/POST transport.
+(() => {
+  "use strict";
+
+  const LOBBY = "#lobby";
+  const SCROLLBACK = 1000;
+  const WELCOME = ", Welcome to the Anophel Chat service";
+
+  const $ = (id) => document.getElementById(id);
+
+  const state = {
+    conn: null,
+    wsPath: "/ws",
+    sse: false,
+    username: "",
+    password: "",
+    joined: false,
+    active: LOBBY,
+    conversations: new Map([[LOBBY, { lines: [], unread: false }]]),
+    users: new Set(),
+  };
+
+  // ------------connection-------------
+
+  // the WebSocket path and the SSE fallback are configured on the server
+  fetch("config.json")
+    .then((resp) => resp.json())
+    .then((cfg) => {
+      state.wsPath = cfg.wsPath || state.wsPath;
+      state.sse = Boolean(cfg.sse);
+    })
+    .catch(() => {});
+
+  // a connection is { send(text), close(), open() } over either transport
+  function connect() {
+    state.joined = false;
+    const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+    const ws = new WebSocket(`${scheme}//${location.host}${state.wsPath}`);
+    let opened = false;
+    const conn = {
+      send: (text) => ws.send(text),
+      close: () => ws.close(),
+      open: () => ws.readyState === WebSocket.OPEN,
+    };
+    state.conn = conn;
+
+    ws.onopen = () => { opened = true; };
+    ws.onmessage = (e) => receive(e.data);
+    ws.onclose = () => {
+      if (conn !== state.conn) {
+        return;
+      }
+      if (!opened && state.sse) {
+        connectSSE();
+        return;
+      }
+      closed();
+    };
+  }
+
+  // connectSSE receives over an EventSource and sends with POST requests, with the tokens of a session
+  async function connectSSE() {
+    let token, streamToken;
+    try {
+      const resp = await fetch("/sessions", { method: "POST" });
+      if (!resp.ok) {
+        throw new Error(await resp.text());
+      }
+      ({ token, streamToken } = await resp.json());
+    } catch (err) {
+      state.conn = null;
+      closed();
+      return;
+    }
+
+    // EventSource reconnects by itself and resumes with Last-Event-ID
+    // the URL only holds the read-only stream token, the token sending messages stays in headers
+    const events = new EventSource("/events?stream=" + encodeURIComponent(streamToken));
+    let open = true;
+    let queue = Promise.resolve();
+    const conn = {
+      // chained so messages arrive in order
+      send: (text) => {
+        queue = queue.then(() => fetch("/messages", {
+          method: "POST",
+          headers: { "Authorization": "Bearer " + token, "Content-Type": "text/plain" },
+          body: text,
+        })).catch(() => {});
+      },
+      close: () => {
+        open = false;
+        events.close();
+        fetch("/messages", { method: "POST", headers: { "Authorization": "Bearer " + token }, body: "/quit" })
+          .catch(() => {});
+      },
+      open: () => open,
+    };
+    state.conn = conn;
+
+    events.onmessage = (e) => receive(e.data);
+    events.onerror = () => {
+      // the session is gone once the server refuses the stream
+      if (events.readyState === EventSource.CLOSED && conn === state.conn) {
+        open = false;
+        closed();
+      }
+    };
+  }
+
+  function receive(data) {
+    for (const line of String(data).split("\n")) {
+      handleLine(line.replace(/\r$/, ""));
+    }
+  }
+
+  function closed() {
+    if (!state.joined) {
+      loginError("Connection closed by the server");
+      return;
+    }
+    state.joined = false;
+    state.users.clear();
+    renderUsers();
+    setStatus("disconnected");
+    $("reconnect").hidden = false;
+    system(LOBBY, "connection closed");
+  }
+
+  // disconnect closes the connection without reporting it
+  function disconnect() {
+    const conn = state.conn;
+    state.conn = null;
+    if (conn) {
+      conn.close();
+    }
+  }
+
+  function send(text) {
+    if (!state.conn || !state.conn.open()) {
+      system(state.active, "not connected");
+      return false;
+    }
+    state.conn.send(text);
+    return true;
+  }
+
+  // handleLine answers the join handshake, then dispatches each server line
+  function handleLine(line) {
+    if (!state.joined) {
+      const prompt = line.trim();
+      if (prompt === "Enter your username:") {
+        state.conn.send(state.username);
+      } else if (prompt === "Enter password:") {
+        state.conn.send(state.password);
+      } else if (line.endsWith(WELCOME)) {
+        joined();
+      } else if (prompt !== "") {
+        loginError(prompt);
+        disconnect();
+      }
+      return;
+    }
+
+    if (line.trim() === "" || line.startsWith("ME: ")) {
+      // our own messages are shown when sent
+      return;
+    }
+
+    let m;
+    if ((m = line.match(/^\[Private\] (\S+) : (.*)$/))) {
+      message("@" + m[1], m[1], m[2]);
+    } else if ((m = line.match(/^\[([^\]]+)\]: ?(.*)$/))) {
+      const [, from, text] = m;
+      if (from === "System") {
+        announce(text);
+      } else if (text === "has joined the chat") {
+        state.users.add(from);
+        renderUsers();
+        system(LOBBY, `${from} joined`);
+      } else if (text === from + " has left the chat") {
+        // leaves are broadcast by the user who left: "[bob]: bob has left the chat"
+        state.users.delete(from);
+        renderUsers();
+        system(LOBBY, `${from} left`);
+      } else {
+        message(LOBBY, from, text);
+      }
+    } else if (line.startsWith("Online users: ")) {
+      state.users = new Set(line.slice("Online users: ".length).split(", ").filter(Boolean));
+      renderUsers();
+    } else {
+      system(state.active, line);
+    }
+  }
+
+  function joined() {
+    state.joined = true;
+    state.users = new Set([state.username]);
+    $("login").hidden = true;
+    $("chat").hidden = false;
+    $("reconnect").hidden = true;
+    setStatus("connected as " + state.username);
+    renderConversations();
+    renderUsers();
+    render();
+    send("/users");
+    $("input").focus();
+  }
+
+  // ------------input-------------
+
+  $("login-form").addEventListener("submit", (e) => {
+    e.preventDefault();
+    state.username = $("username").value.trim();
+    state.password = $("password").value;
+    if (state.username === "") {
+      return;
+    }
+    $("login-error").hidden = true;
+    connect();
+  });
+
+  $("reconnect").addEventListener("click", () => {
+    setStatus("reconnecting...");
+    connect();
+  });
+
+  $("send-form").addEventListener("submit", (e) => {
+    e.preventDefault();
+    const input = $("input");
+    const text = input.value.trim();
+    input.value = "";
+    if (text !== "") {
+      submit(text);
+    }
+  });
+
+  // submit sends text to the lobby or to the peer of the active private conversation
+  function submit(text) {
+    if (text === "/quit") {
+      send(text);
+      return;
+    }
+    if (text.startsWith("/pm ")) {
+      const m = text.match(/^\/pm (\S+) (.+)$/);
+      if (!m) {
+        system(state.active, "usage: /pm <username> <message>");
+        return;
+      }
+      if (send(text)) {
+        message("@" + m[1], state.username, m[2]);
+        open("@" + m[1]);
+      }
+      return;
+    }
+    if (text.startsWith("/")) {
+      // other commands are answered by the server
+      send(text);
+      return;
+    }
+    if (state.active === LOBBY) {
+      if (send(text)) {
+        message(LOBBY, state.username, text);
+      }
+      return;
+    }
+    if (send(`/pm ${state.active.slice(1)} ${text}`)) {
+      message(state.active, state.username, text);
+    }
+  }
+
+  // ------------rendering-------------
+
+  function conversation(name) {
+    let c = state.conversations.get(name);
+    if (!c) {
+      c = { lines: [], unread: false };
+      state.conversations.set(name, c);
+      renderConversations();
+    }
+    return c;
+  }
+
+  function append(name, entry) {
+    const c = conversation(name);
+    entry.time = new Date();
+    c.lines.push(entry);
+    if (c.lines.length > SCROLLBACK) {
+      c.lines.splice(0, c.lines.length - SCROLLBACK);
+    }
+    if (name !== state.active) {
+      c.unread = true;
+      renderConversations();
+      return;
+    }
+    const list = $("messages");
+    const atBottom = list.scrollHeight - list.scrollTop - list.clientHeight < 4;
+    list.append(renderEntry(entry));
+    while (list.childElementCount > SCROLLBACK) {
+      list.firstElementChild.remove();
+    }
+    if (atBottom) {
+      list.scrollTop = list.scrollHeight;
+    }
+  }
+
+  function message(name, from, text) {
+    append(name, { from, text });
+  }
+
+  function system(name, text) {
+    append(name, { text: "-- " + text, className: "system" });
+  }
+
+  function announce(text) {
+    append(LOBBY, { text: "** " + text, className: "announce" });
+  }
+
+  function open(name) {
+    conversation(name).unread = false;
+    state.active = name;
+    $("title").textContent = name;
+    renderConversations();
+    render();
+  }
+
+  function render() {
+    const list = $("messages");
+    list.replaceChildren(...conversation(state.active).lines.map(renderEntry));
+    list.scrollTop = list.scrollHeight;
+  }
+
+  // renderEntry only uses textContent, the server relays whatever users type
+  function renderEntry(entry) {
+    const li = document.createElement("li");
+    const time = document.createElement("span");
+    time.className = "time";
+    time.textContent = entry.time.toTimeString().slice(0, 5);
+    li.append(time);
+    if (entry.from) {
+      li.append(nick(entry.from));
+    }
+    const text = document.createElement("span");
+    text.textContent = entry.text;
+    if (entry.className) {
+      text.className = entry.className;
+    }
+    li.append(text);
+    return li;
+  }
+
+  function renderConversations() {
+    const list = $("conversations");
+    list.replaceChildren(...[...state.conversations].map(([name, c]) => {
+      const li = document.createElement("li");
+      li.textContent = name;
+      li.classList.toggle("active", name === state.active);
+      li.classList.toggle("unread", c.unread);
+      li.addEventListener("click", () => open(name));
+      return li;
+    }));
+  }
+
+  function renderUsers() {
+    const users = [...state.users].sort();
+    $("user-count").textContent = `(${users.length})`;
+    $("users").replaceChildren(...users.map((user) => {
+      const li = document.createElement("li");
+      li.append(nick(user));
+      if (user !== state.username) {
+        li.title = "Send a private message";
+        li.addEventListener("click", () => open("@" + user));
+      }
+      return li;
+    }));
+  }
+
+  // nick colors a username with a color derived from its hash, so it is the same everywhere
+  function nick(username) {
+    let hash = 2166136261;
+    for (let i = 0; i < username.length; i++) {
+      hash = Math.imul(hash ^ username.charCodeAt(i), 16777619);
+    }
+    const span = document.createElement("span");
+    span.className = "nick";
+    span.style.color = `hsl(${(hash >>> 0) % 360}, 65%, 45%)`;
+    span.textContent = `<${username}>`;
+    return span;
+  }
+
+  function setStatus(text) {
+    $("status").textContent = text;
+  }
+
+  function loginError(text) {
+    const error = $("login-error");
+    error.textContent = text;
+    error.hidden = false;
+    $("login").hidden = false;
+    $("chat").hidden = true;
+  }
+})();
@@ -0,0 +1,35 @@
+package web
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Options tells the browser client how to reach the server, it is served as /config.json
+type Options struct {
+	// WSPath is the WebSocket endpoint
+	WSPath string `json:"wsPath"`
+	// SSE enables the fallback to the SSE/POST transport when WebSockets are blocked
+	SSE bool `json:"sse"`
+}
+
+// Handler serves the embedded browser client
+func Handler(opts Options) http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(opts)
+	})
+	mux.Handle("/", http.FileServerFS(files))
+	return mux
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package upgrade
+
+import "os"
+
+// Signal is nil, upgrades need Unix descriptor passing
+var Signal os.Signal
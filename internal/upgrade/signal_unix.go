@@ -0,0 +1,11 @@
+//go:build unix
+
+package upgrade
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signal starts an upgrade
+var Signal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,157 @@
+// Package upgrade replaces the running server with a new build without a gap for new connections:
+// the listening sockets are handed to a new process, which accepts on them while this one drains.
+package upgrade
+
+import (
+	"chat-server/internal/config"
+	"chat-server/internal/server/network"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readyFDEnv is the descriptor the new process writes to once it accepts connections
+const readyFDEnv = "UPGRADE_READY_FD"
+
+var ErrUpgradeInProgress = errors.New("an upgrade is already in progress")
+
+// Upgrader starts the process taking over from this one
+type Upgrader struct {
+	store    *config.Store
+	mutex    sync.Mutex
+	started  bool
+	upgraded bool
+}
+
+// New creates an Upgrader
+func New(store *config.Store) *Upgrader {
+	return &Upgrader{store: store}
+}
+
+// Upgrade starts the server binary again with the same arguments and the listening sockets, then
+// waits up to upgrade.readyTimeout for it to accept connections. Both processes accept until the
+// caller closes its listeners. On error the new process is stopped and nothing changed.
+func (u *Upgrader) Upgrade() error {
+	u.mutex.Lock()
+	if u.started {
+		u.mutex.Unlock()
+		return ErrUpgradeInProgress
+	}
+	u.started = true
+	u.mutex.Unlock()
+
+	err := u.start()
+	u.mutex.Lock()
+	u.started, u.upgraded = err == nil, err == nil
+	u.mutex.Unlock()
+	return err
+}
+
+// Upgraded reports whether a new process took over
+func (u *Upgrader) Upgraded() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.upgraded
+}
+
+func (u *Upgrader) start() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the executable: %w", err)
+	}
+	names, files, err := network.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create the ready pipe: %w", err)
+	}
+	defer readyR.Close()
+
+	// ExtraFiles start at fd 3: the sockets, then the ready pipe
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		network.UpgradeFDNamesEnv+"="+strings.Join(names, ":"),
+		fmt.Sprintf("%s=%d", readyFDEnv, 3+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", exe, err)
+	}
+	log.Printf("Started new process %d with %d sockets, waiting until it is ready\n", cmd.Process.Pid, len(files))
+
+	ready := make(chan error, 1)
+	go func() {
+		// EOF means the new process closed the pipe without being ready
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	timeout := time.Duration(u.store.Get().Upgrade.ReadyTimeout) * time.Second
+	select {
+	case err := <-ready:
+		if err != nil {
+			_ = cmd.Process.Kill()
+			return fmt.Errorf("new process %d failed before being ready: %w", cmd.Process.Pid, err)
+		}
+		log.Printf("New process %d is ready\n", cmd.Process.Pid)
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("new process %d exited before being ready: %v", cmd.Process.Pid, err)
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("new process %d not ready after %s", cmd.Process.Pid, timeout)
+	}
+}
+
+// Ready is called once the server accepts connections. It writes pidFile when set, and tells
+// the previous process, when this one was started by an upgrade, that it can stop accepting.
+func Ready(pidFile string) error {
+	if pidFile != "" {
+		// written atomically, a supervisor may read it at any time
+		tmp := filepath.Join(filepath.Dir(pidFile), "."+filepath.Base(pidFile)+".tmp")
+		if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to write pid file: %w", err)
+		}
+		if err := os.Rename(tmp, pidFile); err != nil {
+			return fmt.Errorf("failed to write pid file: %w", err)
+		}
+	}
+
+	value := os.Getenv(readyFDEnv)
+	if value == "" {
+		return nil
+	}
+	_ = os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", readyFDEnv, value)
+	}
+	file := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer file.Close()
+	if _, err := file.Write([]byte{1}); err != nil {
+		return fmt.Errorf("failed to notify the previous process: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package webhook
+
+import (
+	"chat-server/internal/config"
+	"chat-server/internal/metrics"
+	core "chat-server/internal/server"
+	"chat-server/internal/server/network"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxIncomingBody bounds the JSON body of an incoming webhook
+const maxIncomingBody = 64 << 10
+
+// maxUsernameLength bounds the username a poster may choose
+const maxUsernameLength = 32
+
+// IncomingPayload is the JSON body posted to an incoming webhook
+type IncomingPayload struct {
+	Text        string       `json:"text"`
+	Username    string       `json:"username"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment is shown after the text of a message as "📎 title: text <url>"
+type Attachment struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	URL   string `json:"url"`
+}
+
+// IncomingHandler serves POST /hooks/{room}/{token}: the message of the payload is broadcast to the
+// room as if the hook's user sent it. Hooks are read from the config on every request.
+type IncomingHandler struct {
+	core  *core.ChatServer
+	store *config.Store
+
+	mutex    sync.Mutex
+	limiters map[string]*core.TokenBucket
+}
+
+// NewIncomingHandler creates the handler of the incoming webhooks of the config
+func NewIncomingHandler(coreServer *core.ChatServer, store *config.Store) *IncomingHandler {
+	return &IncomingHandler{
+		core:     coreServer,
+		store:    store,
+		limiters: make(map[string]*core.TokenBucket),
+	}
+}
+
+func (h *IncomingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := h.store.Get()
+	hook, ok := findHook(cfg.IncomingWebhooks.Hooks, r.PathValue("room"), r.PathValue("token"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("unknown webhook"))
+		return
+	}
+
+	perMinute := hook.MessagesPerMinute
+	if perMinute == 0 {
+		perMinute = cfg.IncomingWebhooks.MessagesPerMinute
+	}
+	if !h.limiter(hook.Name, perMinute).Allow() {
+		metrics.RateLimitRejections.WithLabelValues(network.TransportWebhook).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(max(60/perMinute, 1)))
+		writeError(w, http.StatusTooManyRequests, fmt.Errorf("rate limit of %d messages per minute exceeded", perMinute))
+		return
+	}
+
+	var payload IncomingPayload
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIncomingBody)).Decode(&payload)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("body too large (max %d bytes)", maxIncomingBody))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New(`expected {"text": "...", "username": "...", "attachments": [{"title": "...", "text": "...", "url": "..."}]}`))
+		return
+	}
+
+	username := hook.Username
+	if payload.Username != "" {
+		if status, err := h.checkUsername(hook, payload.Username); err != nil {
+			writeError(w, status, err)
+			return
+		}
+		username = payload.Username
+	}
+
+	text, err := render(payload, cfg.IncomingWebhooks.MaxAttachments)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sender := &core.Client{Username: username, Transport: network.TransportWebhook, Message: make(chan string, 1)}
+	msg := &core.Message{Kind: core.MessageBroadcast, Sender: sender, From: username, Text: text}
+	if err := h.core.Inbound(msg); errors.Is(err, core.ErrMessageTooLong) {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err := h.core.Send(msg); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+}
+
+// findHook returns the hook of room with token, comparing every token in constant time
+func findHook(hooks []config.IncomingWebhook, room, token string) (config.IncomingWebhook, bool) {
+	var found config.IncomingWebhook
+	ok := false
+	for _, hook := range hooks {
+		if subtle.ConstantTimeCompare([]byte(hook.Token.Value()), []byte(token)) == 1 && hook.Room == room {
+			found, ok = hook, true
+		}
+	}
+	return found, ok
+}
+
+// limiter returns the rate limiter of the hook named name, following changes of its rate
+func (h *IncomingHandler) limiter(name string, perMinute int) *core.TokenBucket {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	limiter, ok := h.limiters[name]
+	if !ok {
+		limiter = core.NewTokenBucket(perMinute, time.Minute/time.Duration(perMinute))
+		h.limiters[name] = limiter
+	}
+	limiter.SetRate(perMinute, time.Minute/time.Duration(perMinute))
+	return limiter
+}
+
+// checkUsername lets a poster pick username when the hook allows it and nobody could mistake the
+// message for one of a connected user or the server
+func (h *IncomingHandler) checkUsername(hook config.IncomingWebhook, username string) (int, error) {
+	switch {
+	case !hook.AllowUsernameOverride:
+		return http.StatusForbidden, errors.New("this webhook doesn't allow a username override")
+	case len(username) > maxUsernameLength || strings.ContainsAny(username, " []@") || strings.ContainsFunc(username, unicode.IsControl):
+		return http.StatusBadRequest, fmt.Errorf("username must be at most %d characters without spaces, brackets or @", maxUsernameLength)
+	case strings.EqualFold(username, "System") || slices.Contains(h.core.Usernames(), username):
+		return http.StatusConflict, fmt.Errorf("username %s is in use", username)
+	}
+	return 0, nil
+}
+
+// render turns payload into a single chat line, attachments follow the text
+func render(payload IncomingPayload, maxAttachments int) (string, error) {
+	if len(payload.Attachments) > maxAttachments {
+		return "", fmt.Errorf("too many attachments (max %d)", maxAttachments)
+	}
+
+	var parts []string
+	if text := singleLine(payload.Text); text != "" {
+		parts = append(parts, text)
+	}
+	for _, attachment := range payload.Attachments {
+		part := singleLine(attachment.Title)
+		if text := singleLine(attachment.Text); text != "" {
+			part = strings.TrimPrefix(part+": "+text, ": ")
+		}
+		if attachment.URL != "" {
+			u, err := url.Parse(attachment.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return "", fmt.Errorf("attachment url must be an http(s) URL, got %q", attachment.URL)
+			}
+			part = strings.TrimSpace(part + " <" + u.String() + ">")
+		}
+		if part != "" {
+			parts = append(parts, "📎 "+part)
+		}
+	}
+
+	if len(parts) == 0 {
+		return "", errors.New("text or attachments are required")
+	}
+	return strings.Join(parts, " | "), nil
+}
+
+// singleLine joins the lines of text and drops control characters, chat messages are one line
+func singleLine(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,248 @@
+// Package webhook POSTs chat events to HTTP endpoints, e.g. to trigger CI bots or ticketing
+// automations. Payloads are JSON signed with HMAC-SHA256, every endpoint has its own delivery
+// queue so a slow or failing endpoint neither delays the chat nor the other endpoints.
+package webhook
+
+import (
+	"bytes"
+	"chat-server/internal/config"
+	"chat-server/internal/metrics"
+	core "chat-server/internal/server"
+	"chat-server/utils"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Events an endpoint can subscribe to
+const (
+	EventMessage = "message"
+	EventJoin    = "join"
+	EventLeave   = "leave"
+	EventMention = "mention"
+	EventKeyword = "keyword"
+)
+
+// Headers of a delivery. SignatureHeader is "sha256=" followed by the hex HMAC-SHA256 of the body
+// keyed with the secret of the endpoint.
+const (
+	SignatureHeader = "X-Chat-Signature"
+	EventHeader     = "X-Chat-Event"
+	DeliveryHeader  = "X-Chat-Delivery"
+)
+
+const (
+	firstBackoff = time.Second
+	maxBackoff   = time.Minute
+)
+
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@(\S+)`)
+
+// Payload is the JSON body POSTed to an endpoint. ID stays the same across retries.
+type Payload struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Room      string    `json:"room"`
+	User      string    `json:"user"`
+	Text      string    `json:"text,omitempty"`
+	Mentions  []string  `json:"mentions,omitempty"`
+	Keywords  []string  `json:"keywords,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Dispatcher turns chat activity into deliveries to the configured endpoints
+type Dispatcher struct {
+	endpoints  []*endpoint
+	client     *http.Client
+	maxRetries int
+}
+
+type endpoint struct {
+	cfg      config.WebhookEndpoint
+	keywords []string
+	queue    chan Payload
+}
+
+// New creates a dispatcher for the endpoints of cfg and starts delivering
+func New(cfg config.WebhooksConfig) *Dispatcher {
+	d := &Dispatcher{
+		client:     &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		maxRetries: cfg.MaxRetries,
+	}
+	for _, endpointCfg := range cfg.Endpoints {
+		e := &endpoint{
+			cfg:   endpointCfg,
+			queue: make(chan Payload, cfg.QueueSize),
+		}
+		for _, keyword := range endpointCfg.Keywords {
+			e.keywords = append(e.keywords, strings.ToLower(keyword))
+		}
+		d.endpoints = append(d.endpoints, e)
+		go d.deliver(e)
+	}
+	return d
+}
+
+// Handle queues the events of activity for the endpoints subscribed to them, it never blocks.
+// It is meant to be registered with ChatServer.AddHook.
+func (d *Dispatcher) Handle(activity core.Activity) {
+	payload := Payload{
+		Room:      activity.Room,
+		User:      activity.Username,
+		Text:      activity.Text,
+		Timestamp: activity.Time.UTC(),
+	}
+	var mentions []string
+	if activity.Kind == core.ActivityMessage {
+		mentions = parseMentions(activity.Text)
+	}
+
+	for _, e := range d.endpoints {
+		if len(e.cfg.Rooms) > 0 && !slices.Contains(e.cfg.Rooms, activity.Room) {
+			continue
+		}
+		fromUser := len(e.cfg.Users) == 0 || slices.Contains(e.cfg.Users, activity.Username)
+
+		switch activity.Kind {
+		case core.ActivityJoin, core.ActivityLeave:
+			if fromUser {
+				e.enqueue(payload, activity.Kind)
+			}
+		case core.ActivityMessage:
+			if fromUser {
+				e.enqueue(payload, EventMessage)
+			}
+			// a mention concerns the mentioned users as much as the sender
+			if len(mentions) > 0 && (fromUser || slices.ContainsFunc(mentions, func(m string) bool { return slices.Contains(e.cfg.Users, m) })) {
+				mention := payload
+				mention.Mentions = mentions
+				e.enqueue(mention, EventMention)
+			}
+			if keywords := e.matchKeywords(activity.Text); fromUser && len(keywords) > 0 {
+				keyword := payload
+				keyword.Keywords = keywords
+				e.enqueue(keyword, EventKeyword)
+			}
+		}
+	}
+}
+
+// enqueue queues payload as event when e subscribes to it, the delivery is dropped when the queue is full
+func (e *endpoint) enqueue(payload Payload, event string) {
+	if !slices.Contains(e.cfg.Events, event) {
+		return
+	}
+	payload.ID = newID()
+	payload.Event = event
+
+	select {
+	case e.queue <- payload:
+	default:
+		log.Printf("Dropping %s webhook for %s: queue full\n", event, e.cfg.Name)
+		metrics.WebhookDeliveries.WithLabelValues(e.cfg.Name, metrics.WebhookDropped).Inc()
+	}
+}
+
+// matchKeywords returns the keywords of e that text contains, ignoring case
+func (e *endpoint) matchKeywords(text string) []string {
+	text = strings.ToLower(text)
+	var matched []string
+	for i, keyword := range e.keywords {
+		if strings.Contains(text, keyword) {
+			matched = append(matched, e.cfg.Keywords[i])
+		}
+	}
+	return matched
+}
+
+// deliver sends the queued payloads of e in order, retrying each with exponential backoff
+func (d *Dispatcher) deliver(e *endpoint) {
+	for payload := range e.queue {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Error encoding %s webhook for %s: %v\n", payload.Event, e.cfg.Name, err)
+			continue
+		}
+
+		for attempt := 0; ; attempt++ {
+			retry, err := d.post(e, payload, body)
+			if err == nil {
+				metrics.WebhookDeliveries.WithLabelValues(e.cfg.Name, metrics.WebhookDelivered).Inc()
+				break
+			}
+			if !retry || attempt >= d.maxRetries {
+				log.Printf("Webhook %s failed after %d attempts, dropping %s event %s: %v\n", e.cfg.Name, attempt+1, payload.Event, payload.ID, err)
+				metrics.WebhookDeliveries.WithLabelValues(e.cfg.Name, metrics.WebhookFailed).Inc()
+				break
+			}
+			time.Sleep(backoff(attempt))
+		}
+	}
+}
+
+// post sends one delivery, retry reports whether a failure may succeed later (network errors,
+// 429 and 5xx responses)
+func (d *Dispatcher) post(e *endpoint, payload Payload, body []byte) (retry bool, err error) {
+	signature, err := utils.HashMessage(string(body), "hmac-sha256", e.cfg.Secret.Value())
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, e.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-server-webhook")
+	req.Header.Set(EventHeader, payload.Event)
+	req.Header.Set(DeliveryHeader, payload.ID)
+	req.Header.Set(SignatureHeader, "sha256="+signature)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+}
+
+// backoff is the delay before retry number attempt+1: 1s, 2s, 4s, ... up to a minute
+func backoff(attempt int) time.Duration {
+	return min(firstBackoff<<min(attempt, 16), maxBackoff)
+}
+
+// parseMentions returns the users mentioned as @username (or @user@server) in text
+func parseMentions(text string) []string {
+	var mentions []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		username := strings.TrimRight(m[1], ".,:;!?)")
+		if username != "" && !slices.Contains(mentions, username) {
+			mentions = append(mentions, username)
+		}
+	}
+	return mentions
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
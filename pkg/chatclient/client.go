@@ -0,0 +1,282 @@
+// Package chatclient is a Go client for the chat server. It speaks the TCP, WebSocket and gRPC
+// transports behind one API, answers the join handshake, reconnects automatically and
+// delivers what the server sends as typed events.
+//
+//	client, err := chatclient.Dial(ctx, chatclient.Options{Transport: chatclient.TCP, Address: "localhost:8080"})
+//	if err != nil { ... }
+//	defer client.Close()
+//	if err := client.Join(ctx, "bot", ""); err != nil { ... }
+//	for evt := range client.Messages() { ... }
+package chatclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport selects how the client talks to the server
+type Transport string
+
+const (
+	TCP       Transport = "tcp"
+	WebSocket Transport = "websocket"
+	GRPC      Transport = "gRPC"
+)
+
+// Common errors returned by the client
+var (
+	ErrJoinRefused  = errors.New("join refused")
+	ErrNotJoined    = errors.New("not joined")
+	ErrNotConnected = errors.New("not connected")
+	ErrClosed       = errors.New("client closed")
+)
+
+// Options configures a client
+type Options struct {
+	Transport Transport
+	// Address is host:port for TCP and gRPC, and the full URL (ws://host:port/ws) for WebSocket
+	Address string
+	// TLSConfig enables TLS (TLS over TCP, WSS or gRPC with TLS) when set
+	TLSConfig *tls.Config
+	// Reconnect makes the client dial and join again when the connection drops
+	Reconnect bool
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts, default 1s and 30s
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Buffer is the capacity of the Messages channel, default 64
+	Buffer int
+}
+
+// Client is a connection to the chat server, safe for concurrent use
+type Client struct {
+	opts     Options
+	events   chan Event
+	closed   chan struct{}
+	mutex    sync.Mutex
+	session  session
+	username string
+	password string
+	joined   bool
+	once     sync.Once
+}
+
+// Dial connects to the server, the client must then Join before sending messages
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = 64
+	}
+
+	sess, err := dialSession(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s %s: %w", opts.Transport, opts.Address, err)
+	}
+
+	return &Client{
+		opts:    opts,
+		events:  make(chan Event, opts.Buffer),
+		closed:  make(chan struct{}),
+		session: sess,
+	}, nil
+}
+
+// Join answers the username (and password) prompts, then starts delivering events on Messages
+func (c *Client) Join(ctx context.Context, username, password string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.joined {
+		return fmt.Errorf("already joined as %s", c.username)
+	}
+	if c.session == nil {
+		return ErrClosed
+	}
+
+	if err := runWithContext(ctx, c.session, func() error { return c.session.join(username, password) }); err != nil {
+		return err
+	}
+
+	c.username, c.password, c.joined = username, password, true
+	go c.readLoop(c.session)
+	return nil
+}
+
+// Send broadcasts text to every other user
+func (c *Client) Send(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return errors.New("message must be a single line")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.joined {
+		return ErrNotJoined
+	}
+	if c.session == nil {
+		return ErrNotConnected
+	}
+	return c.session.send(text)
+}
+
+// PrivateMessage sends text to a single user
+func (c *Client) PrivateMessage(to, text string) error {
+	if to == "" || strings.ContainsAny(to, " \r\n") {
+		return fmt.Errorf("invalid recipient %q", to)
+	}
+	return c.Send(fmt.Sprintf("/pm %s %s", to, text))
+}
+
+// RequestUsers asks the server for the online users, the answer arrives as an EventUsers
+func (c *Client) RequestUsers() error {
+	return c.Send("/users")
+}
+
+// Messages returns the events sent by the server, the channel is closed once the client is closed
+// or the connection is lost without reconnect
+func (c *Client) Messages() <-chan Event {
+	return c.events
+}
+
+// Close leaves the chat and closes the connection
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.session != nil {
+			if c.joined {
+				_ = c.session.send("/quit")
+			}
+			err = c.session.close()
+			c.session = nil
+		}
+		if !c.joined {
+			close(c.events)
+		}
+	})
+	return err
+}
+
+// readLoop delivers the events of sess until it fails, then reconnects if enabled.
+// It is the only goroutine closing the events channel once the client joined.
+func (c *Client) readLoop(sess session) {
+	defer close(c.events)
+	for {
+		err := c.deliver(sess)
+		if err == nil {
+			return
+		}
+
+		c.mutex.Lock()
+		if c.session == sess {
+			_ = sess.close()
+			c.session = nil
+		}
+		c.mutex.Unlock()
+
+		if !c.emit(Event{Type: EventDisconnected, Time: time.Now(), Err: err}) || !c.opts.Reconnect {
+			return
+		}
+
+		next, ok := c.reconnect()
+		if !ok || !c.emit(newEvent(EventReconnected, "", "reconnected as "+c.username)) {
+			return
+		}
+		sess = next
+	}
+}
+
+// deliver emits the events of sess until it fails, it returns nil when the client stopped
+// listening and the receive error otherwise
+func (c *Client) deliver(sess session) error {
+	for {
+		evt, ok, err := sess.recv()
+		if err != nil {
+			return err
+		}
+		if ok && !c.emit(evt) {
+			return nil
+		}
+	}
+}
+
+// reconnect dials and joins again with exponential backoff until it succeeds or the client is closed
+func (c *Client) reconnect() (session, bool) {
+	backoff := c.opts.MinBackoff
+	for {
+		select {
+		case <-c.closed:
+			return nil, false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.MaxBackoff)
+		sess, err := dialSession(ctx, c.opts)
+		if err == nil {
+			err = runWithContext(ctx, sess, func() error { return sess.join(c.username, c.password) })
+			if err != nil {
+				_ = sess.close()
+			}
+		}
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		c.mutex.Lock()
+		select {
+		case <-c.closed:
+			c.mutex.Unlock()
+			_ = sess.close()
+			return nil, false
+		default:
+		}
+		c.session = sess
+		c.mutex.Unlock()
+		return sess, true
+	}
+}
+
+// emit delivers evt unless the client is closed
+func (c *Client) emit(evt Event) bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	select {
+	case c.events <- evt:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// runWithContext runs fn, closing sess to unblock it if ctx ends first
+func runWithContext(ctx context.Context, sess session, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = sess.close()
+		<-done
+		return ctx.Err()
+	}
+}
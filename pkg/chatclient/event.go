@@ -0,0 +1,130 @@
+package chatclient
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// EventType tells what an Event carries
+type EventType int
+
+const (
+	// EventChat is a message broadcast by another user
+	EventChat EventType = iota
+	// EventPrivate is a private message sent to this client
+	EventPrivate
+	// EventEcho is the server's copy of a message this client sent
+	EventEcho
+	// EventJoin reports that a user joined the chat
+	EventJoin
+	// EventLeave reports that a user left the chat
+	EventLeave
+	// EventAnnouncement is a system message from the server operators
+	EventAnnouncement
+	// EventNotice is any other server message: errors, rate limit warnings, kicks...
+	EventNotice
+	// EventDisconnected reports that the connection was lost, Err holds the cause
+	EventDisconnected
+	// EventReconnected reports that the client reconnected and joined again
+	EventReconnected
+	// EventUsers lists the online users in Users, it answers RequestUsers
+	EventUsers
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventChat:
+		return "chat"
+	case EventPrivate:
+		return "private"
+	case EventEcho:
+		return "echo"
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventAnnouncement:
+		return "announcement"
+	case EventUsers:
+		return "users"
+	case EventNotice:
+		return "notice"
+	case EventDisconnected:
+		return "disconnected"
+	case EventReconnected:
+		return "reconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something the server sent, or a change of the connection state
+type Event struct {
+	Type  EventType
+	From  string
+	Text  string
+	Users []string
+	Time  time.Time
+	Err   error
+}
+
+const (
+	systemSender  = "System"
+	joinedText    = "has joined the chat"
+	leftText      = " has left the chat"
+	welcomeSuffix = ", Welcome to the Anophel Chat service"
+	echoPrefix    = "ME: "
+	usersPrefix   = "Online users: "
+)
+
+var (
+	chatPattern    = regexp.MustCompile(`^\[(.+?)\]:\s*(.*)$`)
+	privatePattern = regexp.MustCompile(`^\[Private\] (.+?) : (.*)$`)
+)
+
+// parseLine turns a line of the TCP/WebSocket protocol into an event
+func parseLine(line string) Event {
+	line = strings.TrimRight(line, "\r\n")
+	if text, ok := strings.CutPrefix(line, echoPrefix); ok {
+		return newEvent(EventEcho, "", text)
+	}
+	if m := privatePattern.FindStringSubmatch(line); m != nil {
+		return newEvent(EventPrivate, m[1], m[2])
+	}
+	if m := chatPattern.FindStringSubmatch(line); m != nil {
+		return chatEvent(m[1], m[2])
+	}
+	return noticeEvent(line)
+}
+
+// noticeEvent classifies a server notice
+func noticeEvent(text string) Event {
+	if list, ok := strings.CutPrefix(text, usersPrefix); ok {
+		evt := newEvent(EventUsers, "", text)
+		if list != "" {
+			evt.Users = strings.Split(list, ", ")
+		}
+		return evt
+	}
+	return newEvent(EventNotice, "", text)
+}
+
+// chatEvent classifies a "[from]: text" message
+func chatEvent(from, text string) Event {
+	text = strings.TrimRight(text, "\r\n")
+	switch {
+	case from == systemSender:
+		return newEvent(EventAnnouncement, from, text)
+	case text == joinedText:
+		return newEvent(EventJoin, from, text)
+	case text == from+leftText:
+		return newEvent(EventLeave, from, text)
+	default:
+		return newEvent(EventChat, from, text)
+	}
+}
+
+func newEvent(t EventType, from, text string) Event {
+	return Event{Type: t, From: from, Text: text, Time: time.Now()}
+}
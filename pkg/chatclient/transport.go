@@ -0,0 +1,235 @@
+package chatclient
+
+import (
+	"bufio"
+	chatpb "chat-server/internal/server/network/grpc"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// session is one live connection to the server, whatever the transport
+type session interface {
+	join(username, password string) error
+	send(text string) error
+	recv() (Event, bool, error)
+	close() error
+}
+
+// dialSession opens a session over the transport selected in opts
+func dialSession(ctx context.Context, opts Options) (session, error) {
+	switch opts.Transport {
+	case TCP:
+		dialer := &net.Dialer{}
+		var conn net.Conn
+		var err error
+		if opts.TLSConfig != nil {
+			conn, err = (&tls.Dialer{NetDialer: dialer, Config: opts.TLSConfig}).DialContext(ctx, "tcp", opts.Address)
+		} else {
+			conn, err = dialer.DialContext(ctx, "tcp", opts.Address)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &lineSession{lines: &tcpLines{conn: conn, reader: bufio.NewReader(conn)}}, nil
+
+	case WebSocket:
+		dialer := websocket.Dialer{TLSClientConfig: opts.TLSConfig}
+		conn, _, err := dialer.DialContext(ctx, opts.Address, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &lineSession{lines: &wsLines{conn: conn}}, nil
+
+	case GRPC:
+		creds := insecure.NewCredentials()
+		if opts.TLSConfig != nil {
+			creds = credentials.NewTLS(opts.TLSConfig)
+		}
+		conn, err := grpc.NewClient(opts.Address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		streamCtx, cancel := context.WithCancel(context.Background())
+		stream, err := chatpb.NewChatServiceClient(conn).Chat(streamCtx)
+		if err != nil {
+			cancel()
+			conn.Close()
+			return nil, err
+		}
+		return &grpcSession{conn: conn, stream: stream, cancel: cancel}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown transport %q", opts.Transport)
+	}
+}
+
+// ------------TCP/WEBSOCKET-------------
+
+// lines is the line oriented protocol spoken over TCP and WebSocket
+type lines interface {
+	readLine() (string, error)
+	writeLine(line string) error
+	close() error
+}
+
+type tcpLines struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (l *tcpLines) readLine() (string, error) {
+	line, err := l.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (l *tcpLines) writeLine(line string) error {
+	_, err := l.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+func (l *tcpLines) close() error {
+	return l.conn.Close()
+}
+
+type wsLines struct {
+	conn *websocket.Conn
+}
+
+func (l *wsLines) readLine() (string, error) {
+	_, msg, err := l.conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+func (l *wsLines) writeLine(line string) error {
+	return l.conn.WriteMessage(websocket.TextMessage, []byte(line))
+}
+
+func (l *wsLines) close() error {
+	return l.conn.Close()
+}
+
+// lineSession answers the server prompts and parses the lines it sends
+type lineSession struct {
+	lines lines
+}
+
+func (s *lineSession) join(username, password string) error {
+	if _, err := s.lines.readLine(); err != nil {
+		return err
+	}
+	if err := s.lines.writeLine(username); err != nil {
+		return err
+	}
+
+	line, err := s.lines.readLine()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) == "Enter password:" {
+		if err := s.lines.writeLine(password); err != nil {
+			return err
+		}
+		if line, err = s.lines.readLine(); err != nil {
+			return err
+		}
+	}
+
+	if !strings.HasSuffix(line, welcomeSuffix) {
+		return fmt.Errorf("%w: %s", ErrJoinRefused, line)
+	}
+	return nil
+}
+
+func (s *lineSession) send(text string) error {
+	return s.lines.writeLine(text)
+}
+
+func (s *lineSession) recv() (Event, bool, error) {
+	line, err := s.lines.readLine()
+	if err != nil {
+		return Event{}, false, err
+	}
+	if strings.TrimSpace(line) == "" {
+		return Event{}, false, nil
+	}
+	return parseLine(line), true, nil
+}
+
+func (s *lineSession) close() error {
+	return s.lines.close()
+}
+
+// ------------gRPC-------------
+
+type grpcSession struct {
+	conn   *grpc.ClientConn
+	stream grpc.BidiStreamingClient[chatpb.ClientEvent, chatpb.ServerEvent]
+	cancel context.CancelFunc
+}
+
+func (s *grpcSession) join(username, password string) error {
+	if _, err := s.stream.Recv(); err != nil {
+		return err
+	}
+	join := &chatpb.ClientEvent{Payload: &chatpb.ClientEvent_Join{Join: &chatpb.Join{Username: username, Password: password}}}
+	if err := s.stream.Send(join); err != nil {
+		return err
+	}
+
+	evt, err := s.stream.Recv()
+	if err != nil {
+		return err
+	}
+	if prompt := evt.GetPrompt(); prompt != nil {
+		return fmt.Errorf("%w: %s", ErrJoinRefused, "password required")
+	}
+	if text := evt.GetNotice().GetText(); !strings.HasSuffix(text, welcomeSuffix) {
+		return fmt.Errorf("%w: %s", ErrJoinRefused, text)
+	}
+	return nil
+}
+
+func (s *grpcSession) send(text string) error {
+	return s.stream.Send(&chatpb.ClientEvent{Payload: &chatpb.ClientEvent_Text{Text: &chatpb.Text{Message: text}}})
+}
+
+func (s *grpcSession) recv() (Event, bool, error) {
+	evt, err := s.stream.Recv()
+	if err != nil {
+		return Event{}, false, err
+	}
+
+	switch payload := evt.GetPayload().(type) {
+	case *chatpb.ServerEvent_Echo:
+		return newEvent(EventEcho, "", payload.Echo.GetText()), true, nil
+	case *chatpb.ServerEvent_Chat:
+		if payload.Chat.GetFrom() == "" {
+			// messages the server could not split, e.g. private messages, keep the line format
+			return parseLine(payload.Chat.GetText()), true, nil
+		}
+		return chatEvent(payload.Chat.GetFrom(), payload.Chat.GetText()), true, nil
+	case *chatpb.ServerEvent_Notice:
+		return noticeEvent(payload.Notice.GetText()), true, nil
+	default:
+		return Event{}, false, nil
+	}
+}
+
+func (s *grpcSession) close() error {
+	s.cancel()
+	return s.conn.Close()
+}